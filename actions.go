@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// action is a single step of an action pipeline. Which fields are used depends on `Type`:
+//
+//	sound           : `sound` holds a legacy sound action (start/select/song/tts)
+//	start/select/song: play music, optionally restricted by `artist`, `album`, `title`; `start` may set the shuffle `mode`
+//	tts             : speak `text` using text-to-speech
+//	sfx             : play the audio file `file`
+//	vtube           : set the veadotube state to `state`
+//	say (or chat)   : send the template `text` to the Twitch chat, as a reply to the triggering message if `reply` is set
+//	request         : add the song named in the user's input ("Title" or "Artist - Title") to the request queue
+//	tags            : only choose random songs with `tags` (or without, for tags starting with "-"); no tags allows any song
+//	vodsafe         : turn VOD-safe mode "on" or "off", or "toggle" it, according to `state`
+//	nowplaying      : reply with the current song and how far through it playback is
+//	history         : reply with the recently played songs
+//	lastsong        : reply with the song played before the current one
+//	next            : reply with the songs coming up next
+//	wait            : pause the pipeline for `duration` (e.g. "1.5s")
+//	obs             : send the OBS WebSocket request `request` with `data`
+//	http            : send a `method` request to `url`, with `body` and `headers`
+//	sequence        : run `actions` in order
+//	parallel        : run `actions` concurrently, waiting for all of them
+type action struct {
+	Type string     `json:"type"`
+	If   *condition `json:"if,omitempty"`
+
+	Sound    *soundAction      `json:"sound,omitempty"`
+	Text     string            `json:"text,omitempty"`
+	Artist   string            `json:"artist,omitempty"`
+	Album    string            `json:"album,omitempty"`
+	Song     string            `json:"title,omitempty"`
+	File     string            `json:"file,omitempty"`
+	State    string            `json:"state,omitempty"`
+	Duration string            `json:"duration,omitempty"`
+	Request  string            `json:"request,omitempty"`
+	Data     map[string]any    `json:"data,omitempty"`
+	URL      string            `json:"url,omitempty"`
+	Method   string            `json:"method,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Actions  []action          `json:"actions,omitempty"`
+	Reply    bool              `json:"reply,omitempty"`
+	Mode     string            `json:"mode,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+}
+
+// condition gates an action; every field which is set must hold for the action to run.
+type condition struct {
+	// Probability, between 0 and 1, that the action runs.
+	Chance *float64 `json:"chance,omitempty"`
+	// Users allowed to trigger the action (case insensitive).
+	Users []string `json:"users,omitempty"`
+	// Regular expression which the user's input must match.
+	Input string `json:"input,omitempty"`
+	// Whether music must be playing (true) or stopped (false).
+	Playing *bool `json:"playing,omitempty"`
+}
+
+// trigger describes what caused an action pipeline to run.
+type trigger struct {
+	// Either "chat", "reward" or "console".
+	Source string
+	User   string
+	// Any text supplied alongside the trigger: the rest of the chat message, or the reward's user input.
+	Input string
+	// ID of the triggering chat message, if any, for replies.
+	MessageID string
+}
+
+type actionHandler func(a action, tr trigger) error
+
+// actionHandlers maps each action type to its implementation.
+// New action types only need to be registered here to be usable from both chat commands and rewards.
+var actionHandlers map[string]actionHandler
+
+func init() {
+	actionHandlers = map[string]actionHandler{
+		"sound":      runSoundAction,
+		"start":      runMusicAction,
+		"select":     runMusicAction,
+		"song":       runMusicAction,
+		"tts":        runTTSAction,
+		"sfx":        runSFXAction,
+		"vtube":      runVTubeAction,
+		"say":        runSayAction,
+		"chat":       runSayAction,
+		"request":    runRequestAction,
+		"tags":       runTagsAction,
+		"vodsafe":    runVODSafeAction,
+		"nowplaying": runNowPlayingAction,
+		"history":    runHistoryAction,
+		"lastsong":   runLastSongAction,
+		"next":       runNextAction,
+		"wait":       runWaitAction,
+		"obs":        runOBSAction,
+		"http":       runHTTPAction,
+		"sequence":   runSequenceAction,
+		"parallel":   runParallelAction,
+	}
+}
+
+// pipeline builds the list of actions to run for a command or reward, converting the
+// legacy `sound` and `vtubeState` fields into their equivalent actions.
+func pipeline(sound *soundAction, vtubeState string, actions []action) []action {
+	var p []action
+	if sound != nil && sound.Type != "" {
+		p = append(p, action{Type: "sound", Sound: sound})
+	}
+	if vtubeState != "" {
+		p = append(p, action{Type: "vtube", State: vtubeState})
+	}
+	return append(p, actions...)
+}
+
+// runPipeline runs each of the actions in order, skipping those whose condition does not hold.
+func runPipeline(actions []action, tr trigger) {
+	for _, a := range actions {
+		err := runAction(a, tr)
+		if err != nil {
+			slog.Error("Error running action", "type", a.Type, "err", err)
+		}
+	}
+}
+
+// Most pipelines which may wait to run for each trigger, beyond which further uses are dropped.
+const maxWaitingPipelines = 16
+
+// pipelineQueues holds the pipelines waiting to run for each trigger, by the trigger's name.
+var pipelineQueues struct {
+	sync.Mutex
+	queues map[string]chan func()
+}
+
+// startPipeline runs the actions in the background, so that chat and PubSub are not held up
+// by waits, speech or sound effects. Pipelines for the same trigger (named by `key`) run one at
+// a time, in the order they were started.
+func startPipeline(key string, actions []action, tr trigger) {
+	pipelineQueues.Lock()
+	defer pipelineQueues.Unlock()
+	if pipelineQueues.queues == nil {
+		pipelineQueues.queues = make(map[string]chan func())
+	}
+	q, ok := pipelineQueues.queues[key]
+	if !ok {
+		q = make(chan func(), maxWaitingPipelines)
+		pipelineQueues.queues[key] = q
+		go func() {
+			for run := range q {
+				run()
+			}
+		}()
+	}
+	select {
+	case q <- func() { runPipeline(actions, tr) }:
+	default:
+		slog.Warn("Too many actions are waiting to run; ignoring the trigger", "trigger", key, "user", tr.User)
+	}
+}
+
+func runAction(a action, tr trigger) error {
+	if !a.If.holds(tr) {
+		return nil
+	}
+	h, ok := actionHandlers[a.Type]
+	if !ok {
+		return errors.New("unknown action type")
+	}
+	return h(a, tr)
+}
+
+func (c *condition) holds(tr trigger) bool {
+	if c == nil {
+		return true
+	}
+	if c.Chance != nil && rand.Float64() >= *c.Chance {
+		return false
+	}
+	if len(c.Users) > 0 {
+		found := false
+		for _, u := range c.Users {
+			if strings.EqualFold(u, tr.User) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.Input != "" {
+		matched, err := regexp.MatchString(c.Input, tr.Input)
+		if err != nil {
+			slog.Warn("Invalid input condition", "err", err)
+			return false
+		}
+		if !matched {
+			return false
+		}
+	}
+	if c.Playing != nil && musicPlayer.Playing() != *c.Playing {
+		return false
+	}
+	return true
+}
+
+func runSoundAction(a action, tr trigger) error {
+	if a.Sound == nil {
+		return errors.New("missing sound")
+	}
+	completeSoundAction(*a.Sound, tr)
+	return nil
+}
+
+func runMusicAction(a action, tr trigger) error {
+	completeSoundAction(soundAction{
+		Type:   a.Type,
+		Artist: a.Artist,
+		Album:  a.Album,
+		Song:   a.Song,
+		Mode:   a.Mode,
+	}, tr)
+	return nil
+}
+
+func runTTSAction(a action, tr trigger) error {
+	completeSoundAction(soundAction{
+		Type: "tts",
+		Text: a.Text,
+	}, tr)
+	return nil
+}
+
+func runSFXAction(a action, _ trigger) error {
+	// each effect gets its own player, so that effects may overlap one another and the music
+	p := twedia.NewPlayer()
+	defer p.Close()
+	return p.PlayFile(a.File)
+}
+
+func runVTubeAction(a action, _ trigger) error {
+	if v == nil {
+		return errors.New("no veadotube instance")
+	}
+	v.SetState(a.State)
+	return nil
+}
+
+func runSayAction(a action, tr trigger) error {
+	tmpl, err := template.New("say").Parse(a.Text)
+	if err != nil {
+		return err
+	}
+
+	d := nowPlayingData(messageData{
+		User:  tr.User,
+		Input: tr.Input,
+	})
+
+	replyTo := ""
+	if a.Reply {
+		replyTo = tr.MessageID
+	}
+	say(renderTemplate(tmpl, d), replyTo)
+	return nil
+}
+
+func runRequestAction(_ action, tr trigger) error {
+	d := messageData{
+		User:  tr.User,
+		Input: tr.Input,
+	}
+
+	artist, album, song := twedia.FindSong(music(), tr.Input)
+	if song == nil {
+		d.Error = "no such song"
+		sendMessage("requestRejected", d, tr.MessageID)
+		return nil
+	}
+	if vodSafeBlocks(artist, album, song) {
+		d.Error = "it would get the VOD muted"
+		sendMessage("requestRejected", d, tr.MessageID)
+		return nil
+	}
+	if isQueued(*artist, *song) {
+		d.Error = "it is already in the queue"
+		sendMessage("requestRejected", d, tr.MessageID)
+		return nil
+	}
+
+	d.setTrack(artist, album, song)
+	d.Position = enqueue(queuedTrack{
+		Artist: *artist,
+		Album:  *album,
+		Song:   *song,
+		User:   tr.User,
+	})
+	sendMessage("requestAccepted", d, tr.MessageID)
+
+	ensurePlaying(tr)
+	return nil
+}
+
+func runTagsAction(a action, _ trigger) error {
+	setTagFilter(a.Tags)
+	return nil
+}
+
+func runVODSafeAction(a action, _ trigger) error {
+	return setVODSafeMode(a.State)
+}
+
+func runNowPlayingAction(_ action, tr trigger) error {
+	sendMessage("currentSong", nowPlayingData(messageData{
+		User:  tr.User,
+		Input: tr.Input,
+	}), tr.MessageID)
+	return nil
+}
+
+func runHistoryAction(_ action, tr trigger) error {
+	n := 5
+	if config.History != nil && config.History.Length > 0 {
+		n = config.History.Length
+	}
+	sendMessage("history", messageData{
+		User:    tr.User,
+		Input:   tr.Input,
+		History: recentHistory(n),
+	}, tr.MessageID)
+	return nil
+}
+
+func runLastSongAction(_ action, tr trigger) error {
+	d := messageData{
+		User:  tr.User,
+		Input: tr.Input,
+	}
+	recent := recentHistory(2)
+	if _, ok := nowPlaying(); ok && len(recent) > 0 {
+		// the most recent entry is the song which is playing now
+		recent = recent[1:]
+	}
+	if len(recent) > 0 {
+		e := recent[0]
+		d.Song, d.Artist, d.Album, d.URL = e.Song, e.Artist, e.Album, e.URL
+	}
+	sendMessage("lastSong", d, tr.MessageID)
+	return nil
+}
+
+func runWaitAction(a action, _ trigger) error {
+	d, err := time.ParseDuration(a.Duration)
+	if err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func runOBSAction(a action, _ trigger) error {
+	if o == nil {
+		return errors.New("OBS is not configured")
+	}
+	return o.Request(a.Request, a.Data)
+}
+
+func runHTTPAction(a action, _ trigger) error {
+	method := a.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	c := http.Client{
+		Timeout: time.Second * 5,
+	}
+	req, err := http.NewRequest(method, a.URL, bytes.NewBufferString(a.Body))
+	if err != nil {
+		return err
+	}
+	for k, val := range a.Headers {
+		req.Header.Set(k, val)
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= 400 {
+		return errors.New("webhook returned " + res.Status)
+	}
+	return nil
+}
+
+func runSequenceAction(a action, tr trigger) error {
+	runPipeline(a.Actions, tr)
+	return nil
+}
+
+func runParallelAction(a action, tr trigger) error {
+	var wg sync.WaitGroup
+	for _, sub := range a.Actions {
+		wg.Add(1)
+		go func(sub action) {
+			defer wg.Done()
+			err := runAction(sub, tr)
+			if err != nil {
+				slog.Error("Error running action", "type", sub.Type, "err", err)
+			}
+		}(sub)
+	}
+	wg.Wait()
+	return nil
+}
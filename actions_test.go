@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordActions replaces the action handlers for the rest of the test with "record", which
+// notes the `text` of each action it runs, and "block", which waits until `release` is closed.
+func recordActions(t *testing.T, release chan struct{}) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var ran []string
+	old := actionHandlers
+	actionHandlers = map[string]actionHandler{
+		"record": func(a action, _ trigger) error {
+			mu.Lock()
+			ran = append(ran, a.Text)
+			mu.Unlock()
+			return nil
+		},
+		"block": func(a action, _ trigger) error {
+			<-release
+			return nil
+		},
+		"wait":     runWaitAction,
+		"sequence": runSequenceAction,
+		"parallel": runParallelAction,
+	}
+	t.Cleanup(func() { actionHandlers = old })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ran...)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	got := pipeline(&soundAction{Type: "tts", Text: "hi"}, "happy", []action{{Type: "wait", Duration: "1s"}})
+	want := []string{"sound", "vtube", "wait"}
+	var types []string
+	for _, a := range got {
+		types = append(types, a.Type)
+	}
+	if !reflect.DeepEqual(types, want) || got[0].Sound.Text != "hi" || got[1].State != "happy" {
+		t.Errorf("got %+v", got)
+	}
+	if got := pipeline(&soundAction{}, "", nil); len(got) != 0 {
+		t.Errorf("got %+v for an empty sound action", got)
+	}
+}
+
+func TestConditionHolds(t *testing.T) {
+	useTestPlayer(t)
+	never, always, playing := 0.0, 1.0, true
+	tests := []struct {
+		name string
+		c    *condition
+		tr   trigger
+		want bool
+	}{
+		{"no condition", nil, trigger{}, true},
+		{"allowed user", &condition{Users: []string{"Mod", "Streamer"}}, trigger{User: "streamer"}, true},
+		{"other user", &condition{Users: []string{"Mod"}}, trigger{User: "viewer"}, false},
+		{"matching input", &condition{Input: `^\d+$`}, trigger{Input: "42"}, true},
+		{"other input", &condition{Input: `^\d+$`}, trigger{Input: "forty"}, false},
+		{"invalid pattern", &condition{Input: `(`}, trigger{Input: "("}, false},
+		{"never", &condition{Chance: &never}, trigger{}, false},
+		{"always", &condition{Chance: &always}, trigger{}, true},
+		{"while playing", &condition{Playing: &playing}, trigger{}, false},
+		{"every field", &condition{Chance: &always, Users: []string{"a"}, Input: "x"}, trigger{User: "A", Input: "xyz"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.holds(tt.tr); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	release := make(chan struct{})
+	ran := recordActions(t, release)
+	never := 0.0
+	runPipeline([]action{
+		{Type: "record", Text: "1"},
+		{Type: "record", Text: "skipped", If: &condition{Chance: &never}},
+		{Type: "unknown"},
+		{Type: "sequence", Actions: []action{{Type: "record", Text: "2"}, {Type: "wait", Duration: "1ms"}, {Type: "record", Text: "3"}}},
+		{Type: "wait", Duration: "not a duration"},
+		{Type: "record", Text: "4"},
+	}, trigger{})
+	if got := ran(); !reflect.DeepEqual(got, []string{"1", "2", "3", "4"}) {
+		t.Errorf("ran %v", got)
+	}
+
+	// parallel actions run together, so one which waits does not hold up the others
+	done := make(chan struct{})
+	go func() {
+		runPipeline([]action{{Type: "parallel", Actions: []action{{Type: "block"}, {Type: "record", Text: "5"}}}, {Type: "record", Text: "6"}}, trigger{})
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ran()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := ran(); len(got) != 5 || got[4] != "5" {
+		t.Errorf("ran %v while one parallel action waits", got)
+	}
+	close(release)
+	<-done
+	if got := ran(); got[len(got)-1] != "6" {
+		t.Errorf("ran %v after the parallel actions", got)
+	}
+}
+
+func TestStartPipeline(t *testing.T) {
+	release := make(chan struct{})
+	ran := recordActions(t, release)
+
+	// the first pipeline blocks, so the rest wait behind it, up to maxWaitingPipelines of them
+	startPipeline("test", []action{{Type: "block"}}, trigger{})
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < maxWaitingPipelines+5; i++ {
+		startPipeline("test", []action{{Type: "record", Text: "x"}}, trigger{})
+	}
+	// another trigger is not held up
+	startPipeline("other", []action{{Type: "record", Text: "other"}}, trigger{})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ran()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := ran(); !reflect.DeepEqual(got, []string{"other"}) {
+		t.Errorf("ran %v while the first pipeline waits", got)
+	}
+
+	close(release)
+	for len(ran()) < 1+maxWaitingPipelines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := len(ran()); n != 1+maxWaitingPipelines {
+		t.Errorf("ran %d pipelines, want %d", n, 1+maxWaitingPipelines)
+	}
+}
+
+func TestRunHTTPAction(t *testing.T) {
+	var got struct {
+		method, body, header string
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got.method, got.body, got.header = r.Method, string(b), r.Header.Get("X-Test")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	err := runHTTPAction(action{URL: srv.URL, Body: "hello", Headers: map[string]string{"X-Test": "yes"}}, trigger{})
+	if err != nil || got.method != http.MethodPost || got.body != "hello" || got.header != "yes" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	err = runHTTPAction(action{URL: srv.URL + "/fail", Method: http.MethodPut}, trigger{})
+	if err == nil || got.method != http.MethodPut {
+		t.Errorf("got %+v, %v from a failing webhook", got, err)
+	}
+}
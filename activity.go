@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// activity is a chat command or channel point redemption which twedia acted upon.
+type activity struct {
+	Time time.Time
+	// "chat" or "reward"
+	Source string
+	User   string
+	// The chat command's trigger, or the reward's title.
+	Name  string
+	Input string
+}
+
+// How many activities are remembered.
+const activityLimit = 50
+
+var recentActivity []activity
+var activityLock sync.Mutex
+
+func recordActivity(a activity) {
+	activityLock.Lock()
+	defer activityLock.Unlock()
+	recentActivity = append(recentActivity, a)
+	if len(recentActivity) > activityLimit {
+		recentActivity = recentActivity[len(recentActivity)-activityLimit:]
+	}
+}
+
+// activities returns the remembered activities, most recent first.
+func activities() []activity {
+	activityLock.Lock()
+	defer activityLock.Unlock()
+	out := make([]activity, len(recentActivity))
+	for i, a := range recentActivity {
+		out[len(out)-1-i] = a
+	}
+	return out
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+type artConfig struct {
+	// Image file to keep the cover art of the song which is playing in, for OBS to show: .png or .jpg.
+	File string `json:"file,omitempty"`
+	// Width and height, in pixels, which the art is resized to fit; defaults to 500.
+	Size int `json:"size,omitempty"`
+	// Image shown when a song has no art, or nothing is playing; defaults to a plain record.
+	Placeholder string `json:"placeholder,omitempty"`
+	// Address on which to serve the art and a now playing overlay to browser sources, such as "localhost:8081".
+	Listen string `json:"listen,omitempty"`
+}
+
+func (a *artConfig) validate() error {
+	if a.File == "" && a.Listen == "" {
+		return errors.New("either file or listen is needed")
+	}
+	switch strings.ToLower(filepath.Ext(a.File)) {
+	case "", ".png", ".jpg", ".jpeg":
+	default:
+		return errors.New("file must be a .png or .jpg image")
+	}
+	if a.Size < 0 {
+		return errors.New("size may not be negative")
+	}
+	return nil
+}
+
+func (a *artConfig) size() int {
+	if a.Size == 0 {
+		return 500
+	}
+	return a.Size
+}
+
+// coverArt is the art shown for the song which is playing.
+var coverArt struct {
+	sync.Mutex
+	// Counts changes of song, so that art which is slow to load does not replace newer art.
+	seq int
+	// The seq of the art in `image`.
+	version     int
+	image       []byte
+	contentType string
+}
+
+var stopArt = func() {}
+
+// startArt shows the placeholder art, and starts serving the overlay if it is configured.
+func startArt(ac *artConfig) {
+	updateArt(nil)
+	if ac.Listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/art", serveArt)
+	mux.HandleFunc("/nowplaying.json", serveNowPlaying)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, overlayPage)
+	})
+	server := &http.Server{Addr: ac.Listen, Handler: mux}
+	stopArt = func() { server.Close() }
+	go func() {
+		slog.Info("Serving the now playing overlay", "address", ac.Listen)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving the now playing overlay", "err", err)
+		}
+	}()
+}
+
+// updateArt shows the art of the track which has started playing, or the placeholder if `q` is nil.
+func updateArt(q *queuedTrack) {
+	ac := config.Art
+	if ac == nil {
+		return
+	}
+	coverArt.Lock()
+	coverArt.seq++
+	seq := coverArt.seq
+	coverArt.Unlock()
+
+	go func() {
+		img := trackArt(q)
+		if img == nil {
+			img = placeholderArt(ac)
+		}
+		img = fitImage(img, ac.size())
+
+		buf := new(bytes.Buffer)
+		contentType := "image/png"
+		var err error
+		if ext := strings.ToLower(filepath.Ext(ac.File)); ext == ".jpg" || ext == ".jpeg" {
+			contentType = "image/jpeg"
+			err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
+		} else {
+			err = png.Encode(buf, img)
+		}
+		if err != nil {
+			slog.Error("Error encoding cover art", "err", err)
+			return
+		}
+
+		coverArt.Lock()
+		defer coverArt.Unlock()
+		if seq != coverArt.seq {
+			// another song has started since
+			return
+		}
+		coverArt.version, coverArt.image, coverArt.contentType = seq, buf.Bytes(), contentType
+		if ac.File != "" {
+			err = writeFileAtomic(ac.File, buf.Bytes(), 0644)
+			if err != nil {
+				slog.Error("Error writing cover art", "file", ac.File, "err", err)
+			}
+		}
+	}()
+}
+
+// trackArt finds a track's cover art: the art given in the catalog, then any embedded in its
+// audio file, then an image such as cover.jpg alongside it. It returns nil if there is none.
+func trackArt(q *queuedTrack) image.Image {
+	if q == nil {
+		return nil
+	}
+	for _, art := range []string{q.Song.Art, q.Album.Art} {
+		if art == "" {
+			continue
+		}
+		if !twedia.IsRemote(art) && !filepath.IsAbs(art) {
+			art = filepath.Join(config.MusicDir, art)
+		}
+		img, err := loadImage(art)
+		if err == nil {
+			return img
+		}
+		slog.Warn("Unable to load cover art", "art", art, "err", err)
+	}
+
+	fn, err := songFile(q.Artist, q.Album, q.Song)
+	if err != nil || twedia.IsRemote(fn) {
+		return nil
+	}
+	data, err := twedia.EmbeddedArt(fn)
+	if err == nil {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err == nil {
+			return img
+		}
+		slog.Debug("Unable to decode embedded cover art", "file", fn, "err", err)
+	}
+	if art := twedia.FolderArt(filepath.Dir(fn)); art != "" {
+		img, err := loadImage(art)
+		if err == nil {
+			return img
+		}
+		slog.Warn("Unable to load cover art", "art", art, "err", err)
+	}
+	return nil
+}
+
+// loadImage reads a JPEG, PNG or GIF image from a file or URL.
+func loadImage(fn string) (image.Image, error) {
+	var r io.Reader
+	if twedia.IsRemote(fn) {
+		res, err := (&http.Client{Timeout: 10 * time.Second}).Get(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.New(res.Status)
+		}
+		r = res.Body
+	} else {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// placeholderArt returns the configured placeholder image, or draws a record.
+func placeholderArt(ac *artConfig) image.Image {
+	if ac.Placeholder != "" {
+		img, err := loadImage(ac.Placeholder)
+		if err == nil {
+			return img
+		}
+		slog.Warn("Unable to load placeholder cover art", "placeholder", ac.Placeholder, "err", err)
+	}
+
+	size := ac.size()
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	background := color.RGBA{0x20, 0x20, 0x26, 0xff}
+	vinyl := color.RGBA{0x10, 0x10, 0x12, 0xff}
+	groove := color.RGBA{0x2c, 0x2c, 0x32, 0xff}
+	label := color.RGBA{0x9a, 0x4d, 0xff, 0xff}
+	c := float64(size) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			r := math.Hypot(float64(x)+0.5-c, float64(y)+0.5-c) / c
+			switch {
+			case r > 0.9:
+				img.SetRGBA(x, y, background)
+			case r < 0.04:
+				img.SetRGBA(x, y, background)
+			case r < 0.3:
+				img.SetRGBA(x, y, label)
+			case int(r*60)%4 == 0:
+				img.SetRGBA(x, y, groove)
+			default:
+				img.SetRGBA(x, y, vinyl)
+			}
+		}
+	}
+	return img
+}
+
+// fitImage scales an image to fit within a square of `size` pixels, keeping its shape.
+func fitImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return src
+	}
+	scale := math.Min(float64(size)/float64(b.Dx()), float64(size)/float64(b.Dy()))
+	w, h := max(1, int(math.Round(float64(b.Dx())*scale))), max(1, int(math.Round(float64(b.Dy())*scale)))
+	if w == b.Dx() && h == b.Dy() {
+		return src
+	}
+
+	s := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(s, s.Bounds(), src, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sx, sy := float64(b.Dx())/float64(w), float64(b.Dy())/float64(h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var c [4]float64
+			if scale < 1 {
+				c = averageArea(s, float64(x)*sx, float64(y)*sy, float64(x+1)*sx, float64(y+1)*sy)
+			} else {
+				c = bilinear(s, (float64(x)+0.5)*sx-0.5, (float64(y)+0.5)*sy-0.5)
+			}
+			i := dst.PixOffset(x, y)
+			for k := range c {
+				dst.Pix[i+k] = uint8(math.Round(min(max(c[k], 0), 255)))
+			}
+		}
+	}
+	return dst
+}
+
+// averageArea averages the pixels of `s` within a rectangle, weighting those which are only partly inside it.
+func averageArea(s *image.RGBA, x0, y0, x1, y1 float64) [4]float64 {
+	var sum [4]float64
+	var total float64
+	for y := int(y0); float64(y) < y1 && y < s.Rect.Dy(); y++ {
+		wy := math.Min(float64(y+1), y1) - math.Max(float64(y), y0)
+		for x := int(x0); float64(x) < x1 && x < s.Rect.Dx(); x++ {
+			wx := math.Min(float64(x+1), x1) - math.Max(float64(x), x0)
+			i := s.PixOffset(x, y)
+			for k := range sum {
+				sum[k] += float64(s.Pix[i+k]) * wx * wy
+			}
+			total += wx * wy
+		}
+	}
+	for k := range sum {
+		sum[k] /= total
+	}
+	return sum
+}
+
+// bilinear samples `s` at a point between its pixels.
+func bilinear(s *image.RGBA, x, y float64) [4]float64 {
+	x = min(max(x, 0), float64(s.Rect.Dx()-1))
+	y = min(max(y, 0), float64(s.Rect.Dy()-1))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, s.Rect.Dx()-1), min(y0+1, s.Rect.Dy()-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+	var c [4]float64
+	for k := range c {
+		p := func(x, y int) float64 { return float64(s.Pix[s.PixOffset(x, y)+k]) }
+		c[k] = (p(x0, y0)*(1-fx)+p(x1, y0)*fx)*(1-fy) + (p(x0, y1)*(1-fx)+p(x1, y1)*fx)*fy
+	}
+	return c
+}
+
+func serveArt(w http.ResponseWriter, r *http.Request) {
+	coverArt.Lock()
+	data, contentType, version := coverArt.image, coverArt.contentType, coverArt.version
+	coverArt.Unlock()
+	if data == nil {
+		http.Error(w, "no art yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", `"`+strconv.Itoa(version)+`"`)
+	if r.Header.Get("If-None-Match") == `"`+strconv.Itoa(version)+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(data)
+}
+
+// overlayState is what the overlay page is told about the song which is playing.
+type overlayState struct {
+	Playing bool   `json:"playing"`
+	Song    string `json:"song,omitempty"`
+	Artist  string `json:"artist,omitempty"`
+	Album   string `json:"album,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Site    string `json:"site,omitempty"`
+	Credit  string `json:"credit,omitempty"`
+	// In seconds.
+	Elapsed float64 `json:"elapsed,omitempty"`
+	Length  float64 `json:"length,omitempty"`
+	// Changes whenever the art does.
+	ArtVersion int `json:"artVersion"`
+	// The songs coming up next.
+	Upcoming []upcomingEntry `json:"upcoming"`
+}
+
+func serveNowPlaying(w http.ResponseWriter, r *http.Request) {
+	var s overlayState
+	if p, ok := nowPlaying(); ok {
+		d := trackData(p.Artist, p.Album, p.Song)
+		s = overlayState{
+			Playing: true,
+			Song:    d.Song,
+			Artist:  d.Artist,
+			Album:   d.Album,
+			URL:     d.URL,
+			Site:    d.Site,
+			Credit:  d.Credit,
+			Elapsed: musicPlayer.Position().Seconds(),
+			Length:  musicPlayer.Duration().Seconds(),
+		}
+	}
+	s.Upcoming = upcomingTracks(lookahead())
+	coverArt.Lock()
+	s.ArtVersion = coverArt.version
+	coverArt.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(s)
+}
+
+// overlayPage shows the song which is playing, with its art, for use as an OBS browser source.
+const overlayPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>twedia</title>
+<style>
+body { margin: 0; background: transparent; color: #fff; font-family: sans-serif; text-shadow: 0 1px 3px #000; }
+#np { display: flex; align-items: center; gap: 16px; padding: 16px; opacity: 0; transition: opacity 0.5s; }
+#np.playing { opacity: 1; }
+#art { width: 160px; height: 160px; object-fit: contain; }
+#song { font-size: 28px; font-weight: bold; }
+#artist { font-size: 22px; }
+#credit { font-size: 14px; opacity: 0.8; }
+</style>
+</head>
+<body>
+<div id="np"><img id="art" alt=""><div><div id="song"></div><div id="artist"></div><div id="credit"></div></div></div>
+<script>
+let version = -1;
+async function update() {
+	try {
+		const np = await (await fetch("nowplaying.json", {cache: "no-store"})).json();
+		document.getElementById("np").className = np.playing ? "playing" : "";
+		document.getElementById("song").textContent = np.song || "";
+		document.getElementById("artist").textContent = np.artist || "";
+		document.getElementById("credit").textContent = np.credit || "";
+		if (np.artVersion !== version) {
+			version = np.artVersion;
+			document.getElementById("art").src = "art?v=" + version;
+		}
+	} catch (e) {
+		// twedia is not running; try again shortly
+	}
+}
+update();
+setInterval(update, 2000);
+</script>
+</body>
+</html>
+`
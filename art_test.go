@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testImage makes an image of the given size, with each pixel's colour set by `pixel`.
+func testImage(r image.Rectangle, pixel func(x, y int) color.RGBA) *image.RGBA {
+	img := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, pixel(x, y))
+		}
+	}
+	return img
+}
+
+func TestFitImage(t *testing.T) {
+	grey := func(v uint8) color.RGBA { return color.RGBA{v, v, v, 255} }
+	// black on the left half and white on the right
+	halves := testImage(image.Rect(0, 0, 4, 2), func(x, y int) color.RGBA { return grey(uint8(x / 2 * 255)) })
+	tests := []struct {
+		name string
+		src  image.Image
+		size int
+		w, h int
+		// expected colours of some of the pixels
+		check map[image.Point]color.RGBA
+	}{
+		{"shrunk", halves, 2, 2, 1, map[image.Point]color.RGBA{{0, 0}: grey(0), {1, 0}: grey(255)}},
+		{"shrunk to one pixel", halves, 1, 1, 1, map[image.Point]color.RGBA{{0, 0}: grey(128)}},
+		{"partial pixels", halves, 3, 3, 2, map[image.Point]color.RGBA{{0, 0}: grey(0), {1, 1}: grey(128), {2, 0}: grey(255)}},
+		{"enlarged", halves, 8, 8, 4, map[image.Point]color.RGBA{{0, 0}: grey(0), {7, 3}: grey(255)}},
+		{"same size", halves, 4, 4, 2, nil},
+		{"offset bounds", halves.SubImage(image.Rect(2, 0, 4, 2)), 1, 1, 1, map[image.Point]color.RGBA{{0, 0}: grey(255)}},
+		{"tall", testImage(image.Rect(0, 0, 1, 10), func(x, y int) color.RGBA { return grey(10) }), 5, 1, 5, map[image.Point]color.RGBA{{0, 4}: grey(10)}},
+		{"empty", image.NewRGBA(image.Rect(0, 0, 0, 0)), 5, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fitImage(tt.src, tt.size)
+			if b := got.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+				t.Fatalf("size is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.w, tt.h)
+			}
+			for p, want := range tt.check {
+				p = p.Add(got.Bounds().Min)
+				// allowing for rounding
+				c := color.RGBAModel.Convert(got.At(p.X, p.Y)).(color.RGBA)
+				if max(c.R, want.R)-min(c.R, want.R) > 1 || c.A != want.A {
+					t.Errorf("pixel %v is %v, want %v", p, c, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBilinear(t *testing.T) {
+	// a 2x2 image whose red channel is 0, 100 on the top row and 200, 255 on the bottom
+	img := testImage(image.Rect(0, 0, 2, 2), func(x, y int) color.RGBA {
+		return color.RGBA{[][]uint8{{0, 100}, {200, 255}}[y][x], 0, 0, 255}
+	})
+	tests := []struct {
+		x, y float64
+		want float64
+	}{
+		{0, 0, 0},
+		{1, 0, 100},
+		{0.5, 0, 50},
+		{0, 0.5, 100},
+		{0.5, 0.5, 138.75},
+		{1, 1, 255},
+		// points outside the image take the colour of its edge
+		{-3, -3, 0},
+		{5, 0, 100},
+		{5, 5, 255},
+	}
+	for _, tt := range tests {
+		c := bilinear(img, tt.x, tt.y)
+		if c[0] != tt.want || c[3] != 255 {
+			t.Errorf("bilinear(%v, %v) = %v, want red %v", tt.x, tt.y, c, tt.want)
+		}
+	}
+
+	one := testImage(image.Rect(0, 0, 1, 1), func(x, y int) color.RGBA { return color.RGBA{9, 9, 9, 9} })
+	if c := bilinear(one, 0.7, 0.2); c != [4]float64{9, 9, 9, 9} {
+		t.Errorf("sampling a single pixel gave %v", c)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// scanMusicDir builds a catalog from the music directory, which holds a folder for each artist
+// containing a folder for each album. Singles are kept in folders named after the song. Artists,
+// albums and songs which are already in the `known` catalog keep their links, details and attributes.
+func scanMusicDir(dir string, known twedia.Music) (twedia.Music, error) {
+	knownArtists := make(map[string]twedia.Attributes)
+	knownAlbums := make(map[string]twedia.Album)
+	knownSongs := make(map[string]twedia.Song)
+	for _, ar := range known.Artists {
+		knownArtists[strings.ToLower(ar.Artist)] = ar.Attributes
+		for _, al := range ar.Albums {
+			knownAlbums[songKey(ar.Artist, al.Name)] = twedia.Album{License: al.License, Art: al.Art, Attributes: al.Attributes}
+			for _, s := range al.Songs {
+				knownSongs[songKey(ar.Artist, s.Title)] = s
+			}
+		}
+	}
+
+	var m twedia.Music
+	artistDirs, err := os.ReadDir(dir)
+	if err != nil {
+		return m, err
+	}
+	for _, ad := range artistDirs {
+		if !ad.IsDir() {
+			continue
+		}
+		artist := twedia.Artist{Artist: ad.Name(), Attributes: knownArtists[strings.ToLower(ad.Name())]}
+		singles := knownAlbums[songKey(ad.Name(), "[Singles]")]
+		singles.Name = "[Singles]"
+
+		albumDirs, err := os.ReadDir(filepath.Join(dir, ad.Name()))
+		if err != nil {
+			return m, err
+		}
+		for _, ald := range albumDirs {
+			if !ald.IsDir() {
+				continue
+			}
+			album := knownAlbums[songKey(ad.Name(), ald.Name())]
+			album.Name = ald.Name()
+			files, err := os.ReadDir(filepath.Join(dir, ad.Name(), ald.Name()))
+			if err != nil {
+				return m, err
+			}
+			for _, f := range files {
+				if f.IsDir() || !twedia.IsAudioFile(f.Name()) {
+					continue
+				}
+				song := knownSongs[songKey(artist.Artist, twedia.TitleFromFile(f.Name()))]
+				song.Title = twedia.TitleFromFile(f.Name())
+				if song.Track == 0 {
+					song.Track = twedia.TrackFromFile(f.Name())
+				}
+				album.Songs = append(album.Songs, song)
+			}
+
+			if len(album.Songs) == 1 && strings.EqualFold(album.Songs[0].Title, album.Name) {
+				singles.Songs = append(singles.Songs, album.Songs[0])
+			} else if len(album.Songs) > 0 {
+				artist.Albums = append(artist.Albums, album)
+			}
+		}
+		if len(singles.Songs) > 0 {
+			artist.Albums = append(artist.Albums, singles)
+		}
+		if len(artist.Albums) > 0 {
+			m.Artists = append(m.Artists, artist)
+		}
+	}
+	return m, nil
+}
+
+func runCatalogScan(args []string) error {
+	fs := newFlagSet("catalog scan")
+	out := fs.String("o", "", "file to write the catalog to, rather than standard output")
+	err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	err = loadConfigFile()
+	if err != nil {
+		return err
+	}
+
+	// songs which are already in the catalog keep their URLs and attributes
+	err = loadCatalog()
+	if err != nil {
+		slog.Warn("Unable to load the existing catalog, so no song URLs are known", "err", err)
+	}
+
+	m, err := scanMusicDir(config.MusicDir, *music())
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, append(data, '\n'))
+}
+
+func runCatalogExport(args []string) error {
+	fs := newFlagSet("catalog export")
+	format := fs.String("format", "json", "format to write: json or csv")
+	out := fs.String("o", "", "file to write the catalog to, rather than standard output")
+	err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	err = loadConfigFile()
+	if err != nil {
+		return err
+	}
+	err = loadCatalog()
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch *format {
+	case "json":
+		data, err = json.MarshalIndent(music(), "", "    ")
+		data = append(data, '\n')
+	case "csv":
+		buf := new(bytes.Buffer)
+		w := csv.NewWriter(buf)
+		w.Write([]string{"artist", "album", "track", "title", "featuring", "composer", "duration", "url", "license", "credit"})
+		for _, ar := range music().Artists {
+			for _, al := range ar.Albums {
+				for _, s := range al.Songs {
+					_, link := s.Link()
+					track, duration := "", ""
+					if s.Track > 0 {
+						track = strconv.Itoa(s.Track)
+					}
+					if s.Duration > 0 {
+						duration = formatDuration(time.Duration(s.Duration * float64(time.Second)))
+					}
+					w.Write([]string{ar.Artist, al.Name, track, s.Title, strings.Join(s.Featuring, ", "), s.Composer, duration, link,
+						twedia.SongLicense(&al, &s), twedia.Credit(&ar, &al, &s)})
+				}
+			}
+		}
+		w.Flush()
+		data, err = buf.Bytes(), w.Error()
+	default:
+		return errors.New("unknown catalog format '" + *format + "'")
+	}
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, data)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lyrenhex/twedia/twedia"
+	"github.com/lyrenhex/twedia/twitch"
+	"github.com/lyrenhex/twedia/veadotube"
+)
+
+// subcommand is one of the commands accepted on twedia's command line.
+type subcommand struct {
+	name        string
+	args        string
+	description string
+	run         func(args []string) error
+}
+
+var subcommands []subcommand
+
+func init() {
+	// filled in here rather than where it is declared, as `help` refers back to the list
+	subcommands = []subcommand{
+		{"run", "[-daemon] [-plain]", "connect to Twitch and play music (the default)", runBot},
+		{"auth", "", "sign in to Twitch to obtain a new PubSub OAuth token", runAuth},
+		{"check", "", "check the config file, secrets, message templates and music catalog", runCheck},
+		{"catalog scan", "[-o file]", "build a music catalog from the files in the music directory", runCatalogScan},
+		{"catalog export", "[-format json|csv] [-o file]", "write out the music catalog", runCatalogExport},
+		{"history export", "[-format csv|m3u] [-since date] [-until date] [-o file]", "write out the play history as CSV or an M3U playlist", runHistoryExport},
+		{"tts warm", "", "synthesise the speech for every tts action ahead of time", runTTSWarm},
+		{"veadotube list", "", "list the running Veadotube mini instances", runVeadotubeList},
+		{"ctl", "<command>", "send a command to a running twedia", runCtlCommand},
+		{"config convert", "<input file> <output file>", "convert a config file between JSON, YAML and TOML", runConfigConvert},
+		{"schema", "", "print the config file's JSON Schema", runSchema},
+		{"help", "", "show this help", runHelp},
+	}
+}
+
+// errUsage is returned by a subcommand which was given the wrong arguments.
+var errUsage = errors.New("invalid arguments")
+
+// globalFlags creates the flag set for the flags which come before the subcommand.
+func globalFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("twedia", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", os.Getenv("TWITCH_CONFIG_FILE"), "path of the config file (default $TWITCH_CONFIG_FILE)")
+	fs.StringVar(&dataDir, "data-dir", ".", "directory in which to keep cached data, such as synthesised speech")
+	fs.StringVar(&logLevelFlag, "log-level", "", "least severe log messages to show: debug, info (the default), warn or error, optionally per subsystem, e.g. info,twitch=debug")
+	fs.StringVar(&logFormatFlag, "log-format", "", "format of log messages: text (the default) or json")
+	fs.StringVar(&logFileFlag, "log-file", "", "file to write log messages to, as well as the terminal")
+	return fs
+}
+
+// runCLI parses the global flags and runs the requested subcommand, returning the exit status.
+func runCLI(args []string) int {
+	fs := globalFlags()
+	fs.Usage = func() {
+		printUsage(fs.Output(), fs)
+	}
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	err = configureLogging(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 2
+	}
+
+	cmd, rest := findSubcommand(fs.Args())
+	if cmd == nil {
+		fmt.Fprintln(os.Stderr, "Unknown command:", strings.Join(fs.Args(), " "))
+		printUsage(os.Stderr, fs)
+		return 2
+	}
+
+	err = cmd.run(rest)
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(os.Stderr, "Usage: twedia %s %s\n", cmd.name, cmd.args)
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// findSubcommand returns the subcommand named at the start of `args`, along with its arguments.
+// With no arguments at all, twedia runs as it always has.
+func findSubcommand(args []string) (*subcommand, []string) {
+	if len(args) == 0 {
+		return &subcommands[0], nil
+	}
+	for i, c := range subcommands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			return &subcommands[i], args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintln(w, "Usage: twedia [flags] <command> [arguments]\n\nCommands:")
+	for _, c := range subcommands {
+		fmt.Fprintf(w, "\t%-48s : %s\n", strings.TrimSpace(c.name+" "+c.args), c.description)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// newFlagSet creates the flag set for a subcommand; parse errors are reported by the caller, along with its usage.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {}
+	return fs
+}
+
+// parseFlags parses a subcommand's flags, and checks that `n` arguments remain.
+func parseFlags(fs *flag.FlagSet, args []string, n int) error {
+	err := fs.Parse(args)
+	if err != nil || fs.NArg() != n {
+		return errUsage
+	}
+	return nil
+}
+
+// writeOutput writes `data` to the file at `fn`, or to standard output if no file is given.
+func writeOutput(fn string, data []byte) error {
+	if fn == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return writeFileAtomic(fn, data, 0644)
+}
+
+func runHelp(args []string) error {
+	printUsage(os.Stdout, globalFlags())
+	return nil
+}
+
+func runSchema(args []string) error {
+	err := parseFlags(newFlagSet("schema"), args, 0)
+	if err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(configSchema(), "", "    ")
+	fmt.Println(string(out))
+	return nil
+}
+
+func runConfigConvert(args []string) error {
+	fs := newFlagSet("config convert")
+	err := parseFlags(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return convertConfig(fs.Arg(0), fs.Arg(1))
+}
+
+func runCtlCommand(args []string) error {
+	// the config file is only needed to find the control socket, if it has been moved
+	if configFile != "" {
+		config, _ = loadConfig(configFile)
+	}
+	return runCtl(os.Stdout, controlSocketPath(), args)
+}
+
+func runAuth(args []string) error {
+	err := parseFlags(newFlagSet("auth"), args, 0)
+	if err != nil {
+		return err
+	}
+	err = loadConfigFile()
+	if err != nil {
+		return err
+	}
+	err = loadCredentials(configFile, true)
+	if err != nil {
+		return fmt.Errorf("unable to load secrets: %w", err)
+	}
+	token, err := authorise()
+	if err != nil {
+		return err
+	}
+	_, err = twitch.GetChannelID(token, config.ClientID)
+	if err != nil {
+		return fmt.Errorf("the new token does not work: %w", err)
+	}
+	fmt.Println("Signed in to Twitch")
+	return nil
+}
+
+func runCheck(args []string) error {
+	err := parseFlags(newFlagSet("check"), args, 0)
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	report := func(what string, err error) bool {
+		if err != nil {
+			problems++
+			fmt.Printf("FAIL %s: %s\n", what, err)
+			return false
+		}
+		fmt.Println("ok   " + what)
+		return true
+	}
+
+	if !report("config file "+configFile, loadConfigFile()) {
+		return errors.New("the config file is invalid")
+	}
+	secretsOK := report("secrets", loadCredentials(configFile, false))
+	report("message templates", compileMessages(config.Messages))
+
+	if report("music catalog "+config.MusicCollectionURL, loadCatalog()) {
+		missing := 0
+		for _, ar := range music().Artists {
+			for _, al := range ar.Albums {
+				for _, s := range al.Songs {
+					_, err := songFile(ar, al, s)
+					if err != nil {
+						fmt.Printf("     %s by %s: %s\n", s.Title, ar.Artist, err)
+						missing++
+					}
+				}
+			}
+		}
+		var err error
+		if missing > 0 {
+			err = fmt.Errorf("%d of %d songs cannot be played", missing, music().TotalSongs)
+		}
+		report("music files in "+config.MusicDir, err)
+	}
+
+	if secretsOK {
+		_, err := twitch.GetChannelID(creds.PubsubOauthToken.Reveal(), config.ClientID)
+		if err != nil && err.Error() == "invalid oauth token" {
+			err = errors.New("the PubSub OAuth token is invalid; run `twedia auth` to renew it")
+		}
+		report("Twitch API access", err)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+func runTTSWarm(args []string) error {
+	err := parseFlags(newFlagSet("tts warm"), args, 0)
+	if err != nil {
+		return err
+	}
+	err = loadConfigFile()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(dataDir, "tts"), 0755)
+	if err != nil {
+		return err
+	}
+
+	var texts []string
+	for _, c := range config.ChatCommands {
+		texts = append(texts, ttsTexts(c.Sound, c.Actions)...)
+	}
+	for _, r := range config.PointRewards {
+		texts = append(texts, ttsTexts(r.Sound, r.Actions)...)
+	}
+
+	synthesised := 0
+	for _, text := range texts {
+		fn := ttsFile(text)
+		if exists(fn) {
+			continue
+		}
+		err := twedia.SynthesiseText(text, fn)
+		if err != nil {
+			return fmt.Errorf("unable to synthesise %q: %w", text, err)
+		}
+		synthesised++
+	}
+	fmt.Printf("Synthesised %d of %d phrases\n", synthesised, len(texts))
+	return nil
+}
+
+// ttsTexts lists the text spoken by a command or reward.
+func ttsTexts(sound *soundAction, actions []action) []string {
+	var texts []string
+	if sound != nil && sound.Type == "tts" && sound.Text != "" {
+		texts = append(texts, sound.Text)
+	}
+	for _, a := range actions {
+		if a.Type == "tts" && a.Text != "" {
+			texts = append(texts, a.Text)
+		}
+		texts = append(texts, ttsTexts(a.Sound, a.Actions)...)
+	}
+	return texts
+}
+
+func runVeadotubeList(args []string) error {
+	err := parseFlags(newFlagSet("veadotube list"), args, 0)
+	if err != nil {
+		return err
+	}
+	instances, err := veadotube.Instances()
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		fmt.Println("No Veadotube mini instances are running")
+	}
+	for _, i := range instances {
+		fmt.Printf("%s\t%s\n", i.Name, i.Server)
+	}
+	return nil
+}
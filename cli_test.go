@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// captureStdout runs `f`, returning what it writes to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	defer func() {
+		os.Stdout = old
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
+
+// keepGlobalFlags restores the settings made by the global flags once the test ends.
+func keepGlobalFlags(t *testing.T) {
+	t.Helper()
+	oldConfig, oldData := configFile, dataDir
+	oldLevel, oldFormat, oldFile := logLevelFlag, logFormatFlag, logFileFlag
+	t.Cleanup(func() {
+		configFile, dataDir = oldConfig, oldData
+		logLevelFlag, logFormatFlag, logFileFlag = oldLevel, oldFormat, oldFile
+		configureLogging(nil)
+	})
+}
+
+func TestFindSubcommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		want     string
+		wantArgs []string
+	}{
+		{nil, "run", nil},
+		{[]string{"run", "-daemon"}, "run", []string{"-daemon"}},
+		{[]string{"catalog", "scan", "-o", "music.json"}, "catalog scan", []string{"-o", "music.json"}},
+		{[]string{"catalog", "export"}, "catalog export", []string{}},
+		{[]string{"ctl", "queue", "add", "Song"}, "ctl", []string{"queue", "add", "Song"}},
+		{[]string{"catalog"}, "", nil},
+		{[]string{"catalogue", "scan"}, "", nil},
+		{[]string{"frobnicate"}, "", nil},
+	}
+	for _, tt := range tests {
+		cmd, args := findSubcommand(tt.args)
+		name := ""
+		if cmd != nil {
+			name = cmd.name
+		}
+		if name != tt.want || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("findSubcommand(%q) = %q, %q; want %q, %q", tt.args, name, args, tt.want, tt.wantArgs)
+		}
+	}
+}
+
+func TestRunCLI(t *testing.T) {
+	keepGlobalFlags(t)
+	dir := t.TempDir()
+	in := filepath.Join(dir, "config.json")
+	err := os.WriteFile(in, []byte(`{"channel": "main", "chatRateLimit": 20}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "config.yaml")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"help", []string{"help"}, 0},
+		{"help flag", []string{"-h"}, 0},
+		{"unknown flag", []string{"-frobnicate", "schema"}, 2},
+		{"unknown command", []string{"frobnicate"}, 2},
+		{"unexpected argument", []string{"schema", "extra"}, 2},
+		{"unknown command flag", []string{"catalog", "export", "-frobnicate"}, 2},
+		{"invalid log level", []string{"-log-level", "loud", "schema"}, 2},
+		{"failure", []string{"config", "convert", filepath.Join(dir, "missing.json"), out}, 1},
+		{"success", []string{"-data-dir", dir, "-log-level", "error,twitch=debug", "config", "convert", in, out}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logLevelFlag = ""
+			var got int
+			captureStdout(t, func() { got = runCLI(tt.args) })
+			if got != tt.want {
+				t.Errorf("exit status %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if dataDir != dir || logLevelFlag != "error,twitch=debug" {
+		t.Errorf("global flags gave data directory %q and log level %q", dataDir, logLevelFlag)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("config convert wrote nothing: %v", err)
+	}
+
+	schema := captureStdout(t, func() { runCLI([]string{"schema"}) })
+	var v map[string]any
+	if err := json.Unmarshal([]byte(schema), &v); err != nil || v["type"] != "object" {
+		t.Errorf("schema printed %.100q, %v", schema, err)
+	}
+}
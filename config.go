@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Path or URL of the JSON Schema describing this file, for editor completion.
+	Schema string `json:"$schema,omitempty"`
+	// Other config files (JSON, YAML or TOML) to merge into this one, relative to this file.
+	Include            []string   `json:"include,omitempty"`
+	Username           string     `json:"username" required:"true"`
+	Channel            string     `json:"channel" required:"true"`
+	ClientID           string     `json:"clientID" required:"true"`
+	ClientSecret       string     `json:"clientSecret,omitempty"`
+	MusicDir           string     `json:"musicDir" required:"true"`
+	MusicFile          string     `json:"musicFile,omitempty"`
+	OauthToken         string     `json:"oauthToken" required:"true"`
+	PubsubOauthToken   string     `json:"pubsubOauthToken,omitempty"`
+	MusicCollectionURL string     `json:"musicCollectionURL" required:"true"`
+	ChatCommands       []command  `json:"chatCommands,omitempty"`
+	PointRewards       []reward   `json:"pointRewards,omitempty"`
+	OBS                *obsConfig `json:"obs,omitempty"`
+	// Where secrets (tokens and passwords) are kept; the fields above only refer to them.
+	Secrets *secretsConfig `json:"secrets,omitempty"`
+	// Templates for the messages twedia sends to chat.
+	Messages messageTemplates `json:"messages"`
+	// Maximum number of chat messages to send in any 30 second window.
+	ChatRateLimit int `json:"chatRateLimit,omitempty"`
+	// Path of the Unix domain socket on which to accept control commands.
+	ControlSocket string `json:"controlSocket,omitempty"`
+	// Name of the Veadotube mini instance to connect to, if several may be running.
+	VeadotubeInstance string `json:"veadotubeInstance,omitempty"`
+	// Log levels, format and file.
+	Logging *loggingConfig `json:"logging,omitempty"`
+	// Play history, and how recently played songs are kept out of random selection.
+	History *historyConfig `json:"history,omitempty"`
+	// How music is chosen when nobody has asked for a particular song.
+	Shuffle *shuffleConfig `json:"shuffle,omitempty"`
+	// Keeping music which would get the stream's VOD muted off stream.
+	VODSafe *vodSafeConfig `json:"vodSafe,omitempty"`
+	// Where audio is played; defaults to the speaker.
+	Output *outputConfig `json:"output,omitempty"`
+	// ffmpeg executable, used to play Opus and AAC files and to encode the stream; defaults to "ffmpeg".
+	FFmpeg string `json:"ffmpeg,omitempty"`
+	// Minutes between checks for changes to the music catalog; 0 (the default) only checks when asked.
+	CatalogRefresh int `json:"catalogRefresh,omitempty"`
+	// Caching songs whose audio is fetched from a URL.
+	RemoteAudio *remoteAudioConfig `json:"remoteAudio,omitempty"`
+	// Streaming the music over HTTP or to Icecast.
+	Stream *streamConfig `json:"stream,omitempty"`
+	// Sites to prefer when linking to a song in chat and on screen, in order, e.g. ["bandcamp", "youtube"].
+	LinkOrder []string `json:"linkOrder,omitempty"`
+	// Showing the cover art of the song which is playing, as an image file and to browser sources.
+	Art *artConfig `json:"art,omitempty"`
+	// Files showing the song which is playing, each with its own templates, alongside `musicFile`.
+	NowPlaying []nowPlayingOutput `json:"nowPlaying,omitempty"`
+}
+
+type obsConfig struct {
+	Address  string `json:"address"`
+	Password string `json:"password,omitempty"`
+}
+
+type outputConfig struct {
+	// "speaker" (the default), "null", "wav" or "pcm".
+	Type string `json:"type,omitempty"`
+	// File to write audio to, for "wav" and "pcm". For "pcm", it may be a named pipe, or "-" for standard output.
+	File string `json:"file,omitempty"`
+}
+
+// toStdout reports whether audio is written to standard output.
+func (o *outputConfig) toStdout() bool {
+	return o != nil && o.Type == "pcm" && o.File == "-"
+}
+
+func (o *outputConfig) validate() error {
+	switch o.Type {
+	case "", "speaker", "null":
+	case "wav", "pcm":
+		if o.File == "" {
+			return errors.New("a file is needed for '" + o.Type + "' output")
+		}
+		if o.Type == "wav" && o.File == "-" {
+			return errors.New("'wav' output cannot be written to standard output")
+		}
+	default:
+		return errors.New("unknown output type '" + o.Type + "' (expected speaker, null, wav or pcm)")
+	}
+	return nil
+}
+
+type remoteAudioConfig struct {
+	// Directory in which downloaded songs are kept; defaults to "audio-cache" in the data directory.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// Most space the downloaded songs may take up, in megabytes; defaults to 1024.
+	CacheSize int `json:"cacheSize,omitempty"`
+}
+
+type command struct {
+	Trigger    string       `json:"trigger" required:"true"`
+	Sound      *soundAction `json:"sound,omitempty"`
+	VTubeState string       `json:"vtubeState,omitempty"`
+	Actions    []action     `json:"actions,omitempty"`
+}
+
+type reward struct {
+	Title      string       `json:"title" required:"true"`
+	Sound      *soundAction `json:"sound,omitempty"`
+	VTubeState string       `json:"vtubeState,omitempty"`
+	Actions    []action     `json:"actions,omitempty"`
+}
+
+type soundAction struct {
+	Type   string `json:"type" required:"true"`
+	Text   string `json:"text,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	Song   string `json:"title,omitempty"`
+	// Shuffle mode to switch to, for "start".
+	Mode string `json:"mode,omitempty"`
+}
+
+// configLock guards the parts of `config` which may be hot-reloaded.
+var configLock sync.RWMutex
+
+// loadConfig reads and validates the config file at `s`, which may be JSON, YAML or TOML
+// (chosen by its extension), along with any files it includes. Any problems found are returned
+// together, each annotated with where it occurs.
+func loadConfig(s string) (Config, error) {
+	c, _, err := readConfig(s)
+	return c, err
+}
+
+// readConfig loads the config file at `s` as for loadConfig, and also returns the list of
+// files which make it up.
+func readConfig(s string) (Config, []string, error) {
+	var config Config
+
+	n, files, err := readConfigTree(s)
+	if err != nil {
+		return config, nil, err
+	}
+
+	errs := validateConfigTree(n, configType)
+	if len(errs) == 0 {
+		// the document's structure is now known to be right, so go via JSON to fill in the Config
+		data, err := json.Marshal(n.plain())
+		if err == nil {
+			err = json.Unmarshal(data, &config)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, config.validate()...)
+		}
+	}
+	if len(errs) > 0 {
+		return config, files, errors.Join(errs...)
+	}
+
+	return config, files, nil
+}
+
+// validate checks the parts of the config which cannot be described by its structure alone.
+func (c *Config) validate() []error {
+	var errs []error
+	for _, cmd := range c.ChatCommands {
+		owner := "chat command '" + cmd.Trigger + "'"
+		errs = append(errs, validateSound(owner, cmd.Sound)...)
+		errs = append(errs, validateActions(owner, cmd.Actions)...)
+	}
+	for _, r := range c.PointRewards {
+		owner := "reward '" + r.Title + "'"
+		errs = append(errs, validateSound(owner, r.Sound)...)
+		errs = append(errs, validateActions(owner, r.Actions)...)
+	}
+	if c.Logging != nil {
+		if _, err := c.Logging.validate(); err != nil {
+			errs = append(errs, errors.New("logging: "+err.Error()))
+		}
+	}
+	if c.Shuffle != nil {
+		if err := c.Shuffle.validate(); err != nil {
+			errs = append(errs, errors.New("shuffle: "+err.Error()))
+		}
+	}
+	if c.History != nil && (c.History.ExcludeMinutes < 0 || c.History.ExcludeTracks < 0 || c.History.Length < 0) {
+		errs = append(errs, errors.New("history: limits may not be negative"))
+	}
+	if c.Output != nil {
+		if err := c.Output.validate(); err != nil {
+			errs = append(errs, errors.New("output: "+err.Error()))
+		}
+	}
+	if c.CatalogRefresh < 0 {
+		errs = append(errs, errors.New("catalogRefresh may not be negative"))
+	}
+	if c.RemoteAudio != nil && c.RemoteAudio.CacheSize < 0 {
+		errs = append(errs, errors.New("remoteAudio: cacheSize may not be negative"))
+	}
+	if c.Stream != nil {
+		if err := c.Stream.validate(); err != nil {
+			errs = append(errs, errors.New("stream: "+err.Error()))
+		}
+	}
+	if c.Art != nil {
+		if err := c.Art.validate(); err != nil {
+			errs = append(errs, errors.New("art: "+err.Error()))
+		}
+	}
+	if _, err := compileNowPlaying(c.NowPlaying); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func validateActions(owner string, actions []action) []error {
+	var errs []error
+	for _, a := range actions {
+		if _, ok := actionHandlers[a.Type]; !ok {
+			errs = append(errs, errors.New(owner+": unknown action type '"+a.Type+"'"))
+		}
+		if a.Type == "vodsafe" && a.State != "on" && a.State != "off" && a.State != "toggle" {
+			errs = append(errs, errors.New(owner+": the vodsafe action's state must be on, off or toggle"))
+		}
+		if a.Mode != "" {
+			if err := validShuffleMode(a.Mode); err != nil {
+				errs = append(errs, errors.New(owner+": "+err.Error()))
+			}
+		}
+		errs = append(errs, validateSound(owner, a.Sound)...)
+		errs = append(errs, validateActions(owner, a.Actions)...)
+	}
+	return errs
+}
+
+func validateSound(owner string, sound *soundAction) []error {
+	if sound == nil || sound.Mode == "" {
+		return nil
+	}
+	if err := validShuffleMode(sound.Mode); err != nil {
+		return []error{errors.New(owner + ": " + err.Error())}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file alongside `fn`, then renames it into place,
+// so that readers never see a partially written file.
+func writeFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), fn)
+}
+
+// chatCommands returns the current chat commands, which may change if the config file is reloaded.
+func chatCommands() []command {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config.ChatCommands
+}
+
+// pointRewards returns the current channel point rewards, which may change if the config file is reloaded.
+func pointRewards() []reward {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config.PointRewards
+}
+
+// watchConfig polls the config file at `s`, and any files it includes, for changes, and reloads
+// the chat commands, channel point rewards and logging settings whenever they change. An invalid config is
+// reported and otherwise ignored.
+func watchConfig(s string) {
+	_, files, _ := readConfig(s)
+	lastMod := modTimes(files)
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		mod := modTimes(files)
+		if mod.Equal(lastMod) {
+			continue
+		}
+
+		c, newFiles, err := readConfig(s)
+		if newFiles != nil {
+			files = newFiles
+		}
+		lastMod = modTimes(files)
+		if err != nil {
+			slog.Error("Not reloading config, as it is invalid", "err", err)
+			continue
+		}
+
+		configLock.Lock()
+		config.ChatCommands = c.ChatCommands
+		config.PointRewards = c.PointRewards
+		configLock.Unlock()
+		err = configureLogging(c.Logging)
+		if err != nil {
+			slog.Error("Error reconfiguring logging", "err", err)
+		}
+		slog.Info("Reloaded config", "chatCommands", len(c.ChatCommands), "rewards", len(c.PointRewards))
+	}
+}
+
+// modTimes returns the most recent modification time of any of the files.
+func modTimes(files []string) time.Time {
+	var latest time.Time
+	for _, fn := range files {
+		if fi, err := os.Stat(fn); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func indent(s string) string {
+	return "\t" + strings.ReplaceAll(s, "\n", "\n\t")
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configNode is a config document (or part of one) in a format-independent form. Each node
+// remembers where it came from, so that problems can be reported in terms of the original file.
+type configNode struct {
+	// Exactly one of Object, Items (with IsList set) or Value is used.
+	Object []configEntry
+	Items  []*configNode
+	IsList bool
+	Value  any
+	Pos    position
+}
+
+type configEntry struct {
+	Key   string
+	Value *configNode
+	// Position of the key itself.
+	Pos position
+}
+
+// position is a location within a config file; `Line` is 0 if the format does not record positions.
+type position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p position) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%s, line %d, column %d", p.File, p.Line, p.Col)
+}
+
+// get returns the value stored under `key`, if this node is an object containing it.
+func (n *configNode) get(key string) *configNode {
+	for _, e := range n.Object {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+// plain converts the node into the equivalent Go value, as produced by encoding/json.
+func (n *configNode) plain() any {
+	switch {
+	case n.Object != nil:
+		m := make(map[string]any, len(n.Object))
+		for _, e := range n.Object {
+			m[e.Key] = e.Value.plain()
+		}
+		return m
+	case n.IsList:
+		l := make([]any, len(n.Items))
+		for i, item := range n.Items {
+			l[i] = item.plain()
+		}
+		return l
+	}
+	return n.Value
+}
+
+// configFormat returns the format of a config file ("json", "yaml" or "toml"), based on its extension.
+func configFormat(fn string) (string, error) {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".json":
+		return "json", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".toml":
+		return "toml", nil
+	}
+	return "", errors.New("unrecognised config file type: " + fn)
+}
+
+// parseConfigFile reads a config file of any supported format.
+func parseConfigFile(fn string) (*configNode, error) {
+	format, err := configFormat(fn)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "yaml":
+		return parseYAML(fn, data)
+	case "toml":
+		return parseTOML(fn, data)
+	}
+	return parseJSON(fn, data)
+}
+
+// readConfigTree reads the config file at `fn`, along with any files it includes, and returns
+// the merged document and the list of every file which was read.
+func readConfigTree(fn string) (*configNode, []string, error) {
+	return readIncludes(fn, nil)
+}
+
+func readIncludes(fn string, parents []string) (*configNode, []string, error) {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range parents {
+		if p == abs {
+			return nil, nil, errors.New("config file " + fn + " includes itself")
+		}
+	}
+
+	n, err := parseConfigFile(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []string{fn}
+
+	inc := n.get("include")
+	if inc == nil {
+		return n, files, nil
+	}
+	if !inc.IsList {
+		return nil, nil, errors.New(inc.Pos.String() + ": include must be a list of file names")
+	}
+	for _, i := range inc.Items {
+		name, ok := i.Value.(string)
+		if !ok {
+			return nil, nil, errors.New(i.Pos.String() + ": include must be a list of file names")
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(fn), name)
+		}
+		included, incFiles, err := readIncludes(name, append(parents, abs))
+		if err != nil {
+			return nil, nil, err
+		}
+		err = mergeConfig(n, included)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, incFiles...)
+	}
+	return n, files, nil
+}
+
+// mergeConfig merges an included document into the including one: lists are concatenated,
+// objects are merged, and otherwise the including document's values take precedence.
+func mergeConfig(dst, src *configNode) error {
+	if src.Object == nil {
+		return errors.New(src.Pos.String() + ": an included config file must contain an object")
+	}
+	for _, e := range src.Object {
+		if e.Key == "include" {
+			continue
+		}
+		existing := dst.get(e.Key)
+		switch {
+		case existing == nil:
+			dst.Object = append(dst.Object, e)
+		case existing.IsList && e.Value.IsList:
+			existing.Items = append(existing.Items, e.Value.Items...)
+		case existing.Object != nil && e.Value.Object != nil:
+			err := mergeConfig(existing, e.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseJSON(fn string, data []byte) (*configNode, error) {
+	p := &jsonParser{
+		fn:   fn,
+		data: data,
+		dec:  json.NewDecoder(bytes.NewReader(data)),
+	}
+	p.dec.UseNumber()
+	n, err := p.value()
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, errors.New(p.position(int(syntaxErr.Offset)).String() + ": " + syntaxErr.Error())
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New(p.position(len(data)).String() + ": unexpected end of file")
+		}
+		return nil, err
+	}
+	return n, nil
+}
+
+type jsonParser struct {
+	fn   string
+	data []byte
+	dec  *json.Decoder
+}
+
+// position returns the position of the byte at `offset`.
+func (p *jsonParser) position(offset int) position {
+	if offset > len(p.data) {
+		offset = len(p.data)
+	}
+	return position{
+		File: p.fn,
+		Line: 1 + bytes.Count(p.data[:offset], []byte("\n")),
+		Col:  offset - bytes.LastIndexByte(p.data[:offset], '\n'),
+	}
+}
+
+// next returns the next token, along with the position at which it starts.
+func (p *jsonParser) next() (json.Token, position, error) {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.data) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+	tok, err := p.dec.Token()
+	return tok, p.position(offset), err
+}
+
+func (p *jsonParser) value() (*configNode, error) {
+	tok, pos, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &configNode{Pos: pos}
+	switch tok {
+	case json.Delim('{'):
+		n.Object = []configEntry{}
+		for p.dec.More() {
+			key, keyPos, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.Object = append(n.Object, configEntry{Key: key.(string), Value: v, Pos: keyPos})
+		}
+		_, _, err = p.next()
+	case json.Delim('['):
+		n.IsList = true
+		for p.dec.More() {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.Items = append(n.Items, v)
+		}
+		_, _, err = p.next()
+	default:
+		if num, ok := tok.(json.Number); ok {
+			n.Value, err = num.Float64()
+		} else {
+			n.Value = tok
+		}
+	}
+	return n, err
+}
+
+func parseYAML(fn string, data []byte) (*configNode, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, errors.New(fn + ": " + err.Error())
+	}
+	if len(doc.Content) == 0 {
+		return &configNode{Object: []configEntry{}, Pos: position{File: fn, Line: 1, Col: 1}}, nil
+	}
+	return fromYAML(fn, doc.Content[0])
+}
+
+func fromYAML(fn string, y *yaml.Node) (*configNode, error) {
+	pos := position{File: fn, Line: y.Line, Col: y.Column}
+	switch y.Kind {
+	case yaml.AliasNode:
+		return fromYAML(fn, y.Alias)
+	case yaml.MappingNode:
+		n := &configNode{Object: []configEntry{}, Pos: pos}
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			v, err := fromYAML(fn, y.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			k := y.Content[i]
+			n.Object = append(n.Object, configEntry{
+				Key:   k.Value,
+				Value: v,
+				Pos:   position{File: fn, Line: k.Line, Col: k.Column},
+			})
+		}
+		return n, nil
+	case yaml.SequenceNode:
+		n := &configNode{IsList: true, Pos: pos}
+		for _, c := range y.Content {
+			v, err := fromYAML(fn, c)
+			if err != nil {
+				return nil, err
+			}
+			n.Items = append(n.Items, v)
+		}
+		return n, nil
+	}
+
+	var v any
+	err := y.Decode(&v)
+	if err != nil {
+		return nil, errors.New(pos.String() + ": " + err.Error())
+	}
+	return &configNode{Value: normaliseNumber(v), Pos: pos}, nil
+}
+
+func parseTOML(fn string, data []byte) (*configNode, error) {
+	var m map[string]any
+	md, err := toml.Decode(string(data), &m)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("%s: %s", position{File: fn, Line: parseErr.Position.Line, Col: parseErr.Position.Col}, parseErr.Message)
+		}
+		return nil, errors.New(fn + ": " + err.Error())
+	}
+
+	// TOML decodes into maps, so use the order in which keys were defined to keep the document's order
+	order := make(map[string]int)
+	for i, k := range md.Keys() {
+		order[k.String()] = i
+	}
+	return fromTOML(fn, m, "", order), nil
+}
+
+func fromTOML(fn string, v any, path string, order map[string]int) *configNode {
+	pos := position{File: fn}
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			return order[path+keys[i]] < order[path+keys[j]]
+		})
+		n := &configNode{Object: []configEntry{}, Pos: pos}
+		for _, k := range keys {
+			n.Object = append(n.Object, configEntry{
+				Key:   k,
+				Value: fromTOML(fn, v[k], path+k+".", order),
+				Pos:   pos,
+			})
+		}
+		return n
+	case []map[string]any:
+		n := &configNode{IsList: true, Pos: pos}
+		for _, item := range v {
+			n.Items = append(n.Items, fromTOML(fn, item, path, order))
+		}
+		return n
+	case []any:
+		n := &configNode{IsList: true, Pos: pos}
+		for _, item := range v {
+			n.Items = append(n.Items, fromTOML(fn, item, path, order))
+		}
+		return n
+	}
+	return &configNode{Value: normaliseNumber(v), Pos: pos}
+}
+
+// normaliseNumber converts integers to float64, as encoding/json would decode them.
+func normaliseNumber(v any) any {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	}
+	return v
+}
+
+// integral converts whole numbers back into integers, so that they are not written as floats.
+func integral(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			v[k] = integral(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = integral(item)
+		}
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v)
+		}
+	}
+	return v
+}
+
+// encodeConfig writes the document in the given format.
+func encodeConfig(n *configNode, format string) ([]byte, error) {
+	switch format {
+	case "yaml":
+		buf := new(bytes.Buffer)
+		enc := yaml.NewEncoder(buf)
+		enc.SetIndent(2)
+		err := enc.Encode(toYAML(n))
+		if err != nil {
+			return nil, err
+		}
+		err = enc.Close()
+		return buf.Bytes(), err
+	case "toml":
+		buf := new(bytes.Buffer)
+		enc := toml.NewEncoder(buf)
+		enc.Indent = ""
+		err := enc.Encode(integral(n.plain()))
+		return buf.Bytes(), err
+	}
+	buf := new(bytes.Buffer)
+	writeJSON(buf, n, "")
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// writeJSON writes the document as indented JSON, keeping the order of object keys.
+func writeJSON(buf *bytes.Buffer, n *configNode, indent string) {
+	const step = "    "
+	switch {
+	case n.Object != nil:
+		if len(n.Object) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteString("{\n")
+		for i, e := range n.Object {
+			k, _ := json.Marshal(e.Key)
+			buf.WriteString(indent + step)
+			buf.Write(k)
+			buf.WriteString(": ")
+			writeJSON(buf, e.Value, indent+step)
+			if i < len(n.Object)-1 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(indent + "}")
+	case n.IsList:
+		if len(n.Items) == 0 {
+			buf.WriteString("[]")
+			return
+		}
+		buf.WriteString("[\n")
+		for i, item := range n.Items {
+			buf.WriteString(indent + step)
+			writeJSON(buf, item, indent+step)
+			if i < len(n.Items)-1 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(indent + "]")
+	default:
+		v, _ := json.Marshal(n.Value)
+		buf.Write(v)
+	}
+}
+
+func toYAML(n *configNode) *yaml.Node {
+	switch {
+	case n.Object != nil:
+		y := &yaml.Node{Kind: yaml.MappingNode}
+		for _, e := range n.Object {
+			y.Content = append(y.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: e.Key}, toYAML(e.Value))
+		}
+		return y
+	case n.IsList:
+		y := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range n.Items {
+			y.Content = append(y.Content, toYAML(item))
+		}
+		return y
+	}
+	y := &yaml.Node{}
+	y.Encode(n.Value)
+	return y
+}
+
+// configValueFile returns which of the files making up the config at `fn` defines the value at
+// the dotted key `path`; values which are not yet defined belong to `fn` itself.
+func configValueFile(fn, path string) string {
+	n, _, err := readConfigTree(fn)
+	if err != nil {
+		return fn
+	}
+	for _, key := range strings.Split(path, ".") {
+		n = n.get(key)
+		if n == nil {
+			return fn
+		}
+	}
+	return n.Pos.File
+}
+
+// setConfigValue sets the string value at the dotted key `path` (e.g. "obs.password") in the
+// config file `fn`, keeping the rest of the file as it is, as far as its format allows.
+func setConfigValue(fn, path, value string) error {
+	format, err := configFormat(fn)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	switch format {
+	case "yaml":
+		out, err = setYAMLValue(data, strings.Split(path, "."), value)
+	case "toml":
+		out, err = setTOMLValue(fn, data, strings.Split(path, "."), value)
+	default:
+		var n *configNode
+		n, err = parseJSON(fn, data)
+		if err == nil {
+			setNodeValue(n, strings.Split(path, "."), value)
+			out, err = encodeConfig(n, "json")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(fn, out, 0600)
+}
+
+func setNodeValue(n *configNode, path []string, value string) {
+	for i, e := range n.Object {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			n.Object[i].Value = &configNode{Value: value}
+		} else {
+			if e.Value.Object == nil {
+				n.Object[i].Value = &configNode{Object: []configEntry{}}
+			}
+			setNodeValue(n.Object[i].Value, path[1:], value)
+		}
+		return
+	}
+
+	v := &configNode{Value: value}
+	if len(path) > 1 {
+		v = &configNode{Object: []configEntry{}}
+		setNodeValue(v, path[1:], value)
+	}
+	n.Object = append(n.Object, configEntry{Key: path[0], Value: v})
+}
+
+// setYAMLValue edits the YAML document directly, so that comments are kept.
+func setYAMLValue(data []byte, path []string, value string) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode}}
+	}
+
+	m := doc.Content[0]
+	for i, key := range path {
+		var next *yaml.Node
+		for j := 0; j+1 < len(m.Content); j += 2 {
+			if m.Content[j].Value == key {
+				next = m.Content[j+1]
+				break
+			}
+		}
+		if next == nil {
+			next = &yaml.Node{Kind: yaml.MappingNode}
+			m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, next)
+		}
+		if i == len(path)-1 {
+			next.Kind, next.Tag, next.Value, next.Content, next.Style = yaml.ScalarNode, "!!str", value, nil, 0
+		} else if next.Kind != yaml.MappingNode {
+			next.Kind, next.Tag, next.Value, next.Content = yaml.MappingNode, "", "", nil
+		}
+		m = next
+	}
+
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	err = enc.Encode(&doc)
+	if err == nil {
+		err = enc.Close()
+	}
+	return buf.Bytes(), err
+}
+
+// setTOMLValue replaces (or adds) the key's line within its table, so that comments are kept.
+// Keys which cannot be found this way, such as those within inline tables, cause the file to be
+// rewritten in full instead.
+func setTOMLValue(fn string, data []byte, path []string, value string) ([]byte, error) {
+	quoted, _ := json.Marshal(value)
+	line := path[len(path)-1] + " = " + string(quoted)
+	table := "[" + strings.Join(path[:len(path)-1], ".") + "]"
+
+	lines := strings.Split(string(data), "\n")
+	inTable := len(path) == 1
+	insertAt := -1
+	if inTable {
+		insertAt = 0
+	}
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") {
+			if inTable {
+				// reached the end of the table without finding the key
+				break
+			}
+			if trimmed == table {
+				inTable = true
+				insertAt = i + 1
+			}
+			continue
+		}
+		if !inTable {
+			continue
+		}
+		k, _, found := strings.Cut(trimmed, "=")
+		if found && strings.Trim(strings.TrimSpace(k), `"'`) == path[len(path)-1] {
+			lines[i] = l[:len(l)-len(strings.TrimLeft(l, " \t"))] + line
+			return []byte(strings.Join(lines, "\n")), nil
+		}
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			insertAt = i + 1
+		}
+	}
+
+	if insertAt >= 0 {
+		lines = append(lines[:insertAt], append([]string{line}, lines[insertAt:]...)...)
+		return []byte(strings.Join(lines, "\n")), nil
+	}
+
+	n, err := parseTOML(fn, data)
+	if err != nil {
+		return nil, err
+	}
+	setNodeValue(n, path, value)
+	return encodeConfig(n, "toml")
+}
+
+// convertConfig translates the config file `in` into the format of `out`, chosen by its extension.
+// Included files are not followed; convert each of them separately.
+func convertConfig(in, out string) error {
+	format, err := configFormat(out)
+	if err != nil {
+		return err
+	}
+	n, err := parseConfigFile(in)
+	if err != nil {
+		return err
+	}
+	if format == "toml" && containsNull(n) {
+		return errors.New("TOML cannot represent null values; remove them from " + in + " first")
+	}
+	data, err := encodeConfig(n, format)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(out, data, 0600)
+}
+
+func containsNull(n *configNode) bool {
+	switch {
+	case n.Object != nil:
+		for _, e := range n.Object {
+			if containsNull(e.Value) {
+				return true
+			}
+		}
+		return false
+	case n.IsList:
+		for _, item := range n.Items {
+			if containsNull(item) {
+				return true
+			}
+		}
+		return false
+	}
+	return n.Value == nil
+}
+
+// keyPath describes where a value sits within the document, for error messages.
+func keyPath(parent string, key any) string {
+	switch k := key.(type) {
+	case int:
+		return parent + "[" + strconv.Itoa(k) + "]"
+	case string:
+		if parent == "" {
+			return k
+		}
+		return parent + "." + k
+	}
+	return parent
+}
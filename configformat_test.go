@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates the named files in a temporary directory, returning the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMergeConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		dst, src string
+		want     any
+		wantErr  string
+	}{
+		{
+			name: "new keys are added",
+			dst:  `{"a": 1}`,
+			src:  `{"b": 2}`,
+			want: map[string]any{"a": 1.0, "b": 2.0},
+		},
+		{
+			name: "the including file wins",
+			dst:  `{"a": 1}`,
+			src:  `{"a": 2}`,
+			want: map[string]any{"a": 1.0},
+		},
+		{
+			name: "lists are concatenated",
+			dst:  `{"l": [1, 2]}`,
+			src:  `{"l": [3]}`,
+			want: map[string]any{"l": []any{1.0, 2.0, 3.0}},
+		},
+		{
+			name: "objects are merged",
+			dst:  `{"o": {"a": 1, "n": {"x": true}}}`,
+			src:  `{"o": {"a": 2, "b": 3, "n": {"y": false}}}`,
+			want: map[string]any{"o": map[string]any{"a": 1.0, "b": 3.0, "n": map[string]any{"x": true, "y": false}}},
+		},
+		{
+			name: "mismatched types keep the including value",
+			dst:  `{"l": [1], "o": {"a": 1}}`,
+			src:  `{"l": {"a": 2}, "o": [2]}`,
+			want: map[string]any{"l": []any{1.0}, "o": map[string]any{"a": 1.0}},
+		},
+		{
+			name: "include is not copied",
+			dst:  `{"a": 1}`,
+			src:  `{"include": ["x.json"]}`,
+			want: map[string]any{"a": 1.0},
+		},
+		{
+			name:    "included file must be an object",
+			dst:     `{"a": 1}`,
+			src:     `[1]`,
+			wantErr: "must contain an object",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := parseJSON("dst.json", []byte(tt.dst))
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, err := parseJSON("src.json", []byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = mergeConfig(dst, src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dst.plain(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigTree(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml":      "channel: main\ninclude:\n  - commands.json\n  - sub/rewards.toml\nchatCommands:\n  - trigger: '!a'\n",
+		"commands.json":    `{"channel": "ignored", "chatCommands": [{"trigger": "!b"}], "shuffle": {"mode": "bag"}}`,
+		"sub/rewards.toml": "include = [\"more.json\"]\n\n[[pointRewards]]\ntitle = \"Song\"\n",
+		"sub/more.json":    `{"shuffle": {"artistBlock": 4}}`,
+	})
+
+	n, files, err := readConfigTree(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"channel":      "main",
+		"include":      []any{"commands.json", "sub/rewards.toml"},
+		"chatCommands": []any{map[string]any{"trigger": "!a"}, map[string]any{"trigger": "!b"}},
+		"shuffle":      map[string]any{"mode": "bag", "artistBlock": 4.0},
+		"pointRewards": []any{map[string]any{"title": "Song"}},
+	}
+	if got := n.plain(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if len(files) != 4 {
+		t.Errorf("got files %v, want all 4", files)
+	}
+
+	// positions refer to the file each value came from
+	commands := n.get("chatCommands")
+	if pos := commands.Items[0].Pos; filepath.Base(pos.File) != "config.yaml" || pos.Line != 6 {
+		t.Errorf("first command is at %v", pos)
+	}
+	if pos := commands.Items[1].Pos; filepath.Base(pos.File) != "commands.json" || pos.Line != 1 {
+		t.Errorf("second command is at %v", pos)
+	}
+}
+
+func TestReadConfigTreeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{"self include", map[string]string{"config.json": `{"include": ["config.json"]}`}, "includes itself"},
+		{"include cycle", map[string]string{
+			"config.json": `{"include": ["a.json"]}`,
+			"a.json":      `{"include": ["config.json"]}`,
+		}, "includes itself"},
+		{"include is not a list", map[string]string{"config.json": `{"include": "a.json"}`}, "include must be a list of file names"},
+		{"include of a number", map[string]string{"config.json": `{"include": [1]}`}, "include must be a list of file names"},
+		{"missing include", map[string]string{"config.json": `{"include": ["a.json"]}`}, "a.json"},
+		{"unknown format", map[string]string{"config.json": `{"include": ["a.ini"]}`, "a.ini": ""}, "unrecognised config file type"},
+		{"syntax error", map[string]string{"config.json": "{\n  \"a\": 1,\n  \"b\" 2\n}"}, "line 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			_, _, err := readConfigTree(filepath.Join(dir, "config.json"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// controlCommand describes a command accepted by the console and the control socket.
+type controlCommand struct {
+	usage       string
+	description string
+	// Whether the command is only available at the interactive console.
+	consoleOnly bool
+}
+
+var controlCommands = []controlCommand{
+	{"start", "start playing random music", false},
+	{"select", "choose a song to play", true},
+	{"shuffle [mode]", "show or change how music is chosen: random, bag, album, artist or sequential", false},
+	{"tags [tag ...]", "only choose random songs with these tags (or without, for -tag); tags clear allows any song", false},
+	{"vodsafe [on|off]", "show or change whether only VOD-safe music is played", false},
+	{"pause", "pause / unpause the current song", false},
+	{"skip", "skip the current song", false},
+	{"stop", "stop playing music", false},
+	{"restart", "play the current song from the start", false},
+	{"seek <time>", "jump to a time in the current song, e.g. 1:30, or +10s / -10s from where it is", false},
+	{"play <song>", `play a specific song ("Title" or "Artist - Title")`, false},
+	{"queue", "list the request queue", false},
+	{"queue add <song>", "add a song to the request queue", false},
+	{"queue clear", "empty the request queue", false},
+	{"queue load <playlist>", "add the songs in an M3U, PLS or XSPF playlist (a file or URL) to the request queue", false},
+	{"queue save <file>", "write the request queue to an M3U playlist", false},
+	{"upcoming", "list the songs coming up: the request queue, then those chosen in advance", false},
+	{"veto [n]", "replace the nth song chosen in advance (the first by default) with another", false},
+	{"status", "show the current song", false},
+	{"history", "list the most recently played songs", false},
+	{"refresh", "load the music catalog again, picking up any changes", false},
+	{"quit", "exit program", false},
+}
+
+// controlHelp lists the available commands, including those which need the interactive console if `console` is set.
+func controlHelp(console bool) string {
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, c := range controlCommands {
+		if c.consoleOnly && !console {
+			continue
+		}
+		fmt.Fprintf(&b, "\n\t%-21s : %s", c.usage, c.description)
+	}
+	return b.String()
+}
+
+// controlSocketPath returns where the control socket is created: `controlSocket` from the
+// config, or twedia.sock in the user's runtime directory.
+func controlSocketPath() string {
+	if config.ControlSocket != "" {
+		return config.ControlSocket
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "twedia.sock")
+}
+
+// runCommand carries out a console or control socket command, writing any output to `w`, and
+// reports whether twedia should quit.
+func runCommand(line string, w io.Writer) bool {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+	switch strings.ToLower(cmd) {
+	case "start":
+		musicPlayer.SetContinuing(true)
+		ensurePlaying(trigger{Source: "console"})
+	case "shuffle":
+		if arg != "" {
+			err := setShuffleMode(strings.ToLower(arg))
+			if err != nil {
+				fmt.Fprintln(w, err)
+				break
+			}
+		}
+		fmt.Fprintln(w, "Shuffle mode:", shuffleMode())
+	case "tags":
+		if strings.EqualFold(arg, "clear") {
+			setTagFilter(nil)
+		} else if arg != "" {
+			setTagFilter(strings.Fields(arg))
+		}
+		if filter := tagFilterText(); filter != "" {
+			fmt.Fprintln(w, "Tags:", filter)
+		} else {
+			fmt.Fprintln(w, "Tags: any")
+		}
+	case "vodsafe":
+		if arg != "" {
+			err := setVODSafeMode(strings.ToLower(arg))
+			if err != nil {
+				fmt.Fprintln(w, err)
+				break
+			}
+		}
+		if vodSafeMode.Load() {
+			fmt.Fprintln(w, "VOD-safe mode is on")
+		} else {
+			fmt.Fprintln(w, "VOD-safe mode is off")
+		}
+	case "pause":
+		musicPlayer.TogglePause()
+	case "skip":
+		err := musicPlayer.Skip()
+		if err != nil {
+			fmt.Fprintln(w, "Error skipping song:", err)
+		}
+	case "stop":
+		stopPlayback()
+	case "restart":
+		err := musicPlayer.Seek(0)
+		if err != nil {
+			fmt.Fprintln(w, "Error restarting song:", err)
+		}
+	case "seek":
+		d, err := parseSeek(arg, musicPlayer.Position())
+		if err == nil {
+			err = musicPlayer.Seek(d)
+		}
+		if err != nil {
+			fmt.Fprintln(w, "Error seeking:", err)
+		}
+	case "play":
+		artist, album, song := twedia.FindSong(music(), arg)
+		if song == nil {
+			fmt.Fprintln(w, "No such song:", arg)
+			break
+		}
+		if vodSafeBlocks(artist, album, song) {
+			fmt.Fprintf(w, "Warning: %s is not VOD-safe, and will appear in the VOD report\n", song.Title)
+		}
+		musicPlayer.SetContinuing(false)
+		startPlaying(artist, album, song, trigger{Source: "console"})
+	case "queue":
+		runQueueCommand(arg, w)
+	case "upcoming":
+		showUpcoming(w)
+	case "veto":
+		n := 1
+		if arg != "" {
+			var err error
+			n, err = strconv.Atoi(arg)
+			if err != nil {
+				fmt.Fprintln(w, "Invalid song number:", arg)
+				break
+			}
+		}
+		s, err := vetoSong(n)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			break
+		}
+		fmt.Fprintf(w, "Vetoed %s by %s\n", s.song.Title, s.artist.Artist)
+		showUpcoming(w)
+	case "status":
+		if p, ok := nowPlaying(); ok {
+			fmt.Fprintf(w, "Playing %s by %s (%s / %s)\n", p.Song.Title, p.Artist.Artist, formatDuration(musicPlayer.Position()), formatDuration(musicPlayer.Duration()))
+		} else {
+			fmt.Fprintln(w, "Not playing")
+		}
+	case "history":
+		recent := recentHistory(10)
+		if len(recent) == 0 {
+			fmt.Fprintln(w, "Nothing has been played yet")
+		}
+		for _, e := range recent {
+			fmt.Fprintf(w, "%s  %s by %s (%s", e.Time.Format("15:04"), e.Song, e.Artist, e.Trigger)
+			if e.User != "" {
+				fmt.Fprintf(w, ", %s", e.User)
+			}
+			fmt.Fprintln(w, ")")
+		}
+	case "refresh":
+		changed, err := refreshCatalog()
+		if err != nil {
+			fmt.Fprintln(w, "Error refreshing the music catalog:", err)
+		} else if changed {
+			fmt.Fprintf(w, "Music catalog updated: %d songs\n", music().TotalSongs)
+		} else {
+			fmt.Fprintln(w, "The music catalog has not changed")
+		}
+	case "quit":
+		return true
+	case "help", "":
+		fmt.Fprintln(w, controlHelp(false))
+	default:
+		fmt.Fprintln(w, "Unknown command:", cmd)
+	}
+	return false
+}
+
+// parseSeek works out where to seek to from a time such as "1:30" or "90s", or one relative to
+// `pos` such as "+10s" or "-1:00".
+func parseSeek(arg string, pos time.Duration) (time.Duration, error) {
+	sign := 0
+	if rest, found := strings.CutPrefix(arg, "+"); found {
+		sign, arg = 1, rest
+	} else if rest, found := strings.CutPrefix(arg, "-"); found {
+		sign, arg = -1, rest
+	}
+
+	var d time.Duration
+	if strings.Contains(arg, ":") {
+		// [h:]m:ss
+		for _, part := range strings.Split(arg, ":") {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return 0, errors.New("invalid time '" + arg + "'")
+			}
+			d = d*60 + time.Duration(n)*time.Second
+		}
+	} else {
+		var err error
+		d, err = time.ParseDuration(arg)
+		if err != nil {
+			return 0, errors.New("invalid time '" + arg + "'")
+		}
+	}
+
+	if sign != 0 {
+		return max(pos+time.Duration(sign)*d, 0), nil
+	}
+	return d, nil
+}
+
+// showUpcoming lists the request queue, then the songs chosen in advance, numbered for `veto`.
+func showUpcoming(w io.Writer) {
+	for _, q := range queuedTracks() {
+		fmt.Fprintf(w, "-  %s by %s", q.Song.Title, q.Artist.Artist)
+		if q.User != "" {
+			fmt.Fprintf(w, " (requested by %s)", q.User)
+		}
+		fmt.Fprintln(w)
+	}
+	if !musicPlayer.Continuing() {
+		fmt.Fprintln(w, "Music stops after the request queue")
+		return
+	}
+	for i, s := range prerolledSongs() {
+		fmt.Fprintf(w, "%d. %s by %s\n", i+1, s.song.Title, s.artist.Artist)
+	}
+}
+
+func runQueueCommand(arg string, w io.Writer) {
+	sub, query, _ := strings.Cut(arg, " ")
+	switch strings.ToLower(sub) {
+	case "":
+		queueLock.Lock()
+		defer queueLock.Unlock()
+		if len(requestQueue) == 0 {
+			fmt.Fprintln(w, "The queue is empty")
+		}
+		for i, q := range requestQueue {
+			fmt.Fprintf(w, "%d. %s by %s", i+1, q.Song.Title, q.Artist.Artist)
+			if q.User != "" {
+				fmt.Fprintf(w, " (requested by %s)", q.User)
+			}
+			fmt.Fprintln(w)
+		}
+	case "add":
+		artist, album, song := twedia.FindSong(music(), query)
+		if song == nil {
+			fmt.Fprintln(w, "No such song:", query)
+			return
+		}
+		pos := enqueue(queuedTrack{
+			Artist: *artist,
+			Album:  *album,
+			Song:   *song,
+		})
+		fmt.Fprintf(w, "Queued %s by %s at position %d\n", song.Title, artist.Artist, pos)
+		if vodSafeBlocks(artist, album, song) {
+			fmt.Fprintln(w, "Warning: it is not VOD-safe, so it will be skipped while VOD-safe mode is on")
+		}
+		ensurePlaying(trigger{Source: "console"})
+	case "clear":
+		queueLock.Lock()
+		requestQueue = nil
+		queueLock.Unlock()
+		fmt.Fprintln(w, "Cleared the queue")
+	case "load":
+		added, unmatched, err := queuePlaylist(strings.TrimSpace(query))
+		if err != nil {
+			fmt.Fprintln(w, "Error loading playlist:", err)
+			return
+		}
+		fmt.Fprintf(w, "Queued %d songs\n", added)
+		for _, e := range unmatched {
+			fmt.Fprintln(w, "Not in the catalog:", e.Location)
+		}
+		if added > 0 {
+			ensurePlaying(trigger{Source: "console"})
+		}
+	case "save":
+		n, err := saveQueue(strings.TrimSpace(query))
+		if err != nil {
+			fmt.Fprintln(w, "Error saving the queue:", err)
+			return
+		}
+		fmt.Fprintf(w, "Saved %d songs\n", n)
+	default:
+		fmt.Fprintln(w, "Unknown queue command:", sub)
+	}
+}
+
+// errAlreadyRunning is returned by serveControlSocket if another twedia is using its socket.
+var errAlreadyRunning = errors.New("twedia is already running")
+
+// requestQuit asks twedia to quit, unless it has already been asked.
+func requestQuit(quit chan<- bool) {
+	select {
+	case quit <- true:
+	default:
+	}
+}
+
+// serveControlSocket accepts commands over a Unix domain socket: each connection sends a single
+// line holding one command, and receives the command's output before the connection is closed.
+// `quit` is signalled if a client asks twedia to quit. The returned function stops listening and
+// removes the socket.
+func serveControlSocket(path string, quit chan<- bool) (func(), error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " already exists, and is not a control socket")
+		}
+		// a socket which still answers belongs to another twedia; any other was left behind by a previous run
+		c, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%w: its control socket %s is in use", errAlreadyRunning, path)
+		}
+		os.Remove(path)
+	}
+
+	// create the socket in a directory which only we may use, and move it into place once only
+	// we may use the socket itself, so that nobody else can connect to it in the meantime
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".twedia-ctl-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed at shutdown from where it has been moved to
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	slog.Info("Listening for commands on " + path)
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("Error accepting control socket connection", "err", err)
+				continue
+			}
+			go func() {
+				defer c.Close()
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err != nil && line == "" {
+					return
+				}
+				if runCommand(line, c) {
+					fmt.Fprintln(c, "Quitting")
+					requestQuit(quit)
+				}
+			}()
+		}
+	}()
+	return func() {
+		ln.Close()
+		os.Remove(path)
+	}, nil
+}
+
+// runCtl sends a command to a running twedia over its control socket, and writes the response to `out`.
+func runCtl(out io.Writer, path string, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(out, controlHelp(false))
+		return nil
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return errors.New("unable to reach twedia at " + path + " (is it running?): " + err.Error())
+	}
+	defer c.Close()
+
+	line := strings.Join(args, " ")
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("commands may not contain line breaks")
+	}
+	_, err = io.WriteString(c, line+"\n")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, c)
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSeek(t *testing.T) {
+	pos := 90 * time.Second
+	tests := []struct {
+		arg     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{arg: "1:30", want: 90 * time.Second},
+		{arg: "0:05", want: 5 * time.Second},
+		{arg: "1:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{arg: "45s", want: 45 * time.Second},
+		{arg: "2m", want: 2 * time.Minute},
+		{arg: "+10s", want: 100 * time.Second},
+		{arg: "-30s", want: 60 * time.Second},
+		{arg: "+0:30", want: 2 * time.Minute},
+		{arg: "-5m", want: 0},
+		{arg: "", wantErr: true},
+		{arg: "soon", wantErr: true},
+		{arg: "1:xx", wantErr: true},
+		{arg: "1:-5", wantErr: true},
+		{arg: "+", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSeek(tt.arg, pos)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSeek(%q) = %v, want an error", tt.arg, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSeek(%q) = %v, %v; want %v", tt.arg, got, err, tt.want)
+		}
+	}
+}
+
+// ctl runs a command through the control socket at `path`, returning its output.
+func ctl(t *testing.T, path string, args ...string) string {
+	t.Helper()
+	var out strings.Builder
+	err := runCtl(&out, path, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestControlSocket(t *testing.T) {
+	useTestPlayer(t)
+	useTestCatalog(t, testMusic())
+	path := filepath.Join(t.TempDir(), "twedia.sock")
+	quit := make(chan bool, 1)
+	stop, err := serveControlSocket(path, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket is %v, %v", info, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("left behind %v", entries)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"shuffle", "bag"}, "Shuffle mode: bag\n"},
+		{[]string{"shuffle"}, "Shuffle mode: bag\n"},
+		{[]string{"tags", "chill", "-loud"}, "Tags: chill -loud\n"},
+		{[]string{"tags", "clear"}, "Tags: any\n"},
+		{[]string{"status"}, "Not playing\n"},
+		{[]string{"play", "nothing"}, "No such song: nothing\n"},
+		{[]string{"frobnicate"}, "Unknown command: frobnicate\n"},
+		{[]string{"help"}, controlHelp(false) + "\n"},
+	}
+	for _, tt := range tests {
+		if got := ctl(t, path, tt.args...); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if strings.Contains(controlHelp(false), "select") || !strings.Contains(controlHelp(true), "select") {
+		t.Error("console-only commands are not limited to the console")
+	}
+
+	// asking to quit more than once neither blocks nor queues a second quit
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := ctl(t, path, "quit"); got != "Quitting\n" {
+				t.Errorf("got %q from quit", got)
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-quit:
+	default:
+		t.Error("quit was not signalled")
+	}
+	requestQuit(quit)
+	requestQuit(quit)
+
+	var out strings.Builder
+	if err := runCtl(&out, path, []string{"queue", "add", "a\nquit"}); err == nil {
+		t.Error("sent a command with a line break")
+	}
+
+	stop()
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket is still there after stopping: %v", err)
+	}
+	if err := runCtl(&out, path, []string{"status"}); err == nil || !strings.Contains(err.Error(), "is it running?") {
+		t.Errorf("got error %v with nothing listening", err)
+	}
+}
+
+func TestControlSocketInUse(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "twedia.sock")
+	stop, err := serveControlSocket(path, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	// another twedia does not take over the socket
+	_, err = serveControlSocket(path, make(chan bool, 1))
+	if !errors.Is(err, errAlreadyRunning) {
+		t.Errorf("got error %v for a socket in use", err)
+	}
+	if got := ctl(t, path, "frobnicate"); got != "Unknown command: frobnicate\n" {
+		t.Errorf("the first twedia answered %q", got)
+	}
+
+	// a socket left behind by a twedia which has exited is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	stop2, err := serveControlSocket(stale, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("got error %v for a stale socket", err)
+	}
+	stop2()
+
+	// anything else is left alone
+	other := filepath.Join(dir, "notes.txt")
+	err = os.WriteFile(other, []byte("keep me"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serveControlSocket(other, make(chan bool, 1)); err == nil {
+		t.Error("replaced a file which is not a socket")
+	}
+	if data, _ := os.ReadFile(other); string(data) != "keep me" {
+		t.Errorf("file holds %q", data)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lyrenhex/twedia/secrets"
+)
+
+type secretsConfig struct {
+	// Where new secrets are saved: "keyring" (the default; falls back to `file` if the OS keyring is unavailable) or "file".
+	Store string `json:"store,omitempty"`
+	// Path of the secrets file; defaults to secrets.json alongside the config file.
+	File string `json:"file,omitempty"`
+}
+
+// credentials holds the secrets referred to by the config file.
+type credentials struct {
+	ClientSecret     secrets.Secret
+	OauthToken       secrets.Secret
+	PubsubOauthToken secrets.Secret
+	OBSPassword      secrets.Secret
+	IcecastPassword  secrets.Secret
+}
+
+var creds credentials
+
+// credsLock guards the secrets which may be updated while twedia is running, such as refreshed OAuth tokens.
+var credsLock sync.RWMutex
+var secretStore *secrets.Store
+
+// secretField ties a secret's reference in the config file to its resolved value.
+type secretField struct {
+	name string
+	// Dotted key of the reference within the config file.
+	path  string
+	ref   *string
+	value *secrets.Secret
+}
+
+func secretFields() []secretField {
+	fields := []secretField{
+		{"clientSecret", "clientSecret", &config.ClientSecret, &creds.ClientSecret},
+		{"oauthToken", "oauthToken", &config.OauthToken, &creds.OauthToken},
+		{"pubsubOauthToken", "pubsubOauthToken", &config.PubsubOauthToken, &creds.PubsubOauthToken},
+	}
+	if config.OBS != nil {
+		fields = append(fields, secretField{"obsPassword", "obs.password", &config.OBS.Password, &creds.OBSPassword})
+	}
+	if config.Stream != nil && config.Stream.Icecast != nil {
+		fields = append(fields, secretField{"icecastPassword", "stream.icecast.password", &config.Stream.Icecast.Password, &creds.IcecastPassword})
+	}
+	return fields
+}
+
+// loadCredentials resolves the secrets referred to by the config file at `configFile`. If
+// `migrate` is set, any secret written directly in the config is moved into the secret store,
+// and the file which held it is updated to refer to it instead.
+func loadCredentials(configFile string, migrate bool) error {
+	sc := secretsConfig{}
+	if config.Secrets != nil {
+		sc = *config.Secrets
+	}
+	if sc.File == "" {
+		sc.File = filepath.Join(filepath.Dir(configFile), "secrets.json")
+	}
+	if sc.Store != "" && sc.Store != "keyring" && sc.Store != "file" {
+		return errors.New("unknown secret store '" + sc.Store + "'")
+	}
+	secretStore = secrets.Open(sc.File, sc.Store != "file")
+
+	for _, f := range secretFields() {
+		v, err := secretStore.Resolve(*f.ref)
+		if err != nil {
+			return errors.New(f.name + ": " + err.Error())
+		}
+		*f.value = v
+
+		if migrate && v != "" && !secrets.IsReference(*f.ref) {
+			ref, err := secretStore.Save(f.name, v)
+			if err != nil {
+				slog.Warn("Unable to move "+f.name+" out of the config file", "err", err)
+				continue
+			}
+			fn := configValueFile(configFile, f.path)
+			err = setConfigValue(fn, f.path, ref)
+			if err != nil {
+				return err
+			}
+			*f.ref = ref
+			slog.Info("Moved " + f.name + " from " + fn + " to " + ref)
+		}
+	}
+
+	return nil
+}
+
+// updateSecret saves a new value for the named secret, such as a refreshed OAuth token, and
+// updates the config at `configFile` to refer to it.
+func updateSecret(configFile, name string, value secrets.Secret) error {
+	credsLock.Lock()
+	defer credsLock.Unlock()
+	for _, f := range secretFields() {
+		if f.name != name {
+			continue
+		}
+		*f.value = value
+		if strings.HasPrefix(*f.ref, "env:") {
+			return errors.New(name + " is read from the environment, so cannot be updated")
+		}
+		ref, err := secretStore.Save(name, value)
+		if err != nil {
+			return err
+		}
+		if ref == *f.ref {
+			return nil
+		}
+		*f.ref = ref
+		return setConfigValue(configValueFile(configFile, f.path), f.path, ref)
+	}
+	return errors.New("unknown secret " + name)
+}
+
+// pubsubToken returns the PubSub OAuth token, which is replaced if Twitch rejects it.
+func pubsubToken() string {
+	credsLock.RLock()
+	defer credsLock.RUnlock()
+	return creds.PubsubOauthToken.Reveal()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+type historyConfig struct {
+	// Songs played within this many minutes are not chosen at random.
+	ExcludeMinutes int `json:"excludeMinutes,omitempty"`
+	// Songs among this many most recently played are not chosen at random.
+	ExcludeTracks int `json:"excludeTracks,omitempty"`
+	// Number of songs listed by the `history` action; defaults to 5.
+	Length int `json:"length,omitempty"`
+}
+
+// historyEntry records a song which was played.
+type historyEntry struct {
+	Time   time.Time `json:"time"`
+	Artist string    `json:"artist"`
+	Album  string    `json:"album"`
+	Song   string    `json:"title"`
+	URL    string    `json:"url,omitempty"`
+	// What caused the song to play: "random", "request", "chat", "reward" or "console".
+	Trigger string `json:"trigger"`
+	User    string `json:"user,omitempty"`
+}
+
+// How many of the most recently played songs are kept in memory.
+const historyMemory = 500
+
+var playHistory []historyEntry
+var historyLock sync.Mutex
+
+// historyFile returns where the play history is kept: a file of JSON objects, one per line.
+func historyFile() string {
+	return filepath.Join(dataDir, "history.jsonl")
+}
+
+// songKey identifies a song by its artist and title, ignoring case.
+func songKey(artist, title string) string {
+	return strings.ToLower(artist + "\x00" + title)
+}
+
+// readHistory reads the play history file at `fn`; a missing file holds no history.
+func readHistory(fn string) ([]historyEntry, error) {
+	f, err := os.Open(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var e historyEntry
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			return entries, fmt.Errorf("%s:%d: %w", fn, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// loadHistory loads the most recently played songs from the play history file.
+func loadHistory() error {
+	entries, err := readHistory(historyFile())
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	playHistory = entries[max(len(entries)-historyMemory, 0):]
+	return err
+}
+
+// recordPlay adds a song to the play history.
+func recordPlay(e historyEntry) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	playHistory = append(playHistory, e)
+	if len(playHistory) > historyMemory {
+		playHistory = playHistory[len(playHistory)-historyMemory:]
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Error recording play history", "err", err)
+		return
+	}
+	f, err := os.OpenFile(historyFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Error recording play history", "err", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		slog.Error("Error recording play history", "err", err)
+	}
+}
+
+// recentHistory returns up to `n` of the most recently played songs, most recent first.
+func recentHistory(n int) []historyEntry {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	n = min(n, len(playHistory))
+	out := make([]historyEntry, n)
+	for i := range out {
+		out[i] = playHistory[len(playHistory)-1-i]
+	}
+	return out
+}
+
+// recentlyPlayed returns the songs which should not be chosen at random, keyed by songKey.
+func recentlyPlayed() map[string]bool {
+	recent := make(map[string]bool)
+	if config.History == nil {
+		return recent
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	since := time.Now().Add(-time.Duration(config.History.ExcludeMinutes) * time.Minute)
+	for i := len(playHistory) - 1; i >= 0; i-- {
+		e := playHistory[i]
+		if len(playHistory)-i > config.History.ExcludeTracks && e.Time.Before(since) {
+			break
+		}
+		recent[songKey(e.Artist, e.Song)] = true
+	}
+	return recent
+}
+
+func runHistoryExport(args []string) error {
+	fs := newFlagSet("history export")
+	since := fs.String("since", "", "only include songs played on or after this date (YYYY-MM-DD)")
+	until := fs.String("until", "", "only include songs played on or before this date (YYYY-MM-DD)")
+	format := fs.String("format", "csv", "format to write: csv, or m3u for a playlist of the songs")
+	out := fs.String("o", "", "file to write the history to, rather than standard output")
+	err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	var from, to time.Time
+	if *since != "" {
+		from, err = time.ParseInLocation(time.DateOnly, *since, time.Local)
+		if err != nil {
+			return errors.New("invalid -since date '" + *since + "'")
+		}
+	}
+	if *until != "" {
+		to, err = time.ParseInLocation(time.DateOnly, *until, time.Local)
+		if err != nil {
+			return errors.New("invalid -until date '" + *until + "'")
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if *format != "csv" && *format != "m3u" {
+		return errors.New("unknown history format '" + *format + "'")
+	}
+
+	entries, err := readHistory(historyFile())
+	if err != nil {
+		return err
+	}
+	if *format == "m3u" {
+		return exportHistoryM3U(entries, from, to, *out)
+	}
+
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Write([]string{"time", "artist", "album", "title", "url", "trigger", "user"})
+	for _, e := range entries {
+		if e.Time.Before(from) || (!to.IsZero() && !e.Time.Before(to)) {
+			continue
+		}
+		w.Write([]string{e.Time.Format(time.RFC3339), e.Artist, e.Album, e.Song, e.URL, e.Trigger, e.User})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return writeOutput(*out, buf.Bytes())
+}
+
+// exportHistoryM3U writes the songs played between `from` and `to` as an M3U playlist, which
+// needs the catalog to find where each song's audio is.
+func exportHistoryM3U(entries []historyEntry, from, to time.Time, out string) error {
+	err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	err = loadCatalog()
+	if err != nil {
+		return err
+	}
+
+	var playlist []twedia.PlaylistEntry
+	for _, e := range entries {
+		if e.Time.Before(from) || (!to.IsZero() && !e.Time.Before(to)) {
+			continue
+		}
+		artist, album, song := twedia.FindArtistSong(music(), e.Artist, e.Song)
+		if song == nil {
+			slog.Warn("Leaving out a song which is no longer in the catalog", "artist", e.Artist, "song", e.Song)
+			continue
+		}
+		pe, ok := songEntry(*artist, *album, *song)
+		if !ok {
+			slog.Warn("Leaving out a song whose audio cannot be found", "artist", e.Artist, "song", e.Song)
+			continue
+		}
+		playlist = append(playlist, pe)
+	}
+	buf := new(bytes.Buffer)
+	err = twedia.WriteM3U(buf, playlist)
+	if err != nil {
+		return err
+	}
+	return writeOutput(out, buf.Bytes())
+}
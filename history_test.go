@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+var initTestPlayer sync.Once
+
+// useTestPlayer plays music through the null output, and keeps the play history in a temporary directory.
+func useTestPlayer(t *testing.T) {
+	t.Helper()
+	initTestPlayer.Do(func() {
+		err := twedia.InitOutput("null", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		musicPlayer = twedia.NewPlayer()
+	})
+	oldDataDir := dataDir
+	dataDir = t.TempDir()
+	historyLock.Lock()
+	playHistory = nil
+	historyLock.Unlock()
+	t.Cleanup(func() { dataDir = oldDataDir })
+}
+
+// writeWAV writes `n` samples of silence to a mono, 16-bit, 8kHz WAV file.
+func writeWAV(t *testing.T, fn string, n int) {
+	t.Helper()
+	const rate = 8000
+	b := []byte("RIFF")
+	b = binary.LittleEndian.AppendUint32(b, uint32(36+2*n))
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, rate)
+	b = binary.LittleEndian.AppendUint32(b, rate*2)
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = binary.LittleEndian.AppendUint16(b, 16)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(2*n))
+	b = append(b, make([]byte, 2*n)...)
+	err := os.WriteFile(fn, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlayTrackRecordsOnlyPlayedSongs(t *testing.T) {
+	useTestPlayer(t)
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.wav")
+	writeWAV(t, good, 400)
+	bad := filepath.Join(dir, "bad.wav")
+	err := os.WriteFile(bad, []byte("not audio at all"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artist := twedia.Artist{Artist: "Artist"}
+	album := twedia.Album{Name: "Album"}
+	err = playTrack(artist, album, twedia.Song{Title: "Bad", Audio: bad}, "request", "viewer")
+	if err == nil {
+		t.Error("playing an unreadable file succeeded")
+	}
+	if h := recentHistory(5); len(h) != 0 {
+		t.Errorf("a song which did not play was recorded: %v", h)
+	}
+
+	err = playTrack(artist, album, twedia.Song{Title: "Good", Audio: good}, "request", "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := recentHistory(5)
+	if len(h) != 1 || h[0].Song != "Good" || h[0].Trigger != "request" || h[0].User != "viewer" {
+		t.Errorf("got history %v", h)
+	}
+	if _, ok := nowPlaying(); ok {
+		t.Error("the song is still playing once it has finished")
+	}
+	entries, err := readHistory(historyFile())
+	if err != nil || len(entries) != 1 {
+		t.Errorf("history file holds %v, %v", entries, err)
+	}
+}
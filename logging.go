@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lyrenhex/twedia/obs"
+	"github.com/lyrenhex/twedia/secrets"
+	"github.com/lyrenhex/twedia/twedia"
+	"github.com/lyrenhex/twedia/twitch"
+	"github.com/lyrenhex/twedia/veadotube"
+)
+
+type loggingConfig struct {
+	// Least severe level of message to show: "debug", "info" (the default), "warn" or "error".
+	Level string `json:"level,omitempty"`
+	// Levels for particular subsystems, overriding `level`.
+	Subsystems map[string]string `json:"subsystems,omitempty"`
+	// "text" (the default) or "json".
+	Format string `json:"format,omitempty"`
+	// File to write log messages to, as well as the terminal.
+	File string `json:"file,omitempty"`
+	// Size in megabytes at which the log file is rotated; defaults to 10.
+	MaxSize int `json:"maxSize,omitempty"`
+	// Number of rotated log files to keep; defaults to 5.
+	MaxFiles int `json:"maxFiles,omitempty"`
+}
+
+// The parts of twedia which have their own loggers, and may have their own log levels.
+var logSubsystems = []string{"twedia", "music", "twitch", "veadotube", "obs", "secrets"}
+
+// Repeated warnings and errors beyond this many in a minute are suppressed.
+const logRepeatLimit = 5
+
+// Logging settings given on the command line, which override those in the config file.
+var logLevelFlag, logFormatFlag, logFileFlag string
+
+// switchWriter passes writes on to a writer which may be changed at any time.
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *switchWriter) Set(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w = w
+}
+
+// logOutput is where all log messages are shown; the terminal UI shows them in a pane while it runs.
+var logOutput = &switchWriter{w: os.Stderr}
+
+// The log file currently being written to, if any.
+var logFile *rotatingFile
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, errors.New("unknown log level '" + s + "'")
+	}
+	return level, nil
+}
+
+// validate checks the logging settings, and returns the level for each subsystem.
+func (c loggingConfig) validate() (map[string]slog.Level, error) {
+	def := slog.LevelInfo
+	var err error
+	if c.Level != "" {
+		def, err = parseLevel(c.Level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	levels := make(map[string]slog.Level)
+	for _, name := range logSubsystems {
+		levels[name] = def
+	}
+	for name, s := range c.Subsystems {
+		if _, ok := levels[name]; !ok {
+			return nil, errors.New("unknown log subsystem '" + name + "' (expected one of " + strings.Join(logSubsystems, ", ") + ")")
+		}
+		levels[name], err = parseLevel(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.Format != "" && c.Format != "text" && c.Format != "json" {
+		return nil, errors.New("unknown log format '" + c.Format + "'")
+	}
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return nil, errors.New("log file limits may not be negative")
+	}
+	return levels, nil
+}
+
+// configureLogging sets up every subsystem's logger from the config file's logging settings
+// (which may be nil) and the command line flags.
+func configureLogging(c *loggingConfig) error {
+	lc := loggingConfig{}
+	if c != nil {
+		lc = *c
+	}
+	lc.Subsystems = make(map[string]string)
+	if c != nil {
+		for k, v := range c.Subsystems {
+			lc.Subsystems[k] = v
+		}
+	}
+	// the -log-level flag takes a default level and/or subsystem=level pairs, separated by commas
+	for _, part := range strings.Split(logLevelFlag, ",") {
+		part = strings.TrimSpace(part)
+		if name, level, found := strings.Cut(part, "="); found {
+			lc.Subsystems[name] = level
+		} else if part != "" {
+			lc.Level = part
+		}
+	}
+	if logFormatFlag != "" {
+		lc.Format = logFormatFlag
+	}
+	if logFileFlag != "" {
+		lc.File = logFileFlag
+	}
+
+	levels, err := lc.validate()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = logOutput
+	oldFile := logFile
+	logFile = nil
+	if lc.File != "" {
+		if lc.MaxSize == 0 {
+			lc.MaxSize = 10
+		}
+		if lc.MaxFiles == 0 {
+			lc.MaxFiles = 5
+		}
+		logFile, err = openRotatingFile(lc.File, int64(lc.MaxSize)<<20, lc.MaxFiles)
+		if err != nil {
+			return err
+		}
+		w = io.MultiWriter(logOutput, logFile)
+	}
+
+	// levels are checked per subsystem, so the underlying handler lets everything through
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var base slog.Handler = slog.NewTextHandler(w, opts)
+	if lc.Format == "json" {
+		base = slog.NewJSONHandler(w, opts)
+	}
+	handlers := make(map[string]slog.Handler)
+	for _, name := range logSubsystems {
+		handlers[name] = base.WithAttrs([]slog.Attr{slog.String("subsystem", name)})
+	}
+	currentLogging.Store(&logSettings{
+		handlers: handlers,
+		levels:   levels,
+		limiter:  newRateLimiter(time.Minute, logRepeatLimit),
+	})
+
+	// the loggers themselves never change, so that the config may be reloaded while they are in use
+	installLoggers.Do(func() {
+		logger := func(name string) *slog.Logger {
+			return slog.New(&logHandler{subsystem: name})
+		}
+		slog.SetDefault(logger("twedia"))
+		twedia.SetLogger(logger("music"))
+		twitch.SetLogger(logger("twitch"))
+		veadotube.SetLogger(logger("veadotube"))
+		obs.SetLogger(logger("obs"))
+		secrets.SetLogger(logger("secrets"))
+	})
+
+	if oldFile != nil {
+		oldFile.Close()
+	}
+	return nil
+}
+
+// logSettings is how log messages are handled, which is replaced as a whole whenever the config is reloaded.
+type logSettings struct {
+	// The handler for each subsystem's messages, once they have been filtered.
+	handlers map[string]slog.Handler
+	levels   map[string]slog.Level
+	limiter  *rateLimiter
+}
+
+var currentLogging atomic.Pointer[logSettings]
+
+// installLoggers gives each subsystem its logger, the first time logging is configured.
+var installLoggers sync.Once
+
+// logHandler filters a subsystem's log messages by level, and suppresses warnings and errors
+// which are repeated too often, according to the current log settings.
+type logHandler struct {
+	subsystem string
+	// Attributes and groups added with WithAttrs and WithGroup, in order.
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= currentLogging.Load().levels[h.subsystem]
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	s := currentLogging.Load()
+	if r.Level >= slog.LevelWarn {
+		ok, suppressed := s.limiter.allow(h.subsystem + "\x00" + r.Message)
+		if !ok {
+			return nil
+		}
+		if suppressed > 0 {
+			r.AddAttrs(slog.Int("suppressed", suppressed))
+		}
+	}
+	next := s.handlers[h.subsystem]
+	for _, w := range h.with {
+		next = w(next)
+	}
+	return next.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.withHandler(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.withHandler(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *logHandler) withHandler(w func(slog.Handler) slog.Handler) slog.Handler {
+	c := *h
+	c.with = append(append([]func(slog.Handler) slog.Handler(nil), h.with...), w)
+	return &c
+}
+
+// rateLimiter allows each message through at most `limit` times per window.
+type rateLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	limit  int
+	seen   map[string]*rateEntry
+	// When expired entries were last removed from `seen`.
+	swept time.Time
+}
+
+func newRateLimiter(window time.Duration, limit int) *rateLimiter {
+	return &rateLimiter{window: window, limit: limit, seen: make(map[string]*rateEntry), swept: time.Now()}
+}
+
+type rateEntry struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// allow reports whether the message with the given key may be logged, and if so, how many
+// times it was suppressed during the previous window.
+func (rl *rateLimiter) allow(key string) (bool, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rl.swept) >= rl.window {
+		rl.sweep(now)
+	}
+	e := rl.seen[key]
+	if e == nil || now.Sub(e.start) >= rl.window {
+		suppressed := 0
+		if e != nil {
+			suppressed = e.suppressed
+		}
+		rl.seen[key] = &rateEntry{start: now, count: 1}
+		return true, suppressed
+	}
+	e.count++
+	if e.count > rl.limit {
+		e.suppressed++
+		return false, 0
+	}
+	return true, 0
+}
+
+// sweep forgets messages whose window has passed, so that `seen` does not grow forever. Those
+// which were suppressed are kept for another window, in case they are logged again and the
+// number suppressed can be reported.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, e := range rl.seen {
+		age := now.Sub(e.start)
+		if age >= 2*rl.window || (age >= rl.window && e.suppressed == 0) {
+			delete(rl.seen, key)
+		}
+	}
+	rl.swept = now
+}
+
+// rotatingFile is a log file which is renamed to `path.1` (and any older file to `path.2`, and
+// so on) once it would exceed `maxSize` bytes, keeping at most `maxFiles` old files.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	err := os.Rename(r.path, r.path+".1")
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
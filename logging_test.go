@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(time.Hour, 2)
+	for i, want := range []bool{true, true, false, false} {
+		ok, suppressed := rl.allow("a")
+		if ok != want || suppressed != 0 {
+			t.Errorf("message %d: got %v, %d; want %v, 0", i, ok, suppressed, want)
+		}
+	}
+	// other messages are counted separately
+	if ok, _ := rl.allow("b"); !ok {
+		t.Error("a different message was suppressed")
+	}
+
+	// once the window has passed, the number suppressed is reported
+	rl.seen["a"].start = time.Now().Add(-time.Hour)
+	ok, suppressed := rl.allow("a")
+	if !ok || suppressed != 2 {
+		t.Errorf("got %v, %d; want true, 2", ok, suppressed)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newRateLimiter(time.Minute, 1)
+	now := time.Now()
+	rl.seen["quiet"] = &rateEntry{start: now.Add(-90 * time.Second), count: 1}
+	rl.seen["suppressed"] = &rateEntry{start: now.Add(-90 * time.Second), count: 3, suppressed: 2}
+	rl.seen["old"] = &rateEntry{start: now.Add(-3 * time.Minute), count: 3, suppressed: 2}
+	rl.seen["current"] = &rateEntry{start: now.Add(-time.Second), count: 1}
+	rl.swept = now.Add(-time.Minute)
+
+	rl.allow("new")
+	for key, want := range map[string]bool{"quiet": false, "suppressed": true, "old": false, "current": true, "new": true} {
+		if _, ok := rl.seen[key]; ok != want {
+			t.Errorf("%s: kept is %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twedia.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err = fmt.Fprintf(r, "line %d\n", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each line fills the file, so only the last three survive
+	for fn, want := range map[string]string{
+		path:        "line 4\n",
+		path + ".1": "line 3\n",
+		path + ".2": "line 2\n",
+	} {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s holds %q, want %q", fn, data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("more old files were kept than allowed")
+	}
+	if _, err := r.Write([]byte("x")); err == nil {
+		t.Error("wrote to a closed file")
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twedia.log")
+	err := os.WriteFile(path, []byte("earlier\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRotatingFile(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("later\n"))
+	r.Close()
+	data, _ := os.ReadFile(path)
+	if string(data) != "earlier\nlater\n" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestReconfigureLogging(t *testing.T) {
+	defer logOutput.Set(os.Stderr)
+	out := &lockedBuffer{}
+	logOutput.Set(out)
+
+	err := configureLogging(&loggingConfig{Level: "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.Default().With("k", "v")
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if s := out.String(); strings.Contains(s, "hidden") || !strings.Contains(s, "msg=shown") || !strings.Contains(s, "k=v") || !strings.Contains(s, "subsystem=twedia") {
+		t.Errorf("got %q", s)
+	}
+
+	// the config may be reloaded while messages are being logged
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				logger.Debug("message", "j", j)
+			}
+		}()
+	}
+	for _, level := range []string{"debug", "info", "error", "debug"} {
+		err := configureLogging(&loggingConfig{Level: level})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	out.Reset()
+	logger.Info("after")
+	if !strings.Contains(out.String(), "msg=after") {
+		t.Errorf("the logger does not follow the new settings: %q", out.String())
+	}
+}
+
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.b.Reset()
+}
@@ -4,120 +4,264 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha256"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	tirc "github.com/gempir/go-twitch-irc"
+	tirc "github.com/gempir/go-twitch-irc/v4"
+	"github.com/lyrenhex/twedia/obs"
+	"github.com/lyrenhex/twedia/secrets"
 	"github.com/lyrenhex/twedia/twedia"
 	"github.com/lyrenhex/twedia/twitch"
 	"github.com/lyrenhex/twedia/veadotube"
+	"golang.org/x/term"
 )
 
-type Config struct {
-	Username           string    `json:"username"`
-	Channel            string    `json:"channel"`
-	ClientID           string    `json:"clientID"`
-	ClientSecret       string    `json:"clientSecret"`
-	MusicDir           string    `json:"musicDir"`
-	MusicFile          string    `json:"musicFile"`
-	OauthToken         string    `json:"oauthToken"`
-	PubsubOauthToken   string    `json:"pubsubOauthToken"`
-	MusicCollectionURL string    `json:"musicCollectionURL"`
-	ChatCommands       []command `json:"chatCommands"`
-	PointRewards       []reward  `json:"pointRewards"`
-}
+var config Config
+
+// The music catalog, which is replaced as a whole when it is refreshed, so the songs within it never change.
+var catalog atomic.Pointer[twedia.Music]
+var catalogLoader *twedia.CatalogLoader
+var t *tirc.Client
+var channelID string
+var musicPlayer *twedia.Player
+var speechPlayer *twedia.Player
+
+var v *veadotube.Veadotube
+var o *obs.OBS
 
-type command struct {
-	Trigger    string      `json:"trigger"`
-	Sound      soundAction `json:"sound"`
-	VTubeState string      `json:"vtubeState"`
+// How long chat commands are on cooldown for after text-to-speech.
+const speechCooldownPeriod = 5 * time.Minute
+
+// speechCooldown tracks when text-to-speech was last used, which puts chat commands on cooldown.
+var speechCooldown struct {
+	sync.Mutex
+	last time.Time
+	// Users who have been told about the current cooldown, who are not told again until the next.
+	told map[string]bool
 }
 
-type reward struct {
-	Title      string      `json:"title"`
-	Sound      soundAction `json:"sound"`
-	VTubeState string      `json:"vtubeState"`
+// startSpeechCooldown puts chat commands on cooldown, as text-to-speech is being used.
+func startSpeechCooldown() {
+	speechCooldown.Lock()
+	defer speechCooldown.Unlock()
+	speechCooldown.last = time.Now()
+	speechCooldown.told = nil
 }
 
-type soundAction struct {
-	Type   string `json:"type"`
-	Text   string `json:"text"`
-	Artist string `json:"artist"`
-	Album  string `json:"album"`
-	Song   string `json:"title"`
+// speechCooldownRemaining returns how long chat commands remain on cooldown, and whether `user`
+// should be told so; each user is told once per cooldown, so that spamming a command does not spam chat.
+func speechCooldownRemaining(user string) (time.Duration, bool) {
+	speechCooldown.Lock()
+	defer speechCooldown.Unlock()
+	remaining := speechCooldownPeriod - time.Since(speechCooldown.last)
+	if remaining <= 0 {
+		return 0, false
+	}
+	if speechCooldown.told[user] {
+		return remaining, false
+	}
+	if speechCooldown.told == nil {
+		speechCooldown.told = make(map[string]bool)
+	}
+	speechCooldown.told[user] = true
+	return remaining, true
 }
 
-var config Config
-var artists twedia.Music
-var t *tirc.Client
-var channelID string
-var musicPlayer twedia.Player
-var speechPlayer twedia.Player
+// Path of the config file, set by the -config flag.
+var configFile string
 
-var v *veadotube.Veadotube
+// Directory holding cached data such as synthesised speech, set by the -data-dir flag.
+var dataDir string
 
-var lastSpeech time.Time = time.Unix(0, 0)
+// Whether to run without the interactive console or any other prompts, e.g. as a service.
+var daemon bool
 
-func init() {
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// loadConfigFile loads and validates the config file given on the command line.
+func loadConfigFile() error {
+	if configFile == "" {
+		return errors.New("no config file given; use -config or set TWITCH_CONFIG_FILE")
+	}
 	var err error
-	config, err = loadConfig(os.Getenv("TWITCH_CONFIG_FILE"))
+	config, err = loadConfig(configFile)
 	if err != nil {
-		panic(err)
+		return errors.New("invalid config file:\n" + indent(err.Error()))
 	}
+	twedia.SetLinkOrder(config.LinkOrder)
+	return configureLogging(config.Logging)
+}
 
-	if !exists("tts") {
-		os.Mkdir("tts", 0644)
+// loadCatalog fetches the music catalog from `musicCollectionURL`.
+func loadCatalog() error {
+	m := &twedia.Music{}
+	err := twedia.GetSongs(m, config.MusicCollectionURL)
+	catalog.Store(m)
+	return err
+}
+
+// music returns the music catalog.
+func music() *twedia.Music {
+	if m := catalog.Load(); m != nil {
+		return m
+	}
+	return &twedia.Music{}
+}
+
+// refreshCatalog loads the music catalog again, and reports whether it had changed. Anything
+// already playing or queued carries on as it was.
+func refreshCatalog() (bool, error) {
+	m, err := catalogLoader.Load()
+	if m == nil {
+		return false, err
 	}
+	catalog.Store(m)
+	// songs lined up by the shuffle mode belong to the old catalog
+	rotation.Lock()
+	resetRotation()
+	rotation.Unlock()
+	return true, err
+}
 
-	err = twedia.GetSongs(&artists, config.MusicCollectionURL)
+// startup loads everything needed to run the bot, and connects to Veadotube, OBS and the Twitch API.
+func startup() error {
+	err := loadConfigFile()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	err = loadCredentials(configFile, true)
+	if err != nil {
+		return fmt.Errorf("unable to load secrets: %w", err)
 	}
 
-	err = twedia.InitSpeaker()
+	err = compileMessages(config.Messages)
+	if err != nil {
+		return fmt.Errorf("invalid message template: %w", err)
+	}
+	if config.ChatRateLimit <= 0 {
+		// Twitch's limit for users who are not a moderator in the channel
+		config.ChatRateLimit = 20
+	}
+
+	err = os.MkdirAll(filepath.Join(dataDir, "tts"), 0755)
+	if err != nil {
+		return err
+	}
+
+	catalogLoader = &twedia.CatalogLoader{
+		Source:    config.MusicCollectionURL,
+		CacheFile: filepath.Join(dataDir, "catalog-cache.json"),
+	}
+	_, err = refreshCatalog()
+	if err != nil {
+		return err
+	}
+
+	err = loadHistory()
+	if err != nil {
+		slog.Warn("Unable to load the play history", "err", err)
+	}
+
+	vodSafeMode.Store(config.VODSafe != nil && config.VODSafe.Enabled)
+	if config.Shuffle != nil {
+		if config.Shuffle.Mode != "" {
+			setShuffleMode(config.Shuffle.Mode)
+		}
+		setTagFilter(config.Shuffle.Tags)
+	}
+
+	output := outputConfig{}
+	if config.Output != nil {
+		output = *config.Output
+	}
+	twedia.SetFFmpeg(config.FFmpeg)
+	remote := remoteAudioConfig{}
+	if config.RemoteAudio != nil {
+		remote = *config.RemoteAudio
+	}
+	if remote.CacheDir == "" {
+		remote.CacheDir = filepath.Join(dataDir, "audio-cache")
+	}
+	twedia.SetRemoteCache(remote.CacheDir, int64(remote.CacheSize)<<20)
+	err = twedia.InitOutput(output.Type, output.File)
 	if err != nil {
-		log.Println("Error initialising speaker:", err)
+		slog.Error("Error initialising audio output", "err", err)
 	}
 
 	musicPlayer = twedia.NewPlayer()
 	speechPlayer = twedia.NewPlayer()
 
-	v, err = veadotube.New()
+	if config.Stream != nil {
+		startStream(config.Stream)
+	}
+	if config.Art != nil {
+		startArt(config.Art)
+	}
+	err = startNowPlaying(nowPlayingOutputs(config))
 	if err != nil {
-		log.Println("Error getting Veadotube instance:", err)
+		return err
+	}
+
+	if daemon || config.VeadotubeInstance != "" {
+		v, err = veadotube.NewNamed(config.VeadotubeInstance)
+	} else {
+		v, err = veadotube.New()
+	}
+	if err != nil {
+		slog.Warn("Error getting Veadotube instance", "err", err)
 	} else if v != nil {
 		v.Connect()
 	}
 
+	if config.OBS != nil && config.OBS.Address != "" {
+		o = obs.New(config.OBS.Address, creds.OBSPassword.Reveal())
+		err = o.Connect()
+		if err != nil {
+			slog.Error("Error connecting to OBS", "err", err)
+		}
+	}
+
 	for {
-		channelID, err = twitch.GetChannelID(config.PubsubOauthToken, config.ClientID)
+		channelID, err = twitch.GetChannelID(creds.PubsubOauthToken.Reveal(), config.ClientID)
 		if err == nil {
-			break
-		} else if err.Error() == "invalid oauth token" {
-			config.PubsubOauthToken = twitch.GetOAuthToken(config.ClientID)
-			config.saveConfig(os.Getenv("TWITCH_CONFIG_FILE"))
-		} else {
-			log.Println("Error obtaining channel ID:", err)
-			os.Exit(1)
+			return nil
+		} else if err.Error() != "invalid oauth token" {
+			return fmt.Errorf("unable to obtain channel ID: %w", err)
+		}
+		_, err = authorise()
+		if err != nil {
+			return err
 		}
 	}
+}
 
-	fmt.Println(`Twedia Music Manager
-	
-Commands:
-	start : start playing random music
-	pause : pause / unpause the current song
-	skip  : skip the current song
-	stop  : stop playing music
-	select: play a specific song
-	quit  : exit program`)
+// authorise has the streamer sign in to Twitch in their browser, and saves and returns the resulting PubSub OAuth token.
+func authorise() (string, error) {
+	if daemon {
+		// there is nobody to sign in
+		return "", errors.New("the PubSub OAuth token is missing or has been rejected; run `twedia auth` in a terminal to sign in to Twitch again")
+	}
+	token, err := twitch.GetOAuthToken(config.ClientID)
+	if err != nil {
+		return "", fmt.Errorf("unable to obtain PubSub OAuth token: %w", err)
+	}
+	err = updateSecret(configFile, "pubsubOauthToken", secrets.Secret(token))
+	if err != nil {
+		slog.Error("Error saving PubSub OAuth token", "err", err)
+	}
+	return token, nil
 }
 
 func hashString(s string) string {
@@ -129,40 +273,9 @@ func hashString(s string) string {
 	return buf.String()
 }
 
-func loadConfig(s string) (Config, error) {
-	var config Config
-
-	f, err := os.Open(s)
-	if err != nil {
-		return config, err
-	}
-	defer f.Close()
-
-	b, _ := io.ReadAll(f)
-
-	json.Unmarshal(b, &config)
-
-	return config, nil
-}
-
-func (c *Config) saveConfig(s string) error {
-	f, err := os.Open(s)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	json, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(s, json, 0777)
-	if err != nil {
-		return err
-	}
-
-	return nil
+// ttsFile returns where the synthesised speech for `text` is cached.
+func ttsFile(text string) string {
+	return filepath.Join(dataDir, "tts", hashString(text)+".mp3")
 }
 
 func exists(fp string) bool {
@@ -177,18 +290,11 @@ func exists(fp string) bool {
 	}
 }
 
-func playTrack(artist twedia.Artist, album twedia.Album, song twedia.Song) error {
-	var f *os.File
-	var err error
-	for {
-		f, err = os.Create(config.MusicFile)
-		if err == nil {
-			break
-		}
+// songFile finds the audio file for a song: the URL of its audio if it has one, or else a file within the music directory.
+func songFile(artist twedia.Artist, album twedia.Album, song twedia.Song) (string, error) {
+	if song.Audio != "" {
+		return song.Audio, nil
 	}
-	defer f.Close()
-
-	// open the song for playing
 	s := string(os.PathSeparator)
 
 	// handle singles: their album name is the same as the song name
@@ -201,112 +307,257 @@ func playTrack(artist twedia.Artist, album twedia.Album, song twedia.Song) error
 
 	files, err := os.ReadDir(path)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	found := false
 	for _, f := range files {
 		fn := strings.ToLower(f.Name())
-		if strings.Contains(fn, strings.ToLower(song.Title)) && (strings.Contains(fn, ".mp3") || strings.Contains(fn, ".flac") || strings.Contains(fn, ".ogg") || strings.Contains(fn, ".wav")) {
-			path += f.Name()
-			found = true
-			break
+		if strings.Contains(fn, strings.ToLower(song.Title)) && twedia.IsAudioFile(fn) {
+			return path + f.Name(), nil
 		}
 	}
-	if !found {
-		log.Println("Song file cannot be found: " + path + song.Title)
-		return errors.New("Song file cannot be found: " + path + song.Title)
+	return "", errors.New("Song file cannot be found: " + path + song.Title)
+}
+
+// playTrack plays a song, recording that it was played because of `source` ("random",
+// "request", "chat", "reward" or "console"), at the request of `requester` if there was one.
+func playTrack(artist twedia.Artist, album twedia.Album, song twedia.Song, source, requester string) error {
+	// open the song for playing
+	path, err := songFile(artist, album, song)
+	if err != nil {
+		return err
 	}
 
-	f.WriteString(fmt.Sprintf("\n%s, by %s", song.Title, artist.Artist))
-	if song.URL != "" {
-		t.Say(config.Channel, fmt.Sprintf("Playing %s by %s. Listen on YouTube: %s", song.Title, artist.Artist, song.URL))
-	} else {
-		t.Say(config.Channel, fmt.Sprintf("Playing %s by %s.", song.Title, artist.Artist))
+	d := trackData(artist, album, song)
+	d.User = requester
+	var start time.Time
+	np := &queuedTrack{
+		Artist: artist,
+		Album:  album,
+		Song:   song,
+		User:   requester,
 	}
+	err = musicPlayer.PlayFileStarted(path, func() {
+		start = time.Now()
+		// only songs which actually play are announced and remembered
+		sendMessage("nowPlaying", d, "")
+		recordPlay(historyEntry{
+			Time:    start,
+			Artist:  artist.Artist,
+			Album:   album.Name,
+			Song:    song.Title,
+			URL:     d.URL,
+			Trigger: source,
+			User:    requester,
+		})
+		setNowPlaying(np)
+	})
+	if start.IsZero() {
+		return err
+	}
+	// another session of music may already have started its own song
+	clearNowPlaying(np)
+	if shouldReportUnsafe(&artist, &album, &song) {
+		go reportUnsafe(artist, album, song, start, time.Now())
+	}
+	return err
+}
 
-	err = musicPlayer.PlayFile(path)
-	if err != nil {
-		log.Println("Error playing file "+path+":", err)
+// songRef points to a song within the catalog.
+type songRef struct {
+	artist *twedia.Artist
+	album  *twedia.Album
+	song   *twedia.Song
+	// Relative likelihood of the song being chosen at random.
+	weight float64
+}
+
+// randomSong picks a song at random, from `album` or `artist` if either is given. Each song's
+// chance depends on its weight rather than on how many songs its artist or album has (this
+// finally solves the disproportionate frequency of 'The Tea Song' and 'Blessed Are The
+// Teamakers'), and recently played songs, along with those in `exclude` (keyed by songKey), are
+// avoided unless there is nothing else to choose from.
+func randomSong(artist *twedia.Artist, album *twedia.Album, exclude map[string]bool) (songRef, bool) {
+	recent := recentlyPlayed()
+	for k := range exclude {
+		recent[k] = true
 	}
+	all := randomCandidates(artist, album)
+	var fresh []songRef
+	for _, s := range all {
+		if !recent[songKey(s.artist.Artist, s.song.Title)] {
+			fresh = append(fresh, s)
+		}
+	}
+	if len(fresh) > 0 {
+		return weightedChoice(fresh), true
+	}
+	if len(all) > 0 {
+		return weightedChoice(all), true
+	}
+	return songRef{}, false
+}
 
-	// clear the current song from the now playing file list
-	os.Create(config.MusicFile)
+// How many songs in a row may fail to play before play gives up.
+const maxPlayFailures = 5
 
-	return nil
+// Identifies the most recent call to play; any earlier call stops once its current song ends.
+var playSession atomic.Int64
+
+// The session of music which is playing, or 0 if there is none, guarded by sessionLock.
+var activeSession int64
+var sessionLock sync.Mutex
+
+// startPlaying stops any music which is playing, and starts playing music as for `play` in its place.
+func startPlaying(artist *twedia.Artist, album *twedia.Album, song *twedia.Song, tr trigger) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	startSession(artist, album, song, tr)
+}
+
+// ensurePlaying starts playing music at random, followed by any requests, unless music is already playing.
+func ensurePlaying(tr trigger) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	if activeSession == 0 {
+		startSession(nil, nil, nil, tr)
+	}
 }
 
-func play(artist *twedia.Artist, album *twedia.Album, song *twedia.Song) {
+// startSession is startPlaying for callers which hold sessionLock.
+func startSession(artist *twedia.Artist, album *twedia.Album, song *twedia.Song, tr trigger) {
+	session := playSession.Add(1)
+	activeSession = session
+	err := musicPlayer.Stop()
+	if err != nil {
+		slog.Error("Error stopping music player", "err", err)
+	}
+	go play(session, artist, album, song, tr)
+}
+
+// play plays the given song, or one chosen by the shuffle mode from the given album or artist
+// (or the whole catalog), followed by any requested songs, and carries on with random songs if
+// continuous playback is on. `tr` is what asked for the music. It returns early if another
+// session of music is started.
+func play(session int64, artist *twedia.Artist, album *twedia.Album, song *twedia.Song, tr trigger) {
+	defer func() {
+		sessionLock.Lock()
+		if activeSession == session {
+			activeSession = 0
+		}
+		sessionLock.Unlock()
+	}()
+	failures := 0
 	for {
 		resolvedArtist := artist
 		resolvedAlbum := album
 		resolvedSong := song
-		if resolvedArtist == nil {
-			// select a random artist, with probability adjusted proportionally to the number of songs by that artist (this finally solves the disproportionate frequency of 'The Tea Song' and 'Blessed Are The Teamakers')
-			r := rand.Intn(artists.TotalSongs)
-			for _, a := range artists.Artists {
-				if r < a.TotalSongs {
-					resolvedArtist = &a
-					break
+		source, requester := tr.Source, tr.User
+		if resolvedSong == nil {
+			// viewers' requests take priority over random selection
+			for q, ok := dequeue(); ok; q, ok = dequeue() {
+				if vodSafeBlocks(&q.Artist, &q.Album, &q.Song) {
+					slog.Warn("Skipping a requested song which is not VOD-safe", "song", q.Song.Title, "artist", q.Artist.Artist, "user", q.User)
+					continue
 				}
-				r -= a.TotalSongs
+				resolvedArtist, resolvedAlbum, resolvedSong = &q.Artist, &q.Album, &q.Song
+				source, requester = "request", q.User
+				break
 			}
 		}
-
-		if resolvedAlbum == nil {
-			// now select a random album by that artist
-			r := rand.Intn(resolvedArtist.TotalSongs)
-			for _, al := range resolvedArtist.Albums {
-				if r < al.TotalSongs {
-					resolvedAlbum = &al
-					break
-				}
-				r -= al.TotalSongs
-			}
+		if resolvedArtist == nil {
+			source, requester = "random", ""
 		}
-
 		if resolvedSong == nil {
-			// and a random song from that album
-			resolvedSong = &resolvedAlbum.Songs[rand.Intn(len(resolvedAlbum.Songs))]
+			ref, ok := nextSong(resolvedArtist, resolvedAlbum)
+			if !ok {
+				slog.Error("There are no songs to choose from")
+				return
+			}
+			resolvedArtist, resolvedAlbum, resolvedSong = ref.artist, ref.album, ref.song
 		}
 
-		err := playTrack(*resolvedArtist, *resolvedAlbum, *resolvedSong)
+		err := playTrack(*resolvedArtist, *resolvedAlbum, *resolvedSong, source, requester)
+		if playSession.Load() != session {
+			return
+		}
 		if err != nil {
-			log.Println(err)
-			continue
+			slog.Error("Error playing song", "err", err)
+			d := trackData(*resolvedArtist, *resolvedAlbum, *resolvedSong)
+			d.User = requester
+			d.Error = err.Error()
+			sendMessage("error", d, "")
+			failures++
+			if failures >= maxPlayFailures {
+				slog.Error("Stopping music after too many songs could not be played", "failures", failures)
+				return
+			}
+			if song == nil {
+				// try another song instead
+				continue
+			}
+		} else {
+			failures = 0
 		}
-		if !musicPlayer.ContinuingPlayback {
-			break
+		// the song asked for has been played, so carry on with requests and random songs
+		song = nil
+		if endSession(session) {
+			return
 		}
 	}
 }
 
+// endSession ends the session of music if it has nothing more to play, and reports whether it
+// has, so that ensurePlaying cannot miss a request queued just as the session ends.
+func endSession(session int64) bool {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	if musicPlayer.Continuing() || queueLength() > 0 {
+		return false
+	}
+	if activeSession == session {
+		activeSession = 0
+	}
+	return true
+}
+
 func stopPlayback() {
-	musicPlayer.ContinuingPlayback = false
+	sessionLock.Lock()
+	playSession.Add(1)
+	activeSession = 0
+	sessionLock.Unlock()
+	musicPlayer.SetContinuing(false)
 	err := musicPlayer.Stop()
 	if err != nil {
-		log.Println("Error stopping music player:", err)
+		slog.Error("Error stopping music player", "err", err)
 	}
 	err = speechPlayer.Stop()
 	if err != nil {
-		log.Println("Error stopping speech player:", err)
+		slog.Error("Error stopping speech player", "err", err)
 	}
-	os.Create(config.MusicFile)
 }
 
 func rewardCallback(r twitch.Redemption) {
-	for _, rewardAction := range config.PointRewards {
+	for _, rewardAction := range pointRewards() {
 		if strings.EqualFold(r.Reward.Title, rewardAction.Title) {
-			completeSoundAction(rewardAction.Sound)
-			if rewardAction.VTubeState != "" {
-				v.SetState(rewardAction.VTubeState)
-			}
+			recordActivity(activity{
+				Time:   time.Now(),
+				Source: "reward",
+				User:   r.User.DisplayName,
+				Name:   rewardAction.Title,
+				Input:  r.UserInput,
+			})
+			startPipeline("reward:"+rewardAction.Title, pipeline(rewardAction.Sound, rewardAction.VTubeState, rewardAction.Actions), trigger{
+				Source: "reward",
+				User:   r.User.Login,
+				Input:  r.UserInput,
+			})
 			return
 		}
 	}
 }
 
-func completeSoundAction(a soundAction) {
+func completeSoundAction(a soundAction, tr trigger) {
 	switch a.Type {
 	case "start", "select", "song":
 		var artist *twedia.Artist = nil
@@ -314,7 +565,7 @@ func completeSoundAction(a soundAction) {
 		var song *twedia.Song = nil
 
 		if a.Artist != "" {
-			for _, ar := range artists.Artists {
+			for _, ar := range music().Artists {
 				if strings.EqualFold(ar.Artist, a.Artist) {
 					artist = &ar
 					break
@@ -340,20 +591,31 @@ func completeSoundAction(a soundAction) {
 			}
 		}
 
-		err := musicPlayer.Stop()
-		if err != nil {
-			log.Println("Error stopping music player:", err)
+		if song != nil && tr.Source != "console" && vodSafeBlocks(artist, album, song) {
+			slog.Warn("Not playing a song which is not VOD-safe", "song", song.Title, "artist", artist.Artist, "user", tr.User)
+			return
 		}
-		musicPlayer.ContinuingPlayback = a.Type == "start"
-		go play(artist, album, song)
+
+		if a.Type == "start" {
+			err := setStationMode(a.Mode)
+			if err != nil {
+				slog.Error("Error changing shuffle mode", "err", err)
+			}
+		}
+		musicPlayer.SetContinuing(a.Type == "start")
+		startPlaying(artist, album, song, tr)
 	case "tts":
-		lastSpeech = time.Now()
+		startSpeechCooldown()
 
-		fn := "tts/" + hashString(a.Text) + ".mp3"
+		fn := ttsFile(a.Text)
 
 		if !exists(fn) {
 			// write spoken speech to file
-			twedia.SynthesiseText(a.Text, fn)
+			err := twedia.SynthesiseText(a.Text, fn)
+			if err != nil {
+				slog.Error("Error synthesising speech", "err", err)
+				return
+			}
 		}
 
 		// lower the music volume while the TTS occurs...
@@ -361,7 +623,7 @@ func completeSoundAction(a soundAction) {
 
 		err := speechPlayer.PlayFile(fn)
 		if err != nil {
-			log.Println("Error playing synthesised speech:", err)
+			slog.Error("Error playing synthesised speech", "err", err)
 		}
 
 		// and raise it again!
@@ -369,77 +631,166 @@ func completeSoundAction(a soundAction) {
 	}
 }
 
-func main() {
+// runBot runs twedia: it connects to Twitch chat and PubSub and plays music until told to quit.
+func runBot(args []string) error {
+	fs := newFlagSet("run")
+	fs.BoolVar(&daemon, "daemon", false, "run without the interactive console, taking commands over the control socket instead")
+	plain := fs.Bool("plain", false, "use a line-based console rather than the full-screen terminal UI")
+	err := parseFlags(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	err = startup()
+	if err != nil {
+		return err
+	}
+
+	quit := make(chan bool, 1)
+	stopControl, err := serveControlSocket(controlSocketPath(), quit)
+	if errors.Is(err, errAlreadyRunning) {
+		return err
+	} else if err != nil {
+		slog.Error("Error starting control socket", "err", err)
+	}
+
 	r := make(chan bool)
 
 	// Set up Twitch bot
-	t = tirc.NewClient(config.Username, "oauth:"+config.OauthToken)
-
-	t.OnNewMessage(func(c string, u tirc.User, m tirc.Message) {
-		if time.Since(lastSpeech) > (5 * time.Minute) {
-			for _, chatCommand := range config.ChatCommands {
-				if strings.EqualFold(strings.Split(m.Text, " ")[0], chatCommand.Trigger) {
-					completeSoundAction(chatCommand.Sound)
-					if chatCommand.VTubeState != "" {
-						v.SetState(chatCommand.VTubeState)
+	t = tirc.NewClient(config.Username, "oauth:"+creds.OauthToken.Reveal())
+
+	t.OnPrivateMessage(func(m tirc.PrivateMessage) {
+		word, input, _ := strings.Cut(m.Message, " ")
+		for _, chatCommand := range chatCommands() {
+			if strings.EqualFold(word, chatCommand.Trigger) {
+				recordActivity(activity{
+					Time:   time.Now(),
+					Source: "chat",
+					User:   m.User.DisplayName,
+					Name:   chatCommand.Trigger,
+					Input:  input,
+				})
+				if remaining, tell := speechCooldownRemaining(m.User.Name); remaining > 0 {
+					if tell {
+						sendMessage("cooldown", messageData{
+							User:      m.User.DisplayName,
+							Input:     input,
+							Remaining: clockTime(remaining),
+						}, m.ID)
 					}
 					return
 				}
+				startPipeline("chat:"+strings.ToLower(chatCommand.Trigger), pipeline(chatCommand.Sound, chatCommand.VTubeState, chatCommand.Actions), trigger{
+					Source:    "chat",
+					User:      m.User.Name,
+					Input:     input,
+					MessageID: m.ID,
+				})
+				return
 			}
 		}
 	})
 
 	t.Join(config.Channel)
 
+	go sendChatMessages(config.ChatRateLimit)
+	go watchConfig(configFile)
+
 	t.OnConnect(func() {
-		log.Println("Connected to Twitch chat as " + config.Username)
+		slog.Info("Connected to Twitch chat as " + config.Username)
+		chatConnected.Store(true)
 		r <- true
 	})
 
+	connErr := make(chan error, 1)
 	go func() {
-		err := t.Connect()
-		if err != nil {
-			panic(err)
-		}
+		connErr <- t.Connect()
 	}()
 
-	<-r
+	select {
+	case <-r:
+	case err := <-connErr:
+		return fmt.Errorf("unable to connect to Twitch chat: %w", err)
+	}
 
-	go twitch.ListenChannelPoints(channelID, config.ClientID, config.PubsubOauthToken, rewardCallback)
+	go twitch.ListenChannelPoints(channelID, pubsubToken(), authorise, rewardCallback)
 
-main:
+	if config.CatalogRefresh > 0 {
+		go func() {
+			for range time.Tick(time.Duration(config.CatalogRefresh) * time.Minute) {
+				changed, err := refreshCatalog()
+				if err != nil {
+					slog.Warn("Unable to refresh the music catalog", "err", err)
+				} else if changed {
+					slog.Info("Music catalog updated")
+				}
+			}
+		}()
+	}
+
+	if !daemon && !*plain && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) {
+		go func() {
+			err := runTUI()
+			if err != nil {
+				slog.Error("Error running terminal UI", "err", err)
+			}
+			requestQuit(quit)
+		}()
+	} else if config.Output.toStdout() {
+		slog.Info("Audio is written to standard output, so the console is disabled; twedia can be controlled with `twedia ctl`.")
+	} else if !daemon {
+		fmt.Println("Twedia Music Manager\n\n" + controlHelp(true))
+		go console(quit)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case <-quit:
+	case sig := <-signals:
+		slog.Info("Received " + sig.String() + " - shutting down")
+	}
+
+	stopTUI()
+	stopPlayback()
+	// clear the now playing outputs here, as the process may exit before the music's goroutine does
+	stopNowPlaying()
+	stopStream()
+	stopArt()
+	err = twedia.CloseOutput()
+	if err != nil {
+		slog.Error("Error closing audio output", "err", err)
+	}
+	if stopControl != nil {
+		stopControl()
+	}
+	return nil
+}
+
+// console reads commands from the terminal until the user quits.
+func console(quit chan<- bool) {
+	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("> ")
 
-		var opt string
-		var err error
-		for {
-			reader := bufio.NewReader(os.Stdin)
-			opt, err = reader.ReadString('\n')
-			if err == nil {
-				break
-			}
+		opt, err := reader.ReadString('\n')
+		if err != nil {
+			slog.Info("Console closed; twedia can still be controlled with `twedia ctl`.")
+			return
 		}
-		opt = strings.ToLower(strings.Replace(strings.Replace(opt, "\n", "", -1), "\r", "", -1))
-		switch opt {
+		opt = strings.TrimSpace(opt)
+		switch strings.ToLower(opt) {
 		case "start", "select":
-			artist, album, song := twedia.SelectSong(&artists)
-			musicPlayer.ContinuingPlayback = opt == "start"
-			go play(artist, album, song)
-		case "pause":
-			musicPlayer.TogglePause()
-		case "skip":
-			err = musicPlayer.Skip()
-			if err != nil {
-				log.Println("Error skipping song:", err)
+			artist, album, song := twedia.SelectSong(music())
+			musicPlayer.SetContinuing(strings.EqualFold(opt, "start"))
+			startPlaying(artist, album, song, trigger{Source: "console"})
+		case "help", "":
+			fmt.Println(controlHelp(true))
+		default:
+			if runCommand(opt, os.Stdout) {
+				requestQuit(quit)
+				return
 			}
-		case "stop":
-			stopPlayback()
-		case "quit":
-			break main
 		}
 	}
-
-	stopPlayback()
-	os.Exit(0)
 }
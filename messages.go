@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// messageTemplates holds the Go text/template source for each message twedia sends to chat.
+// Any template left empty uses the default; a template of "-" disables the message.
+type messageTemplates struct {
+	NowPlaying      string `json:"nowPlaying,omitempty"`
+	RequestAccepted string `json:"requestAccepted,omitempty"`
+	RequestRejected string `json:"requestRejected,omitempty"`
+	Cooldown        string `json:"cooldown,omitempty"`
+	Error           string `json:"error,omitempty"`
+	History         string `json:"history,omitempty"`
+	LastSong        string `json:"lastSong,omitempty"`
+	CurrentSong     string `json:"currentSong,omitempty"`
+	UpNext          string `json:"upNext,omitempty"`
+}
+
+// messageData is the data available to message templates.
+type messageData struct {
+	Song   string
+	Artist string
+	Album  string
+	// The best link to the song, and the name of the site it is on, e.g. "YouTube", if known.
+	URL  string
+	Site string
+	// All of the song's links, by site.
+	Links     map[string]string
+	Track     int
+	Composer  string
+	Featuring string
+	License   string
+	// The attribution the song's licence asks for, if it has one.
+	Credit string
+	User   string
+	// The text supplied alongside the trigger, e.g. the requested song.
+	Input string
+	// Position of a requested song in the queue, starting at 1.
+	Position int
+	// Time remaining on a cooldown, or of the current song.
+	Remaining clockTime
+	Error     string
+	// How far through the current song playback is, and the song's length.
+	Elapsed clockTime
+	Length  clockTime
+	// Recently played songs, most recent first.
+	History []historyEntry
+	// The songs coming up next.
+	Upcoming []upcomingEntry
+}
+
+// clockTime is a length of time which templates show as m:ss, e.g. 3:07.
+type clockTime time.Duration
+
+func (c clockTime) String() string {
+	return formatDuration(time.Duration(c))
+}
+
+// chatMessage is a message waiting to be sent to chat; if `ReplyTo` is a message ID, it is sent as a reply to that message.
+type chatMessage struct {
+	Text    string
+	ReplyTo string
+}
+
+const chatRateWindow = 30 * time.Second
+
+var defaultMessages = messageTemplates{
+	NowPlaying:      "Playing {{.Song}} by {{.Artist}}{{with .Featuring}} feat. {{.}}{{end}}.{{if .URL}} Listen{{with .Site}} on {{.}}{{end}}: {{.URL}}{{end}}{{with .Credit}} {{.}}{{end}}",
+	RequestAccepted: "@{{.User}} {{.Song}} by {{.Artist}} has been added to the queue at position {{.Position}}.",
+	RequestRejected: "@{{.User}} Sorry, I couldn't queue '{{.Input}}': {{.Error}}.",
+	Cooldown:        "@{{.User}} That command is on cooldown for another {{.Remaining}}.",
+	Error:           "Something went wrong: {{.Error}}",
+	History:         "@{{.User}} Recently played: {{range $i, $s := .History}}{{if $i}}, {{end}}{{$s.Song}} by {{$s.Artist}}{{else}}nothing yet{{end}}.",
+	LastSong:        "@{{.User}} {{if .Song}}The last song was {{.Song}} by {{.Artist}}.{{if .URL}} {{.URL}}{{end}}{{else}}Nothing has been played yet.{{end}}",
+	CurrentSong:     "@{{.User}} {{if .Song}}Now playing {{.Song}} by {{.Artist}}, {{.Elapsed}} of {{.Length}}.{{if .URL}} {{.URL}}{{end}}{{else}}No music is playing.{{end}}",
+	UpNext:          "@{{.User}} Coming up: {{range $i, $s := .Upcoming}}{{if $i}}, {{end}}{{$s.Song}} by {{$s.Artist}}{{if $s.User}} (requested by {{$s.User}}){{end}}{{else}}nothing yet{{end}}.",
+}
+
+var messages map[string]*template.Template
+var chatQueue = make(chan chatMessage, 100)
+
+// compileMessages parses the configured message templates, falling back to the defaults for any which are unset.
+func compileMessages(m messageTemplates) error {
+	sources := map[string][2]string{
+		"nowPlaying":      {m.NowPlaying, defaultMessages.NowPlaying},
+		"requestAccepted": {m.RequestAccepted, defaultMessages.RequestAccepted},
+		"requestRejected": {m.RequestRejected, defaultMessages.RequestRejected},
+		"cooldown":        {m.Cooldown, defaultMessages.Cooldown},
+		"error":           {m.Error, defaultMessages.Error},
+		"history":         {m.History, defaultMessages.History},
+		"lastSong":        {m.LastSong, defaultMessages.LastSong},
+		"currentSong":     {m.CurrentSong, defaultMessages.CurrentSong},
+		"upNext":          {m.UpNext, defaultMessages.UpNext},
+	}
+
+	compiled := make(map[string]*template.Template)
+	for name, src := range sources {
+		s := src[0]
+		if s == "" {
+			s = src[1]
+		}
+		if s == "-" {
+			continue
+		}
+		tmpl, err := template.New(name).Parse(s)
+		if err != nil {
+			return err
+		}
+		compiled[name] = tmpl
+	}
+	messages = compiled
+	return nil
+}
+
+// trackData fills in the song details of a messageData.
+func trackData(artist twedia.Artist, album twedia.Album, song twedia.Song) messageData {
+	var d messageData
+	d.setTrack(&artist, &album, &song)
+	return d
+}
+
+// setTrack fills in the details of a song.
+func (d *messageData) setTrack(artist *twedia.Artist, album *twedia.Album, song *twedia.Song) {
+	d.Song, d.Artist, d.Album = song.Title, artist.Artist, album.Name
+	d.Site, d.URL = song.Link()
+	d.Links = song.Links
+	d.Track = song.Track
+	d.Composer = song.Composer
+	d.Featuring = strings.Join(song.Featuring, ", ")
+	d.License = twedia.SongLicense(album, song)
+	d.Credit = twedia.Credit(artist, album, song)
+}
+
+// nowPlayingData fills in the details of the song which is playing, if any.
+func nowPlayingData(d messageData) messageData {
+	if p, ok := nowPlaying(); ok {
+		d.setTrack(&p.Artist, &p.Album, &p.Song)
+		d.Elapsed = clockTime(musicPlayer.Position().Round(time.Second))
+		d.Length = clockTime(musicPlayer.Duration().Round(time.Second))
+		d.Remaining = d.Length - d.Elapsed
+	}
+	return d
+}
+
+func renderTemplate(tmpl *template.Template, d messageData) string {
+	buf := new(bytes.Buffer)
+	err := tmpl.Execute(buf, d)
+	if err != nil {
+		slog.Error("Error rendering message", "message", tmpl.Name(), "err", err)
+		return ""
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// sendMessage renders the named message template and sends it to chat, replying to `replyTo` if it is set.
+func sendMessage(name string, d messageData, replyTo string) {
+	tmpl, ok := messages[name]
+	if !ok {
+		return
+	}
+	say(renderTemplate(tmpl, d), replyTo)
+}
+
+// say queues a message to be sent to chat.
+func say(text, replyTo string) {
+	if text == "" {
+		return
+	}
+	select {
+	case chatQueue <- chatMessage{Text: text, ReplyTo: replyTo}:
+	default:
+		slog.Warn("Chat queue is full; dropping message", "message", text)
+	}
+}
+
+// sendChatMessages sends queued messages to chat, sending at most `limit` messages in any 30 second window.
+func sendChatMessages(limit int) {
+	throttleChat(chatQueue, limit, chatRateWindow, func(m chatMessage) {
+		if m.ReplyTo != "" {
+			t.Reply(config.Channel, m.ReplyTo, m.Text)
+		} else {
+			t.Say(config.Channel, m.Text)
+		}
+	})
+}
+
+// throttleChat passes the messages from `queue` to `send`, at most `limit` of them in any `window`.
+func throttleChat(queue <-chan chatMessage, limit int, window time.Duration, send func(chatMessage)) {
+	var sent []time.Time
+	for m := range queue {
+		for len(sent) > 0 && time.Since(sent[0]) > window {
+			sent = sent[1:]
+		}
+		if len(sent) >= limit {
+			time.Sleep(time.Until(sent[0].Add(window)))
+			sent = sent[1:]
+		}
+
+		send(m)
+		sent = append(sent, time.Now())
+	}
+}
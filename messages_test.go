@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestRenderTimes(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		d    messageData
+		want string
+	}{
+		{"{{.Elapsed}} of {{.Length}}", messageData{Elapsed: clockTime(67 * time.Second), Length: clockTime(3*time.Minute + 7*time.Second)}, "1:07 of 3:07"},
+		{"{{.Remaining}}", messageData{Remaining: clockTime(4*time.Minute + 32*time.Second + 600*time.Millisecond)}, "4:33"},
+		{"{{.Length}}", messageData{Length: clockTime(75 * time.Minute)}, "75:00"},
+		{"{{.Elapsed}}", messageData{}, "0:00"},
+	}
+	for _, tt := range tests {
+		tmpl := template.Must(template.New("test").Parse(tt.tmpl))
+		if got := renderTemplate(tmpl, tt.d); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestThrottleChat(t *testing.T) {
+	const window = 100 * time.Millisecond
+	tests := []struct {
+		name     string
+		limit    int
+		messages int
+		// how many windows must pass before the last message is sent
+		windows int
+	}{
+		{"under the limit", 3, 3, 0},
+		{"at the limit", 2, 3, 1},
+		{"well over the limit", 2, 5, 2},
+		{"one at a time", 1, 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := make(chan chatMessage, tt.messages)
+			for i := 0; i < tt.messages; i++ {
+				queue <- chatMessage{Text: strconv.Itoa(i)}
+			}
+			close(queue)
+			var sent []time.Time
+			var texts []string
+			start := time.Now()
+			throttleChat(queue, tt.limit, window, func(m chatMessage) {
+				sent = append(sent, time.Now())
+				texts = append(texts, m.Text)
+			})
+
+			if len(texts) != tt.messages || texts[0] != "0" || texts[len(texts)-1] != strconv.Itoa(tt.messages-1) {
+				t.Fatalf("sent %v", texts)
+			}
+			// no window holds more than `limit` messages
+			for i := tt.limit; i < len(sent); i++ {
+				if gap := sent[i].Sub(sent[i-tt.limit]); gap < window {
+					t.Errorf("messages %d and %d were sent %v apart", i-tt.limit, i, gap)
+				}
+			}
+			took := sent[len(sent)-1].Sub(start)
+			if took < time.Duration(tt.windows)*window || took > time.Duration(tt.windows+1)*window {
+				t.Errorf("the last message was sent after %v", took)
+			}
+		})
+	}
+}
+
+func TestSayDropsWhenFull(t *testing.T) {
+	old := chatQueue
+	chatQueue = make(chan chatMessage, 2)
+	t.Cleanup(func() { chatQueue = old })
+
+	say("", "")
+	say("one", "msg-1")
+	say("two", "")
+	say("three", "")
+	close(chatQueue)
+	var got []chatMessage
+	for m := range chatQueue {
+		got = append(got, m)
+	}
+	want := []chatMessage{{Text: "one", ReplyTo: "msg-1"}, {Text: "two"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %+v, want %+v", got, want)
+	}
+}
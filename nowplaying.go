@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// nowPlayingOutput is a file which shows the song which is playing, such as for an OBS text source.
+type nowPlayingOutput struct {
+	File string `json:"file" required:"true"`
+	// Go template for the file's contents while a song is playing, given the same details as chat
+	// messages; defaults to the song and artist.
+	Template string `json:"template,omitempty"`
+	// Go template for the file's contents between songs; defaults to an empty file.
+	Idle string `json:"idle,omitempty"`
+}
+
+const defaultNowPlayingTemplate = "\n{{.Song}}, by {{.Artist}}{{with .Credit}}\n{{.}}{{end}}"
+
+// nowPlayingFile is a now playing output, ready to be written.
+type nowPlayingFile struct {
+	file     string
+	playing  *template.Template
+	idle     *template.Template
+	last     string
+	written  bool
+	reported bool
+}
+
+var nowPlayingFiles struct {
+	sync.Mutex
+	files []*nowPlayingFile
+}
+
+// nowPlayingOutputs lists the now playing outputs in the config, including `musicFile`.
+func nowPlayingOutputs(c Config) []nowPlayingOutput {
+	var outputs []nowPlayingOutput
+	if c.MusicFile != "" {
+		outputs = append(outputs, nowPlayingOutput{File: c.MusicFile})
+	}
+	return append(outputs, c.NowPlaying...)
+}
+
+// compileNowPlaying parses the templates of the now playing outputs.
+func compileNowPlaying(outputs []nowPlayingOutput) ([]*nowPlayingFile, error) {
+	var files []*nowPlayingFile
+	for i, o := range outputs {
+		src := o.Template
+		if src == "" {
+			src = defaultNowPlayingTemplate
+		}
+		playing, err := template.New("template").Parse(src)
+		if err != nil {
+			return nil, errors.New("nowPlaying[" + strconv.Itoa(i) + "]: " + err.Error())
+		}
+		idle, err := template.New("idle").Parse(o.Idle)
+		if err != nil {
+			return nil, errors.New("nowPlaying[" + strconv.Itoa(i) + "]: " + err.Error())
+		}
+		files = append(files, &nowPlayingFile{file: o.File, playing: playing, idle: idle})
+	}
+	return files, nil
+}
+
+// startNowPlaying writes the now playing outputs, and keeps them up to date as songs play.
+func startNowPlaying(outputs []nowPlayingOutput) error {
+	files, err := compileNowPlaying(outputs)
+	if err != nil {
+		return err
+	}
+	nowPlayingFiles.Lock()
+	nowPlayingFiles.files = files
+	nowPlayingFiles.Unlock()
+
+	updateNowPlaying()
+	go func() {
+		// keep the elapsed and remaining time current
+		for range time.Tick(time.Second) {
+			updateNowPlaying()
+		}
+	}()
+	return nil
+}
+
+// updateNowPlaying renders the now playing outputs, and writes any which have changed.
+func updateNowPlaying() {
+	nowPlayingFiles.Lock()
+	defer nowPlayingFiles.Unlock()
+	if len(nowPlayingFiles.files) == 0 {
+		return
+	}
+
+	p, playing := nowPlaying()
+	d := messageData{User: p.User}
+	if playing {
+		d = nowPlayingData(d)
+	} else {
+		d.History = recentHistory(5)
+	}
+	d.Upcoming = upcomingTracks(lookahead())
+	for _, f := range nowPlayingFiles.files {
+		tmpl := f.idle
+		if playing {
+			tmpl = f.playing
+		}
+		// unlike chat messages, leading and trailing line breaks are kept
+		buf := new(bytes.Buffer)
+		err := tmpl.Execute(buf, d)
+		if err != nil {
+			if !f.reported {
+				slog.Error("Error rendering now playing output", "file", f.file, "err", err)
+				f.reported = true
+			}
+			continue
+		}
+		text := buf.String()
+		if f.written && text == f.last {
+			continue
+		}
+		err = writeFileAtomic(f.file, buf.Bytes(), 0644)
+		if err != nil {
+			if !f.reported {
+				slog.Error("Error writing now playing output", "file", f.file, "err", err)
+				f.reported = true
+			}
+			continue
+		}
+		f.last, f.written, f.reported = text, true, false
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// useNowPlaying writes the now playing outputs for the rest of the test.
+func useNowPlaying(t *testing.T, outputs []nowPlayingOutput) {
+	t.Helper()
+	files, err := compileNowPlaying(outputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nowPlayingFiles.Lock()
+	old := nowPlayingFiles.files
+	nowPlayingFiles.files = files
+	nowPlayingFiles.Unlock()
+	t.Cleanup(func() {
+		nowPlayingFiles.Lock()
+		nowPlayingFiles.files = old
+		nowPlayingFiles.Unlock()
+	})
+}
+
+func readFile(t *testing.T, fn string) string {
+	t.Helper()
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNowPlayingFiles(t *testing.T) {
+	useTestPlayer(t)
+	useTestCatalog(t, testMusic())
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "music.txt")
+	custom := filepath.Join(dir, "custom.txt")
+	useNowPlaying(t, nowPlayingOutputs(Config{
+		MusicFile: plain,
+		NowPlaying: []nowPlayingOutput{{
+			File:     custom,
+			Template: "{{.Song}} ({{.User}})\n",
+			Idle:     "Back soon{{range .History}}; last: {{.Song}}{{end}}",
+		}},
+	}))
+
+	updateNowPlaying()
+	if got := readFile(t, plain); got != "" {
+		t.Errorf("%q while idle with no idle template", got)
+	}
+	if got := readFile(t, custom); got != "Back soon" {
+		t.Errorf("%q while idle", got)
+	}
+
+	q := &queuedTrack{
+		Artist: twedia.Artist{Artist: "A"},
+		Album:  twedia.Album{Name: "B"},
+		Song:   twedia.Song{Title: "C", License: "CC0"},
+		User:   "viewer",
+	}
+	setNowPlaying(q)
+	// leading and trailing line breaks are kept
+	if got := readFile(t, plain); !strings.HasPrefix(got, "\nC, by A\n") {
+		t.Errorf("%q with the default template", got)
+	}
+	if got := readFile(t, custom); got != "C (viewer)\n" {
+		t.Errorf("%q with a template", got)
+	}
+
+	// stopping for good clears the outputs, even before the song's own clearNowPlaying
+	historyLock.Lock()
+	playHistory = append(playHistory, historyEntry{Artist: "A", Song: "C"})
+	historyLock.Unlock()
+	stopNowPlaying()
+	clearNowPlaying(q)
+	if _, ok := nowPlaying(); ok {
+		t.Error("still playing once stopped")
+	}
+	if got := readFile(t, plain); got != "" {
+		t.Errorf("%q once stopped", got)
+	}
+	if got := readFile(t, custom); got != "Back soon; last: C" {
+		t.Errorf("%q once stopped", got)
+	}
+}
+
+func TestCompileNowPlaying(t *testing.T) {
+	_, err := compileNowPlaying([]nowPlayingOutput{{File: "a"}, {File: "b", Idle: "{{.Song"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "nowPlaying[1]: ") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "out.txt")
+	for _, text := range []string{"first", "second, which is longer", ""} {
+		err := writeFileAtomic(fn, []byte(text), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, fn); got != text {
+			t.Errorf("read %q, want %q", got, text)
+		}
+	}
+	info, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0640 {
+		t.Errorf("mode is %v", perm)
+	}
+	// no temporary files are left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %v", entries)
+	}
+
+	if writeFileAtomic(filepath.Join(dir, "missing", "out.txt"), nil, 0644) == nil {
+		t.Error("wrote to a directory which does not exist")
+	}
+}
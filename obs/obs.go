@@ -0,0 +1,223 @@
+package obs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OBS WebSocket (v5) message opcodes; see
+// https://github.com/obsproject/obs-websocket/blob/master/docs/generated/protocol.md
+const (
+	opHello           = 0
+	opIdentify        = 1
+	opIdentified      = 2
+	opRequest         = 6
+	opRequestResponse = 7
+)
+
+type OBS struct {
+	Address    string
+	Connection *websocket.Conn
+
+	password string
+	mu       sync.Mutex
+	nextID   int
+	pending  map[string]chan requestStatus
+}
+
+type message struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+}
+
+type hello struct {
+	RPCVersion     int `json:"rpcVersion"`
+	Authentication *struct {
+		Challenge string `json:"challenge"`
+		Salt      string `json:"salt"`
+	} `json:"authentication"`
+}
+
+type identify struct {
+	RPCVersion     int    `json:"rpcVersion"`
+	Authentication string `json:"authentication,omitempty"`
+}
+
+type request struct {
+	RequestType string         `json:"requestType"`
+	RequestID   string         `json:"requestId"`
+	RequestData map[string]any `json:"requestData,omitempty"`
+}
+
+type requestResponse struct {
+	RequestID     string        `json:"requestId"`
+	RequestStatus requestStatus `json:"requestStatus"`
+}
+
+type requestStatus struct {
+	Result  bool   `json:"result"`
+	Code    int    `json:"code"`
+	Comment string `json:"comment"`
+}
+
+var l *slog.Logger = slog.Default()
+
+// SetLogger sets the logger to which the package's log messages are written.
+func SetLogger(logger *slog.Logger) {
+	l = logger
+}
+
+// New creates an OBS WebSocket client for the server at `address` (host:port),
+// authenticating with `password` if the server requires it.
+func New(address, password string) *OBS {
+	return &OBS{
+		Address:  address,
+		password: password,
+		pending:  make(map[string]chan requestStatus),
+	}
+}
+
+// Connect to the OBS WebSocket server and complete the identification handshake.
+func (o *OBS) Connect() error {
+	l.Info("Connecting to OBS", "address", o.Address)
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+o.Address, nil)
+	if err != nil {
+		return err
+	}
+
+	m := &message{}
+	err = c.ReadJSON(m)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if m.Op != opHello {
+		c.Close()
+		return errors.New("unexpected opcode " + strconv.Itoa(m.Op) + " in place of Hello")
+	}
+	h := &hello{}
+	json.Unmarshal(m.D, h)
+
+	id := identify{RPCVersion: 1}
+	if h.Authentication != nil {
+		id.Authentication = authResponse(o.password, h.Authentication.Salt, h.Authentication.Challenge)
+	}
+	d, _ := json.Marshal(id)
+	err = c.WriteJSON(message{Op: opIdentify, D: d})
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	err = c.ReadJSON(m)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if m.Op != opIdentified {
+		c.Close()
+		return errors.New("OBS did not accept identification")
+	}
+
+	o.mu.Lock()
+	o.Connection = c
+	o.mu.Unlock()
+	l.Info("Connected")
+
+	go o.listen()
+
+	return nil
+}
+
+// Connected reports whether there is an open connection to OBS.
+func (o *OBS) Connected() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.Connection != nil
+}
+
+// authResponse computes the authentication string described by the OBS WebSocket protocol.
+func authResponse(password, salt, challenge string) string {
+	secret := sha256.Sum256([]byte(password + salt))
+	b64Secret := base64.StdEncoding.EncodeToString(secret[:])
+	auth := sha256.Sum256([]byte(b64Secret + challenge))
+	return base64.StdEncoding.EncodeToString(auth[:])
+}
+
+func (o *OBS) listen() {
+	for {
+		m := &message{}
+		err := o.Connection.ReadJSON(m)
+		if err != nil {
+			l.Error("Lost connection to OBS", "err", err)
+			o.mu.Lock()
+			o.Connection = nil
+			for id, ch := range o.pending {
+				close(ch)
+				delete(o.pending, id)
+			}
+			o.mu.Unlock()
+			return
+		}
+		if m.Op != opRequestResponse {
+			continue
+		}
+		resp := &requestResponse{}
+		json.Unmarshal(m.D, resp)
+		o.mu.Lock()
+		ch, ok := o.pending[resp.RequestID]
+		delete(o.pending, resp.RequestID)
+		o.mu.Unlock()
+		if ok {
+			ch <- resp.RequestStatus
+		}
+	}
+}
+
+// Request sends an OBS WebSocket request of type `requestType` (for example
+// "SetCurrentProgramScene") with the given request data, and waits for OBS to respond.
+func (o *OBS) Request(requestType string, requestData map[string]any) error {
+	o.mu.Lock()
+	if o.Connection == nil {
+		o.mu.Unlock()
+		return errors.New("no connection")
+	}
+	o.nextID++
+	id := strconv.Itoa(o.nextID)
+	ch := make(chan requestStatus, 1)
+	o.pending[id] = ch
+	d, _ := json.Marshal(request{
+		RequestType: requestType,
+		RequestID:   id,
+		RequestData: requestData,
+	})
+	err := o.Connection.WriteJSON(message{Op: opRequest, D: d})
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case status, ok := <-ch:
+		if !ok {
+			return errors.New("connection closed")
+		}
+		if !status.Result {
+			return errors.New(requestType + " failed (" + strconv.Itoa(status.Code) + "): " + status.Comment)
+		}
+		return nil
+	case <-time.After(5 * time.Second):
+		o.mu.Lock()
+		delete(o.pending, id)
+		o.mu.Unlock()
+		return errors.New(requestType + " timed out")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// readPlaylist reads an M3U, PLS or XSPF playlist from a file or URL.
+func readPlaylist(name string) ([]twedia.PlaylistEntry, error) {
+	var data []byte
+	var err error
+	if twedia.IsRemote(name) {
+		var res *http.Response
+		res, err = (&http.Client{Timeout: 10 * time.Second}).Get(name)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.New("unable to fetch " + name + ": " + res.Status)
+		}
+		data, err = io.ReadAll(res.Body)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return twedia.ParsePlaylist(name, data)
+}
+
+// matchEntry finds the song in the catalog which a playlist entry refers to: first by its
+// location, then by where it is within the music directory, and then by its artist and title.
+func matchEntry(m *twedia.Music, e twedia.PlaylistEntry) (*twedia.Artist, *twedia.Album, *twedia.Song) {
+	for i := range m.Artists {
+		for j := range m.Artists[i].Albums {
+			for k, s := range m.Artists[i].Albums[j].Songs {
+				if s.Audio != "" && s.Audio == e.Location {
+					return &m.Artists[i], &m.Artists[i].Albums[j], &m.Artists[i].Albums[j].Songs[k]
+				}
+			}
+		}
+	}
+
+	if !twedia.IsRemote(e.Location) && config.MusicDir != "" {
+		rel, err := filepath.Rel(config.MusicDir, e.Location)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if err == nil && len(parts) == 3 && parts[0] != ".." {
+			artist, album, song := twedia.FindArtistSong(m, parts[0], twedia.TitleFromFile(parts[2]))
+			if song != nil {
+				return artist, album, song
+			}
+		}
+	}
+
+	if e.Title == "" {
+		return nil, nil, nil
+	}
+	return twedia.FindArtistSong(m, e.Artist, e.Title)
+}
+
+// queuePlaylist adds the songs in a playlist to the request queue, returning how many were
+// added, and the entries which are not in the catalog.
+func queuePlaylist(name string) (int, []twedia.PlaylistEntry, error) {
+	entries, err := readPlaylist(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	m := music()
+	added := 0
+	var unmatched []twedia.PlaylistEntry
+	for _, e := range entries {
+		artist, album, song := matchEntry(m, e)
+		if song == nil {
+			unmatched = append(unmatched, e)
+			continue
+		}
+		enqueue(queuedTrack{Artist: *artist, Album: *album, Song: *song})
+		added++
+	}
+	return added, unmatched, nil
+}
+
+// songEntry makes a playlist entry for a song, reporting false if its audio cannot be found.
+func songEntry(artist twedia.Artist, album twedia.Album, song twedia.Song) (twedia.PlaylistEntry, bool) {
+	loc, err := songFile(artist, album, song)
+	if err != nil {
+		return twedia.PlaylistEntry{}, false
+	}
+	if !twedia.IsRemote(loc) {
+		if abs, err := filepath.Abs(loc); err == nil {
+			loc = abs
+		}
+	}
+	return twedia.PlaylistEntry{Location: loc, Artist: artist.Artist, Album: album.Name, Title: song.Title}, true
+}
+
+// saveQueue writes the request queue to the M3U playlist `fn`, returning how many songs it holds.
+func saveQueue(fn string) (int, error) {
+	var entries []twedia.PlaylistEntry
+	for _, q := range queuedTracks() {
+		if e, ok := songEntry(q.Artist, q.Album, q.Song); ok {
+			entries = append(entries, e)
+		}
+	}
+	buf := new(bytes.Buffer)
+	err := twedia.WriteM3U(buf, entries)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), os.WriteFile(fn, buf.Bytes(), 0644)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+func TestMatchEntry(t *testing.T) {
+	m := testMusic()
+	m.Artists[1].Albums[0].Songs[1].Audio = "http://nas/b2.flac"
+	old := config.MusicDir
+	config.MusicDir = filepath.FromSlash("/music")
+	t.Cleanup(func() { config.MusicDir = old })
+
+	tests := []struct {
+		name string
+		e    twedia.PlaylistEntry
+		want string
+	}{
+		{"by location", twedia.PlaylistEntry{Location: "http://nas/b2.flac", Title: "a1"}, "b2"},
+		{"in the music directory", twedia.PlaylistEntry{Location: filepath.FromSlash("/music/A/A1/02 - a2.mp3")}, "a2"},
+		{"outside the music directory", twedia.PlaylistEntry{Location: filepath.FromSlash("/elsewhere/A/A1/a2.mp3")}, ""},
+		{"by artist and title", twedia.PlaylistEntry{Location: "/elsewhere/x.mp3", Artist: "b", Title: "b1"}, "b1"},
+		{"by title alone", twedia.PlaylistEntry{Location: "/elsewhere/x.mp3", Title: "A4"}, "a4"},
+		{"by the wrong artist", twedia.PlaylistEntry{Location: "/elsewhere/x.mp3", Artist: "A", Title: "b1"}, ""},
+		{"not in the catalog", twedia.PlaylistEntry{Location: "http://nas/c.flac"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, song := matchEntry(m, tt.e)
+			got := ""
+			if song != nil {
+				got = song.Title
+			}
+			if got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
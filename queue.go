@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// queuedTrack is a song requested by a viewer, waiting to be played.
+type queuedTrack struct {
+	Artist twedia.Artist
+	Album  twedia.Album
+	Song   twedia.Song
+	User   string
+}
+
+var requestQueue []queuedTrack
+var queueLock sync.Mutex
+
+// enqueue adds a track to the end of the request queue, and returns its position (starting at 1).
+func enqueue(q queuedTrack) int {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	requestQueue = append(requestQueue, q)
+	return len(requestQueue)
+}
+
+// dequeue removes and returns the track at the front of the request queue, if there is one.
+func dequeue() (queuedTrack, bool) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	if len(requestQueue) == 0 {
+		return queuedTrack{}, false
+	}
+	q := requestQueue[0]
+	requestQueue = requestQueue[1:]
+	return q, true
+}
+
+// queuedTracks returns a copy of the request queue.
+func queuedTracks() []queuedTrack {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	return append([]queuedTrack(nil), requestQueue...)
+}
+
+func queueLength() int {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	return len(requestQueue)
+}
+
+// isQueued reports whether the song is already waiting in the request queue.
+func isQueued(artist twedia.Artist, song twedia.Song) bool {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	for _, q := range requestQueue {
+		if strings.EqualFold(q.Artist.Artist, artist.Artist) && strings.EqualFold(q.Song.Title, song.Title) {
+			return true
+		}
+	}
+	return false
+}
+
+var current *queuedTrack
+
+// Held while the track playing changes, so that the outputs which show it are updated in order.
+var nowPlayingLock sync.Mutex
+
+func setNowPlaying(q *queuedTrack) {
+	nowPlayingLock.Lock()
+	defer nowPlayingLock.Unlock()
+	queueLock.Lock()
+	current = q
+	queueLock.Unlock()
+	showNowPlaying(q)
+}
+
+// clearNowPlaying marks nothing as playing, unless `q` has already been replaced by another track.
+func clearNowPlaying(q *queuedTrack) {
+	nowPlayingLock.Lock()
+	defer nowPlayingLock.Unlock()
+	queueLock.Lock()
+	if current != q {
+		queueLock.Unlock()
+		return
+	}
+	current = nil
+	queueLock.Unlock()
+	showNowPlaying(nil)
+}
+
+// stopNowPlaying marks nothing as playing, whichever track was, once music has stopped for good.
+func stopNowPlaying() {
+	nowPlayingLock.Lock()
+	defer nowPlayingLock.Unlock()
+	queueLock.Lock()
+	current = nil
+	queueLock.Unlock()
+	showNowPlaying(nil)
+}
+
+// showNowPlaying updates the stream title, cover art and now playing files for `q`.
+func showNowPlaying(q *queuedTrack) {
+	setStreamTitle(q)
+	updateArt(q)
+	updateNowPlaying()
+}
+
+// nowPlaying returns the track which is currently playing, if there is one.
+func nowPlaying() (queuedTrack, bool) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	if current == nil {
+		return queuedTrack{}, false
+	}
+	return *current, true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+func TestClearNowPlaying(t *testing.T) {
+	first := &queuedTrack{Song: twedia.Song{Title: "first"}}
+	second := &queuedTrack{Song: twedia.Song{Title: "second"}}
+	setNowPlaying(first)
+	setNowPlaying(second)
+
+	// the first song ending does not clear the song which replaced it
+	clearNowPlaying(first)
+	if p, ok := nowPlaying(); !ok || p.Song.Title != "second" {
+		t.Errorf("now playing %v, %v", p.Song.Title, ok)
+	}
+	clearNowPlaying(second)
+	if _, ok := nowPlaying(); ok {
+		t.Error("still playing once cleared")
+	}
+}
+
+func TestEnsurePlaying(t *testing.T) {
+	useTestPlayer(t)
+	fn := filepath.Join(t.TempDir(), "song.wav")
+	writeWAV(t, fn, 800)
+	useTestCatalog(t, &twedia.Music{Artists: []twedia.Artist{{Artist: "A", Albums: []twedia.Album{
+		{Name: "B", Songs: []twedia.Song{{Title: "C", Audio: fn}}},
+	}}}})
+	musicPlayer.SetContinuing(false)
+
+	before := playSession.Load()
+	ensurePlaying(trigger{Source: "console"})
+	ensurePlaying(trigger{Source: "console"})
+	if n := playSession.Load() - before; n != 1 {
+		t.Errorf("%d sessions of music were started", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sessionLock.Lock()
+		active := activeSession
+		sessionLock.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the session did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h := recentHistory(5); len(h) != 1 {
+		t.Errorf("played %v", h)
+	}
+}
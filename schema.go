@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var configType = reflect.TypeOf(Config{})
+
+// validateConfigTree checks that the document matches the structure of type `t`: every key
+// must correspond to a field, every value must have a suitable type, and every field tagged
+// `required:"true"` must be present. Problems are reported along with where they occur.
+func validateConfigTree(n *configNode, t reflect.Type) []error {
+	return validateNode(n, t, "")
+}
+
+func validationError(n *configNode, path, msg string) error {
+	if n.Pos.Line == 0 && path != "" {
+		// without a line number, say which key is at fault instead
+		return errors.New(n.Pos.String() + ": " + path + ": " + msg)
+	}
+	return errors.New(n.Pos.String() + ": " + msg)
+}
+
+func validateNode(n *configNode, t reflect.Type, path string) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if n.Object == nil && !n.IsList && n.Value == nil {
+		// null is acceptable for any type
+		return nil
+	}
+
+	var errs []error
+	switch t.Kind() {
+	case reflect.Interface:
+	case reflect.Struct:
+		if n.Object == nil {
+			return []error{validationError(n, path, "expected an object")}
+		}
+		fields := jsonFields(t)
+		seen := make(map[string]bool)
+		for _, e := range n.Object {
+			var field *reflect.StructField
+			for name, f := range fields {
+				// encoding/json matches keys case-insensitively
+				if strings.EqualFold(name, e.Key) {
+					field = &f
+					seen[name] = true
+					break
+				}
+			}
+			if field == nil {
+				errs = append(errs, validationError(&configNode{Pos: e.Pos}, path, "unknown key '"+e.Key+"' in "+typeName(t)))
+				continue
+			}
+			errs = append(errs, validateNode(e.Value, field.Type, keyPath(path, e.Key))...)
+		}
+
+		var missing []string
+		for name, f := range fields {
+			if f.Tag.Get("required") == "true" && !seen[name] {
+				missing = append(missing, "'"+name+"'")
+			}
+		}
+		sort.Strings(missing)
+		if len(missing) > 0 {
+			errs = append(errs, validationError(n, path, typeName(t)+" is missing required key(s) "+strings.Join(missing, ", ")))
+		}
+	case reflect.Map:
+		if n.Object == nil {
+			return []error{validationError(n, path, "expected an object")}
+		}
+		for _, e := range n.Object {
+			errs = append(errs, validateNode(e.Value, t.Elem(), keyPath(path, e.Key))...)
+		}
+	case reflect.Slice, reflect.Array:
+		if !n.IsList {
+			return []error{validationError(n, path, "expected a list")}
+		}
+		for i, item := range n.Items {
+			errs = append(errs, validateNode(item, t.Elem(), keyPath(path, i))...)
+		}
+	case reflect.String:
+		if _, ok := n.Value.(string); !ok {
+			errs = append(errs, validationError(n, path, "expected a string"))
+		}
+	case reflect.Bool:
+		if _, ok := n.Value.(bool); !ok {
+			errs = append(errs, validationError(n, path, "expected true or false"))
+		}
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		if _, ok := n.Value.(float64); !ok {
+			errs = append(errs, validationError(n, path, "expected a number"))
+		}
+	}
+	return errs
+}
+
+// jsonFields maps the JSON keys of a struct type to the corresponding fields.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func typeName(t reflect.Type) string {
+	switch t {
+	case configType:
+		return "config"
+	case reflect.TypeOf(action{}):
+		return "action"
+	}
+	return t.Name()
+}
+
+// configSchema generates a JSON Schema (draft 2020-12) describing the config file.
+func configSchema() map[string]any {
+	s := schemaFor(configType)
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "twedia config"
+	return s
+}
+
+func schemaFor(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		props := make(map[string]any)
+		var required []string
+		for name, f := range jsonFields(t) {
+			props[name] = schemaFor(f.Type)
+			if f.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+		}
+		if t == reflect.TypeOf(action{}) {
+			var types []string
+			for k := range actionHandlers {
+				types = append(types, k)
+			}
+			sort.Strings(types)
+			props["type"].(map[string]any)["enum"] = types
+			// actions nest recursively, so refer back to the definition rather than expanding it forever
+			props["actions"] = map[string]any{"type": "array", "items": map[string]any{"$ref": "#/$defs/action"}}
+		}
+		s := map[string]any{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			sort.Strings(required)
+			s["required"] = required
+		}
+		if t == configType {
+			s["$defs"] = map[string]any{"action": schemaFor(reflect.TypeOf(action{}))}
+		}
+		return s
+	case reflect.Slice, reflect.Array:
+		items := map[string]any{"$ref": "#/$defs/action"}
+		if t.Elem() != reflect.TypeOf(action{}) {
+			items = schemaFor(t.Elem())
+		}
+		return map[string]any{"type": "array", "items": items}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	// interface types may hold anything
+	return map[string]any{}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type schemaTestConfig struct {
+	Name    string            `json:"name" required:"true"`
+	Enabled bool              `json:"enabled,omitempty"`
+	Count   int               `json:"count,omitempty"`
+	Tags    []string          `json:"tags,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Nested  *schemaTestNested `json:"nested,omitempty"`
+	Any     any               `json:"any,omitempty"`
+}
+
+type schemaTestNested struct {
+	Level float64 `json:"level" required:"true"`
+}
+
+func TestValidateNode(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		// Substrings expected in the errors, in order; none means the document is valid.
+		want []string
+	}{
+		{"valid", `{"name": "a", "enabled": true, "count": 2, "tags": ["x"], "labels": {"k": "v"}, "nested": {"level": 1.5}, "any": [1, "b"]}`, nil},
+		{"keys are case insensitive", `{"NAME": "a"}`, nil},
+		{"null is allowed", `{"name": "a", "nested": null, "tags": null}`, nil},
+		{"missing required key", `{"enabled": true}`, []string{"line 1, column 1: schemaTestConfig is missing required key(s) 'name'"}},
+		{"unknown key", `{"name": "a",
+  "colour": "red"}`, []string{"line 2, column 3: unknown key 'colour' in schemaTestConfig"}},
+		{"wrong scalar types", `{"name": 1, "enabled": "yes", "count": "two"}`, []string{
+			"column 10: expected a string",
+			"column 24: expected true or false",
+			"column 40: expected a number",
+		}},
+		{"list expected", `{"name": "a", "tags": "x"}`, []string{"expected a list"}},
+		{"object expected", `{"name": "a", "labels": []}`, []string{"expected an object"}},
+		{"list items", `{"name": "a", "tags": ["x", 2]}`, []string{"column 29: expected a string"}},
+		{"map values", `{"name": "a", "labels": {"k": false}}`, []string{"expected a string"}},
+		{"nested", `{"name": "a", "nested": {"level": "high", "depth": 2}}`, []string{
+			"expected a number",
+			"unknown key 'depth' in schemaTestNested",
+		}},
+		{"nested required", `{"name": "a", "nested": {}}`, []string{"schemaTestNested is missing required key(s) 'level'"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := parseJSON("test.json", []byte(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs := validateConfigTree(n, reflect.TypeOf(schemaTestConfig{}))
+			if len(errs) != len(tt.want) {
+				t.Fatalf("got errors %v, want %d", errs, len(tt.want))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.want[i]) {
+					t.Errorf("error %d is %q, want it to contain %q", i, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidationErrorWithoutLines(t *testing.T) {
+	// formats without positions name the key at fault instead
+	n := &configNode{Pos: position{File: "test.toml"}}
+	err := validationError(n, "stream.port", "expected a number")
+	if err.Error() != "test.toml: stream.port: expected a number" {
+		t.Errorf("got %q", err)
+	}
+}
+
+func TestConfigTypeValidates(t *testing.T) {
+	n, err := parseJSON("config.json", []byte(`{
+	"username": "bot", "channel": "c", "clientID": "id", "musicDir": "m", "oauthToken": "t", "musicCollectionURL": "u",
+	"chatCommands": [{"trigger": "!a", "actions": [{"type": "say", "text": "hi", "actions": [{"type": "wait", "duration": 1}]}]}]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := validateConfigTree(n, configType)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "line 3") || !strings.Contains(errs[0].Error(), "expected a string") {
+		t.Errorf("got %v", errors.Join(errs...))
+	}
+}
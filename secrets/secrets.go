@@ -0,0 +1,216 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zalando/go-keyring"
+)
+
+// Service is the name under which secrets are stored in the OS keyring.
+const Service = "twedia"
+
+// Secret is a sensitive string, such as an OAuth token, which is redacted whenever it is printed or logged.
+// Use `Reveal` to obtain the underlying value.
+type Secret string
+
+const redacted = "[REDACTED]"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Reveal returns the secret's actual value.
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// backend is a place in which secrets may be kept.
+type backend interface {
+	get(name string) (Secret, error)
+	set(name string, value Secret) error
+}
+
+// Store resolves references to secrets, of the form "env:NAME", "file:NAME" or "keyring:NAME",
+// and saves new secrets to the preferred backend.
+type Store struct {
+	backends map[string]backend
+	// Scheme of the backend to which new secrets are saved.
+	preferred string
+}
+
+var l *slog.Logger = slog.Default()
+
+// SetLogger sets the logger to which the package's log messages are written.
+func SetLogger(logger *slog.Logger) {
+	l = logger
+}
+
+// Open creates a Store which keeps secrets in the 0600-permission JSON file at `path`, and in
+// the OS keyring (via the Secret Service D-Bus API on Linux) if `useKeyring` is set. If the
+// keyring cannot be reached, secrets are saved to the file instead.
+func Open(path string, useKeyring bool) *Store {
+	s := &Store{
+		backends: map[string]backend{
+			"env":  envBackend{},
+			"file": &fileBackend{path: path},
+		},
+		preferred: "file",
+	}
+	if useKeyring {
+		_, err := keyring.Get(Service, "twedia-probe")
+		if err == nil || errors.Is(err, keyring.ErrNotFound) {
+			s.backends["keyring"] = keyringBackend{}
+			s.preferred = "keyring"
+		} else {
+			l.Warn("OS keyring is unavailable, so secrets will be kept in "+path, "err", err)
+		}
+	}
+	return s
+}
+
+// IsReference reports whether `ref` refers to a secret, rather than being a secret itself.
+func IsReference(ref string) bool {
+	scheme, _, found := strings.Cut(ref, ":")
+	return found && (scheme == "env" || scheme == "file" || scheme == "keyring")
+}
+
+// Resolve returns the secret referred to by `ref`. For compatibility with older config files,
+// a value which is not a reference is taken to be the secret itself.
+func (s *Store) Resolve(ref string) (Secret, error) {
+	if ref == "" || !IsReference(ref) {
+		return Secret(ref), nil
+	}
+	scheme, name, _ := strings.Cut(ref, ":")
+	b, ok := s.backends[scheme]
+	if !ok {
+		return "", errors.New("the " + scheme + " secret store is unavailable")
+	}
+	return b.get(name)
+}
+
+// Save stores the secret under `name` in the preferred backend, and returns a reference to it.
+func (s *Store) Save(name string, value Secret) (string, error) {
+	err := s.backends[s.preferred].set(name, value)
+	if err != nil {
+		return "", err
+	}
+	return s.preferred + ":" + name, nil
+}
+
+type envBackend struct{}
+
+func (envBackend) get(name string) (Secret, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.New("environment variable " + name + " is not set")
+	}
+	return Secret(v), nil
+}
+
+func (envBackend) set(name string, _ Secret) error {
+	return errors.New("cannot save " + name + " to the environment")
+}
+
+type keyringBackend struct{}
+
+func (keyringBackend) get(name string) (Secret, error) {
+	v, err := keyring.Get(Service, name)
+	return Secret(v), err
+}
+
+func (keyringBackend) set(name string, value Secret) error {
+	return keyring.Set(Service, name, value.Reveal())
+}
+
+type fileBackend struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (f *fileBackend) read() (map[string]Secret, error) {
+	secrets := make(map[string]Secret)
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]string
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range raw {
+		secrets[k] = Secret(v)
+	}
+	return secrets, nil
+}
+
+func (f *fileBackend) get(name string) (Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secrets, err := f.read()
+	if err != nil {
+		return "", err
+	}
+	v, ok := secrets[name]
+	if !ok {
+		return "", errors.New(name + " is not in " + f.path)
+	}
+	return v, nil
+}
+
+func (f *fileBackend) set(name string, value Secret) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secrets, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	raw := make(map[string]string)
+	for k, v := range secrets {
+		raw[k] = v.Reveal()
+	}
+	raw[name] = value.Reveal()
+	data, err := json.MarshalIndent(raw, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// write the file atomically, and readable only by its owner
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,194 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestSecretRedaction(t *testing.T) {
+	s := Secret("oauth:abc123")
+	var logged bytes.Buffer
+	slog.New(slog.NewTextHandler(&logged, nil)).Info("test", "token", s)
+	data, err := json.Marshal(struct{ Token Secret }{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []string{s.String(), fmt.Sprint(s), fmt.Sprintf("%#v", s), string(data), logged.String()} {
+		if strings.Contains(out, "abc123") || !strings.Contains(out, redacted) {
+			t.Errorf("%q shows the secret", out)
+		}
+	}
+	if s.Reveal() != "oauth:abc123" {
+		t.Errorf("revealed %q", s.Reveal())
+	}
+	if Secret("").String() != "" {
+		t.Error("an empty secret is not shown as empty")
+	}
+}
+
+// fileMode returns the permissions of the file at `path`.
+func fileMode(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestFileBackend(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets.json")
+	f := &fileBackend{path: path}
+
+	_, err := f.get("token")
+	if err == nil {
+		t.Error("got a secret from a missing file")
+	}
+	err = f.set("token", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fileMode(t, path); mode != 0600 {
+		t.Errorf("file has mode %v", mode)
+	}
+	err = f.set("secret", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// overwriting one secret keeps the others
+	err = f.set("token", "three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]Secret{"token": "three", "secret": "two"} {
+		got, err := f.get(name)
+		if err != nil || got != want {
+			t.Errorf("%s is %q, %v; want %q", name, got.Reveal(), err, want.Reveal())
+		}
+	}
+	if _, err := f.get("missing"); err == nil {
+		t.Error("got a secret which was never set")
+	}
+
+	// a file which others could read is replaced by one which they cannot
+	err = os.Chmod(path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.set("token", "four")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fileMode(t, path); mode != 0600 {
+		t.Errorf("file has mode %v after overwriting", mode)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %v", entries)
+	}
+
+	err = os.WriteFile(path, []byte("{not json"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.get("token"); err == nil {
+		t.Error("read a secret from a broken file")
+	}
+	if err := f.set("token", "five"); err == nil {
+		t.Error("overwrote a broken file, losing its secrets")
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	s := Open(path, false)
+
+	ref, err := s.Save("clientSecret", "hunter2")
+	if err != nil || ref != "file:clientSecret" {
+		t.Fatalf("saved as %q, %v", ref, err)
+	}
+	// a new store reads what an earlier one saved
+	got, err := Open(path, false).Resolve(ref)
+	if err != nil || got != "hunter2" {
+		t.Errorf("resolved %q, %v", got.Reveal(), err)
+	}
+
+	t.Setenv("TWEDIA_TEST_SECRET", "from the environment")
+	tests := []struct {
+		ref     string
+		want    Secret
+		wantErr bool
+	}{
+		{"env:TWEDIA_TEST_SECRET", "from the environment", false},
+		{"env:TWEDIA_TEST_MISSING", "", true},
+		{"file:missing", "", true},
+		{"keyring:token", "", true},
+		{"oauth:plain value", "oauth:plain value", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := s.Resolve(tt.ref)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("Resolve(%q) = %q, %v", tt.ref, got.Reveal(), err)
+		}
+	}
+	if _, err := (envBackend{}).get("TWEDIA_TEST_SECRET"); err != nil {
+		t.Error(err)
+	}
+	if err := (envBackend{}).set("TWEDIA_TEST_SECRET", "x"); err == nil {
+		t.Error("saved to the environment")
+	}
+}
+
+func TestIsReference(t *testing.T) {
+	tests := map[string]bool{
+		"env:TOKEN":     true,
+		"file:token":    true,
+		"keyring:token": true,
+		"oauth:abc":     false,
+		"abc":           false,
+		"":              false,
+	}
+	for ref, want := range tests {
+		if got := IsReference(ref); got != want {
+			t.Errorf("IsReference(%q) = %v", ref, got)
+		}
+	}
+}
+
+func TestStoreKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	keyring.MockInit()
+	s := Open(path, true)
+	ref, err := s.Save("token", "in the keyring")
+	if err != nil || ref != "keyring:token" {
+		t.Fatalf("saved as %q, %v", ref, err)
+	}
+	got, err := s.Resolve(ref)
+	if err != nil || got != "in the keyring" {
+		t.Errorf("resolved %q, %v", got.Reveal(), err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("the secret was also saved to the file")
+	}
+
+	// without a keyring, secrets go to the file
+	keyring.MockInitWithError(errors.New("no D-Bus session"))
+	s = Open(path, true)
+	ref, err = s.Save("token", "in the file")
+	if err != nil || ref != "file:token" {
+		t.Fatalf("saved as %q, %v", ref, err)
+	}
+	if _, err := s.Resolve("keyring:token"); err == nil {
+		t.Error("resolved a keyring secret without a keyring")
+	}
+}
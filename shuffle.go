@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+type shuffleConfig struct {
+	// How music is chosen when nobody has asked for a particular song: "random" (the default),
+	// "bag", "album", "artist" or "sequential".
+	Mode string `json:"mode,omitempty"`
+	// Number of songs played from each artist in "artist" mode; defaults to 3.
+	ArtistBlock int `json:"artistBlock,omitempty"`
+	// Tags which songs chosen at random must have; those starting with "-" are tags they must not have.
+	Tags []string `json:"tags,omitempty"`
+	// Number of songs to choose in advance, so that viewers can see what is coming up; defaults to 3.
+	Lookahead int `json:"lookahead,omitempty"`
+}
+
+func (s *shuffleConfig) validate() error {
+	if s.Mode != "" {
+		if err := validShuffleMode(s.Mode); err != nil {
+			return err
+		}
+	}
+	if s.ArtistBlock < 0 {
+		return errors.New("artistBlock may not be negative")
+	}
+	if s.Lookahead < 0 {
+		return errors.New("lookahead may not be negative")
+	}
+	return nil
+}
+
+// lookahead returns how many songs are chosen in advance.
+func lookahead() int {
+	if config.Shuffle != nil && config.Shuffle.Lookahead > 0 {
+		return config.Shuffle.Lookahead
+	}
+	return 3
+}
+
+// shuffleModes lists the ways of choosing music, in the order the console cycles through them:
+//
+//	random     : an independent random song each time, avoiding recently played songs
+//	bag        : every song once, in a random order, before any is repeated
+//	album      : a random album, played through in order
+//	artist     : a block of random songs by one artist, then another artist
+//	sequential : every song in the order of the catalog
+var shuffleModes = []string{"random", "bag", "album", "artist", "sequential"}
+
+func validShuffleMode(mode string) error {
+	for _, m := range shuffleModes {
+		if m == mode {
+			return nil
+		}
+	}
+	return errors.New("unknown shuffle mode '" + mode + "' (expected one of " + strings.Join(shuffleModes, ", ") + ")")
+}
+
+// rotation tracks the songs lined up by the current shuffle mode.
+var rotation struct {
+	sync.Mutex
+	// The shuffle mode chosen in the config or from the console.
+	mode string
+	// The shuffle mode of the station last started by a `start` with a `mode`, which takes the
+	// place of `mode` until music is started without one or the mode is changed from the console.
+	stationMode string
+	// The artist and album which music is restricted to, if any, when `upcoming` was filled.
+	scope  string
+	artist *twedia.Artist
+	album  *twedia.Album
+	// The songs still to come from the current bag, album, block of songs or pass through the catalog.
+	upcoming []songRef
+	// The songs chosen in advance to play next, once any requests have been played.
+	next []songRef
+	// Songs vetoed from the console, and when, which are not chosen again for vetoExpiry or until
+	// the rotation starts afresh.
+	vetoed map[string]time.Time
+}
+
+// How long a vetoed song is left out for.
+const vetoExpiry = time.Hour
+
+// resetRotation discards the songs lined up, so that they are chosen afresh. The caller must hold the rotation's lock.
+func resetRotation() {
+	rotation.upcoming = nil
+	rotation.next = nil
+	rotation.vetoed = nil
+}
+
+// isVetoed reports whether a song was vetoed recently enough to be left out, forgetting vetoes
+// which have expired. The caller must hold the rotation's lock.
+func isVetoed(key string) bool {
+	vetoed, ok := rotation.vetoed[key]
+	if ok && time.Since(vetoed) >= vetoExpiry {
+		delete(rotation.vetoed, key)
+		ok = false
+	}
+	return ok
+}
+
+// currentShuffleMode returns the shuffle mode in use. The caller must hold the rotation's lock.
+func currentShuffleMode() string {
+	switch {
+	case rotation.stationMode != "":
+		return rotation.stationMode
+	case rotation.mode != "":
+		return rotation.mode
+	default:
+		return "random"
+	}
+}
+
+// shuffleMode returns the shuffle mode in use.
+func shuffleMode() string {
+	rotation.Lock()
+	defer rotation.Unlock()
+	return currentShuffleMode()
+}
+
+// setShuffleMode changes how music is chosen, both now and for stations started without a
+// mode of their own, starting afresh if the mode in use changes.
+func setShuffleMode(mode string) error {
+	err := validShuffleMode(mode)
+	if err != nil {
+		return err
+	}
+	rotation.Lock()
+	defer rotation.Unlock()
+	old := currentShuffleMode()
+	rotation.mode, rotation.stationMode = mode, ""
+	if currentShuffleMode() != old {
+		resetRotation()
+	}
+	return nil
+}
+
+// setStationMode changes how music is chosen for the station being started, without changing
+// the mode set in the config or from the console, which is used again if `mode` is empty.
+func setStationMode(mode string) error {
+	if mode != "" {
+		err := validShuffleMode(mode)
+		if err != nil {
+			return err
+		}
+	}
+	rotation.Lock()
+	defer rotation.Unlock()
+	old := currentShuffleMode()
+	rotation.stationMode = mode
+	if currentShuffleMode() != old {
+		resetRotation()
+	}
+	return nil
+}
+
+// tagFilter limits the songs chosen at random to those with every tag in `include`, and none in `exclude`.
+var tagFilter struct {
+	sync.Mutex
+	include, exclude []string
+}
+
+// setTagFilter changes which songs may be chosen at random; tags starting with "-" are those
+// the songs must not have. No tags at all allows every song.
+func setTagFilter(tags []string) {
+	var include, exclude []string
+	for _, tag := range tags {
+		if t, found := strings.CutPrefix(tag, "-"); found {
+			exclude = append(exclude, t)
+		} else if tag != "" {
+			include = append(include, tag)
+		}
+	}
+	tagFilter.Lock()
+	tagFilter.include, tagFilter.exclude = include, exclude
+	tagFilter.Unlock()
+
+	rotation.Lock()
+	resetRotation()
+	rotation.Unlock()
+}
+
+// tagFilterText describes the tag filter, in the form accepted by setTagFilter.
+func tagFilterText() string {
+	tagFilter.Lock()
+	defer tagFilter.Unlock()
+	tags := append([]string(nil), tagFilter.include...)
+	for _, t := range tagFilter.exclude {
+		tags = append(tags, "-"+t)
+	}
+	return strings.Join(tags, " ")
+}
+
+// allowedByTags reports whether a song's tags pass the tag filter.
+func allowedByTags(t twedia.Traits) bool {
+	tagFilter.Lock()
+	defer tagFilter.Unlock()
+	for _, tag := range tagFilter.include {
+		if !t.HasTag(tag) {
+			return false
+		}
+	}
+	for _, tag := range tagFilter.exclude {
+		if t.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// nextShuffleMode returns the mode after the current one, for cycling through them.
+func nextShuffleMode() string {
+	mode := shuffleMode()
+	for i, m := range shuffleModes {
+		if m == mode {
+			return shuffleModes[(i+1)%len(shuffleModes)]
+		}
+	}
+	return shuffleModes[0]
+}
+
+// catalogSongs lists the songs in the catalog, in order, restricted to `album` or `artist` if either is given.
+func catalogSongs(artist *twedia.Artist, album *twedia.Album) []songRef {
+	var songs []songRef
+	m := music()
+	for i := range m.Artists {
+		ar := &m.Artists[i]
+		if artist != nil && ar.Artist != artist.Artist {
+			continue
+		}
+		for j := range ar.Albums {
+			al := &ar.Albums[j]
+			if album != nil && al.Name != album.Name {
+				continue
+			}
+			for k := range al.Songs {
+				songs = append(songs, songRef{artist: ar, album: al, song: &al.Songs[k], weight: 1})
+			}
+		}
+	}
+	return songs
+}
+
+// randomCandidates lists the songs which the shuffle mode may choose when nobody has asked for a
+// particular song, from `album` or `artist` if either is given: those which are not excluded from
+// random selection, have a weight above zero, pass the tag filter, and are VOD-safe if they need to be.
+func randomCandidates(artist *twedia.Artist, album *twedia.Album) []songRef {
+	var songs []songRef
+	for _, s := range catalogSongs(artist, album) {
+		t := twedia.SongTraits(s.artist, s.album, s.song)
+		if t.ExcludeFromRandom || t.Weight <= 0 || !allowedByTags(t) || (vodSafeMode.Load() && !t.VODSafe) {
+			continue
+		}
+		s.weight = t.Weight
+		songs = append(songs, s)
+	}
+	return songs
+}
+
+// weightedChoice picks one of the songs at random, in proportion to their weights.
+func weightedChoice(songs []songRef) songRef {
+	total := 0.0
+	for _, s := range songs {
+		total += s.weight
+	}
+	r := rand.Float64() * total
+	for _, s := range songs {
+		if r < s.weight {
+			return s
+		}
+		r -= s.weight
+	}
+	return songs[len(songs)-1]
+}
+
+// nextSong chooses the next song to play according to the shuffle mode, from `album` or `artist`
+// if either is given: the first of the songs chosen in advance.
+func nextSong(artist *twedia.Artist, album *twedia.Album) (songRef, bool) {
+	rotation.Lock()
+	defer rotation.Unlock()
+	setRotationScope(artist, album)
+	topUpRotation(1)
+	if len(rotation.next) == 0 {
+		return songRef{}, false
+	}
+	next := rotation.next[0]
+	rotation.next = rotation.next[1:]
+	return next, true
+}
+
+// setRotationScope restricts the songs lined up to `album` or `artist`, starting afresh if
+// they have changed. The caller must hold the rotation's lock.
+func setRotationScope(artist *twedia.Artist, album *twedia.Album) {
+	scope := ""
+	if artist != nil {
+		scope = artist.Artist
+	}
+	if album != nil {
+		scope += "\x00" + album.Name
+	}
+	if scope != rotation.scope {
+		rotation.scope = scope
+		rotation.upcoming = nil
+		rotation.next = nil
+	}
+	rotation.artist, rotation.album = artist, album
+}
+
+// topUpRotation chooses songs in advance until there are at least `n`. The caller must hold the rotation's lock.
+func topUpRotation(n int) {
+	mode := currentShuffleMode()
+	for len(rotation.next) < n {
+		var next songRef
+		if mode == "random" {
+			// avoid choosing a song which is already lined up, or has been vetoed
+			exclude := make(map[string]bool)
+			for _, s := range rotation.next {
+				exclude[songKey(s.artist.Artist, s.song.Title)] = true
+			}
+			for k := range rotation.vetoed {
+				if isVetoed(k) {
+					exclude[k] = true
+				}
+			}
+			var ok bool
+			next, ok = randomSong(rotation.artist, rotation.album, exclude)
+			if !ok {
+				return
+			}
+		} else {
+			for len(rotation.upcoming) > 0 && isVetoed(songKey(rotation.upcoming[0].artist.Artist, rotation.upcoming[0].song.Title)) {
+				rotation.upcoming = rotation.upcoming[1:]
+			}
+			if len(rotation.upcoming) == 0 {
+				rotation.upcoming = fillRotation(mode, randomCandidates(rotation.artist, rotation.album))
+				// leave out vetoed songs, unless there is nothing else
+				var allowed []songRef
+				for _, s := range rotation.upcoming {
+					if !isVetoed(songKey(s.artist.Artist, s.song.Title)) {
+						allowed = append(allowed, s)
+					}
+				}
+				if len(allowed) > 0 {
+					rotation.upcoming = allowed
+				}
+			}
+			if len(rotation.upcoming) == 0 {
+				return
+			}
+			next = rotation.upcoming[0]
+			rotation.upcoming = rotation.upcoming[1:]
+		}
+		rotation.next = append(rotation.next, next)
+	}
+}
+
+// prerolledSongs returns the songs chosen in advance to play next, choosing more if there are too few.
+func prerolledSongs() []songRef {
+	rotation.Lock()
+	defer rotation.Unlock()
+	topUpRotation(lookahead())
+	return append([]songRef(nil), rotation.next...)
+}
+
+// vetoSong discards the `n`th song chosen in advance (starting at 1), and chooses another in its place.
+func vetoSong(n int) (songRef, error) {
+	rotation.Lock()
+	defer rotation.Unlock()
+	topUpRotation(lookahead())
+	if n < 1 || n > len(rotation.next) {
+		return songRef{}, errors.New("there is no upcoming song " + strconv.Itoa(n))
+	}
+	s := rotation.next[n-1]
+	rotation.next = append(rotation.next[:n-1], rotation.next[n:]...)
+	if rotation.vetoed == nil {
+		rotation.vetoed = make(map[string]time.Time)
+	}
+	rotation.vetoed[songKey(s.artist.Artist, s.song.Title)] = time.Now()
+	topUpRotation(lookahead())
+	return s, nil
+}
+
+// fillRotation lines up the next run of songs for `mode`, chosen from `songs`.
+func fillRotation(mode string, songs []songRef) []songRef {
+	if len(songs) == 0 {
+		return nil
+	}
+	switch mode {
+	case "bag":
+		rand.Shuffle(len(songs), func(i, j int) {
+			songs[i], songs[j] = songs[j], songs[i]
+		})
+		return songs
+	case "album":
+		return pickGroup(groupSongs(songs, func(a, b songRef) bool { return a.album == b.album }))
+	case "artist":
+		block := pickGroup(groupSongs(songs, func(a, b songRef) bool { return a.artist == b.artist }))
+		rand.Shuffle(len(block), func(i, j int) {
+			block[i], block[j] = block[j], block[i]
+		})
+		n := 3
+		if config.Shuffle != nil && config.Shuffle.ArtistBlock > 0 {
+			n = config.Shuffle.ArtistBlock
+		}
+		return block[:min(n, len(block))]
+	default:
+		return songs
+	}
+}
+
+// groupSongs splits `songs` into runs of consecutive songs for which `same` holds.
+func groupSongs(songs []songRef, same func(a, b songRef) bool) [][]songRef {
+	var groups [][]songRef
+	for i, s := range songs {
+		if i == 0 || !same(s, songs[i-1]) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], s)
+	}
+	return groups
+}
+
+// pickGroup chooses one of the groups at random, in proportion to the total weight of their songs,
+// preferring those with no recently played songs (including the song which played last).
+func pickGroup(groups [][]songRef) []songRef {
+	recent := recentlyPlayed()
+	if last := recentHistory(1); len(last) > 0 {
+		recent[songKey(last[0].Artist, last[0].Song)] = true
+	}
+	var fresh [][]songRef
+	for _, g := range groups {
+		if !anyRecent(g, recent) {
+			fresh = append(fresh, g)
+		}
+	}
+	if len(fresh) > 0 {
+		groups = fresh
+	}
+	weights := make([]float64, len(groups))
+	total := 0.0
+	for i, g := range groups {
+		for _, s := range g {
+			weights[i] += s.weight
+		}
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return groups[i]
+		}
+		r -= w
+	}
+	return groups[len(groups)-1]
+}
+
+// anyRecent reports whether any of the songs was played recently.
+func anyRecent(songs []songRef, recent map[string]bool) bool {
+	for _, s := range songs {
+		if recent[songKey(s.artist.Artist, s.song.Title)] {
+			return true
+		}
+	}
+	return false
+}
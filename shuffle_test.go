@@ -0,0 +1,338 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+// useTestCatalog makes `m` the music catalog, with the rotation and play history starting afresh.
+func useTestCatalog(t *testing.T, m *twedia.Music) {
+	t.Helper()
+	old := catalog.Load()
+	catalog.Store(m)
+	rotation.Lock()
+	rotation.mode, rotation.stationMode = "", ""
+	setRotationScope(nil, nil)
+	resetRotation()
+	rotation.Unlock()
+	historyLock.Lock()
+	playHistory = nil
+	historyLock.Unlock()
+	t.Cleanup(func() {
+		catalog.Store(old)
+		rotation.Lock()
+		rotation.mode, rotation.stationMode = "", ""
+		setRotationScope(nil, nil)
+		resetRotation()
+		rotation.Unlock()
+	})
+}
+
+// testMusic is a catalog of two artists: A, with albums A1 (a1, a2, a3) and A2 (a4), and B, with album B1 (b1, b2).
+func testMusic() *twedia.Music {
+	songs := func(titles ...string) []twedia.Song {
+		var s []twedia.Song
+		for _, title := range titles {
+			s = append(s, twedia.Song{Title: title})
+		}
+		return s
+	}
+	return &twedia.Music{Artists: []twedia.Artist{
+		{Artist: "A", Albums: []twedia.Album{
+			{Name: "A1", Songs: songs("a1", "a2", "a3")},
+			{Name: "A2", Songs: songs("a4")},
+		}},
+		{Artist: "B", Albums: []twedia.Album{
+			{Name: "B1", Songs: songs("b1", "b2")},
+		}},
+	}}
+}
+
+func titles(songs []songRef) []string {
+	var t []string
+	for _, s := range songs {
+		t = append(t, s.song.Title)
+	}
+	return t
+}
+
+func TestFillRotation(t *testing.T) {
+	useTestCatalog(t, testMusic())
+	all := []string{"a1", "a2", "a3", "a4", "b1", "b2"}
+
+	if got := titles(fillRotation("sequential", catalogSongs(nil, nil))); !reflect.DeepEqual(got, all) {
+		t.Errorf("sequential: got %v", got)
+	}
+	if got := fillRotation("bag", nil); got != nil {
+		t.Errorf("bag of nothing: got %v", titles(got))
+	}
+
+	for i := 0; i < 20; i++ {
+		got := titles(fillRotation("bag", catalogSongs(nil, nil)))
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, all) {
+			t.Fatalf("bag: got %v, want every song once", got)
+		}
+
+		album := titles(fillRotation("album", catalogSongs(nil, nil)))
+		if !slices.ContainsFunc([][]string{{"a1", "a2", "a3"}, {"a4"}, {"b1", "b2"}}, func(want []string) bool { return slices.Equal(album, want) }) {
+			t.Fatalf("album: got %v, want a whole album in order", album)
+		}
+	}
+}
+
+func TestFillRotationArtistBlock(t *testing.T) {
+	useTestCatalog(t, testMusic())
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = Config{Shuffle: &shuffleConfig{ArtistBlock: 2}}
+
+	for i := 0; i < 20; i++ {
+		block := fillRotation("artist", catalogSongs(nil, nil))
+		if len(block) != 2 {
+			t.Fatalf("got %v, want 2 songs", titles(block))
+		}
+		if block[0].artist != block[1].artist {
+			t.Fatalf("got %v, want songs by one artist", titles(block))
+		}
+	}
+}
+
+func TestGroupSongs(t *testing.T) {
+	useTestCatalog(t, testMusic())
+	byAlbum := groupSongs(catalogSongs(nil, nil), func(a, b songRef) bool { return a.album == b.album })
+	var got [][]string
+	for _, g := range byAlbum {
+		got = append(got, titles(g))
+	}
+	want := [][]string{{"a1", "a2", "a3"}, {"a4"}, {"b1", "b2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if groups := groupSongs(nil, nil); groups != nil {
+		t.Errorf("got %v for no songs", groups)
+	}
+}
+
+func TestWeightedChoice(t *testing.T) {
+	songs := []songRef{
+		{song: &twedia.Song{Title: "never"}, weight: 0},
+		{song: &twedia.Song{Title: "rare"}, weight: 1},
+		{song: &twedia.Song{Title: "common"}, weight: 9},
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[weightedChoice(songs).song.Title]++
+	}
+	if counts["never"] != 0 {
+		t.Errorf("a song with no weight was chosen %d times", counts["never"])
+	}
+	// expect about 1000; this fails far less than once in a billion runs
+	if counts["rare"] < 700 || counts["rare"] > 1300 {
+		t.Errorf("got %v, want about 1 in 10 to be rare", counts)
+	}
+}
+
+func TestTopUpRotation(t *testing.T) {
+	useTestCatalog(t, testMusic())
+	rotation.Lock()
+	defer rotation.Unlock()
+
+	// random songs are not repeated among those lined up, and vetoed songs are left out
+	rotation.vetoed = map[string]time.Time{songKey("A", "a1"): time.Now()}
+	topUpRotation(5)
+	got := titles(rotation.next)
+	if len(got) != 5 || slices.Contains(got, "a1") {
+		t.Errorf("random: got %v", got)
+	}
+	slices.Sort(got)
+	if len(slices.Compact(got)) != 5 {
+		t.Errorf("random: got repeats in %v", got)
+	}
+
+	// scopes limit the songs to an artist or album
+	m := music()
+	resetRotation()
+	rotation.mode = "sequential"
+	setRotationScope(&m.Artists[1], nil)
+	topUpRotation(3)
+	if got := titles(rotation.next); !reflect.DeepEqual(got, []string{"b1", "b2", "b1"}) {
+		t.Errorf("sequential from B: got %v", got)
+	}
+	setRotationScope(&m.Artists[0], &m.Artists[0].Albums[0])
+	topUpRotation(2)
+	if got := titles(rotation.next); !reflect.DeepEqual(got, []string{"a1", "a2"}) {
+		t.Errorf("sequential from A1: got %v", got)
+	}
+}
+
+func TestStationMode(t *testing.T) {
+	useTestCatalog(t, testMusic())
+	err := setShuffleMode("bag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prerolledSongs()
+
+	// a station's mode takes over, and starts the rotation afresh
+	err = setStationMode("sequential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := shuffleMode(); mode != "sequential" {
+		t.Errorf("mode is %s with a station playing", mode)
+	}
+	if got := titles(prerolledSongs()); !reflect.DeepEqual(got, []string{"a1", "a2", "a3"}) {
+		t.Errorf("got %v from the station", got)
+	}
+
+	// without a mode of its own, the usual mode returns
+	err = setStationMode("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := shuffleMode(); mode != "bag" {
+		t.Errorf("mode is %s once the station has ended", mode)
+	}
+
+	// changing the mode from the console overrides the station's
+	setStationMode("album")
+	setShuffleMode("random")
+	if mode := shuffleMode(); mode != "random" {
+		t.Errorf("mode is %s after changing it", mode)
+	}
+
+	if setStationMode("loud") == nil {
+		t.Error("an unknown mode was accepted")
+	}
+}
+
+func TestVetoSong(t *testing.T) {
+	useTestCatalog(t, testMusic())
+	if _, err := vetoSong(4); err == nil {
+		t.Error("vetoed a song which is not lined up")
+	}
+
+	// in random mode, a vetoed song is left out until its veto expires
+	for i := 0; i < 20; i++ {
+		vetoed, err := vetoSong(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := titles(prerolledSongs()); slices.Contains(got, vetoed.song.Title) {
+			t.Fatalf("%s was lined up again after being vetoed: %v", vetoed.song.Title, got)
+		}
+		rotation.Lock()
+		key := songKey(vetoed.artist.Artist, vetoed.song.Title)
+		rotation.vetoed[key] = time.Now().Add(-vetoExpiry)
+		if isVetoed(key) || len(rotation.vetoed) != 0 {
+			t.Errorf("the veto of %s did not expire", vetoed.song.Title)
+		}
+		rotation.Unlock()
+	}
+
+	// in other modes, vetoed songs are skipped in the songs still to come
+	setShuffleMode("sequential")
+	vetoSong(3)
+	if got := titles(prerolledSongs()); !reflect.DeepEqual(got, []string{"a1", "a2", "a4"}) {
+		t.Errorf("sequential: got %v after vetoing a3", got)
+	}
+	for i := 0; i < 4; i++ {
+		nextSong(nil, nil)
+	}
+	if got := titles(prerolledSongs()); !reflect.DeepEqual(got, []string{"b2", "a1", "a2"}) {
+		t.Errorf("sequential: got %v on the next pass", got)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	defer setTagFilter(nil)
+	chill := twedia.Traits{Tags: []string{"Chill"}}
+	loud := twedia.Traits{Tags: []string{"chill", "loud"}}
+	for _, c := range []struct {
+		tags        []string
+		text        string
+		chill, loud bool
+	}{
+		{nil, "", true, true},
+		{[]string{"chill"}, "chill", true, true},
+		{[]string{"chill", "-loud"}, "chill -loud", true, false},
+		{[]string{"loud"}, "loud", false, true},
+		{[]string{"-chill"}, "-chill", false, false},
+	} {
+		setTagFilter(c.tags)
+		if got := tagFilterText(); got != c.text {
+			t.Errorf("tags %v shown as %q", c.tags, got)
+		}
+		if allowedByTags(chill) != c.chill || allowedByTags(loud) != c.loud {
+			t.Errorf("tags %v: allowed chill %v, loud %v", c.tags, allowedByTags(chill), allowedByTags(loud))
+		}
+	}
+}
+
+func TestShuffleCandidates(t *testing.T) {
+	m := testMusic()
+	zero, two, yes := 0.0, 2.0, true
+	m.Artists[0].Albums[0].Songs[0].ExcludeFromRandom = &yes // a1
+	m.Artists[0].Albums[0].Songs[1].Weight = &zero           // a2
+	m.Artists[0].Albums[1].Tags = []string{"loud"}           // a4
+	m.Artists[1].Weight = &two                               // b1, b2
+	useTestCatalog(t, m)
+	defer setTagFilter(nil)
+	setTagFilter([]string{"-loud"})
+
+	if got := titles(randomCandidates(nil, nil)); !reflect.DeepEqual(got, []string{"a3", "b1", "b2"}) {
+		t.Errorf("got candidates %v", got)
+	}
+	// every mode keeps to the songs which may be chosen
+	for _, mode := range shuffleModes {
+		setShuffleMode(mode)
+		for i := 0; i < 10; i++ {
+			s, ok := nextSong(nil, nil)
+			if !ok || !slices.Contains([]string{"a3", "b1", "b2"}, s.song.Title) {
+				t.Fatalf("%s: played %v", mode, s.song.Title)
+			}
+			if want := map[string]float64{"a3": 1, "b1": 2, "b2": 2}[s.song.Title]; s.weight != want {
+				t.Fatalf("%s: %s has weight %v", mode, s.song.Title, s.weight)
+			}
+		}
+	}
+}
+
+func TestPickGroup(t *testing.T) {
+	useTestCatalog(t, testMusic())
+	group := func(title string, weight float64) []songRef {
+		return []songRef{{artist: &twedia.Artist{Artist: "A"}, song: &twedia.Song{Title: title}, weight: weight}}
+	}
+	// groups are chosen in proportion to the total weight of their songs
+	light := group("light", 1)
+	heavy := append(group("heavy", 2), group("heavy too", 7)...)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[pickGroup([][]songRef{light, heavy, group("never", 0)})[0].song.Title]++
+	}
+	if counts["never"] != 0 {
+		t.Errorf("a group with no weight was chosen %d times", counts["never"])
+	}
+	// expect about 1000; this fails far less than once in a billion runs
+	if counts["light"] < 700 || counts["light"] > 1300 {
+		t.Errorf("got %v, want about 1 in 10 to be light", counts)
+	}
+
+	// groups with recently played songs are avoided, unless there are no others
+	historyLock.Lock()
+	playHistory = append(playHistory, historyEntry{Artist: "A", Song: "heavy too"})
+	historyLock.Unlock()
+	for i := 0; i < 20; i++ {
+		if got := pickGroup([][]songRef{light, heavy}); got[0].song.Title != "light" {
+			t.Fatalf("chose %v, which was just played", titles(got))
+		}
+	}
+	if got := pickGroup([][]songRef{heavy}); got[0].song.Title != "heavy" {
+		t.Errorf("chose %v from a single group", titles(got))
+	}
+}
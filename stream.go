@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+type streamConfig struct {
+	// "mp3" (the default) or "ogg".
+	Format string `json:"format,omitempty"`
+	// Bitrate in kbit/s; defaults to 128.
+	Bitrate int `json:"bitrate,omitempty"`
+	// Address on which to serve the stream over HTTP, such as ":8000".
+	Listen string `json:"listen,omitempty"`
+	// Path of the stream on the HTTP server; defaults to "/stream".
+	Path string `json:"path,omitempty"`
+	// Name of the stream, given to listeners.
+	Name string `json:"name,omitempty"`
+	// Icecast mount to send the stream to, as a source client.
+	Icecast *icecastConfig `json:"icecast,omitempty"`
+}
+
+type icecastConfig struct {
+	// URL of the mount, such as "http://localhost:8000/twedia".
+	URL string `json:"url" required:"true"`
+	// Source username; defaults to "source".
+	User     string `json:"user,omitempty"`
+	Password string `json:"password"`
+}
+
+func (s *streamConfig) validate() error {
+	if s.Format != "" && s.Format != "mp3" && s.Format != "ogg" {
+		return errors.New("unknown format '" + s.Format + "' (expected mp3 or ogg)")
+	}
+	if s.Bitrate < 0 {
+		return errors.New("bitrate may not be negative")
+	}
+	if s.Listen == "" && s.Icecast == nil {
+		return errors.New("either listen or icecast is needed")
+	}
+	if s.Path != "" && !strings.HasPrefix(s.Path, "/") {
+		return errors.New("path must start with '/'")
+	}
+	if s.Icecast != nil {
+		u, err := url.Parse(s.Icecast.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Path == "" {
+			return errors.New("icecast url must be an http(s) URL including the mount, such as http://localhost:8000/twedia")
+		}
+	}
+	return nil
+}
+
+func (s *streamConfig) contentType() string {
+	if s.Format == "ogg" {
+		return "application/ogg"
+	}
+	return "audio/mpeg"
+}
+
+func (s *streamConfig) bitrate() int {
+	if s.Bitrate == 0 {
+		return 128
+	}
+	return s.Bitrate
+}
+
+// Number of bytes of audio between ICY metadata blocks.
+const icyMetaInt = 16000
+
+// audioStream shares the encoded music between everyone listening to it.
+var audioStream struct {
+	sync.Mutex
+	listeners map[chan []byte]bool
+	// For Ogg, the pages which start the stream, which each listener needs before anything else.
+	header []byte
+	// "Artist - Song" for the song which is playing.
+	title string
+}
+
+// listenStream returns a channel on which the encoded stream is sent, along with anything
+// which must be sent before it. The channel is closed if the listener falls too far behind.
+func listenStream() (chan []byte, []byte) {
+	audioStream.Lock()
+	defer audioStream.Unlock()
+	if audioStream.listeners == nil {
+		audioStream.listeners = make(map[chan []byte]bool)
+	}
+	ch := make(chan []byte, 256)
+	audioStream.listeners[ch] = true
+	return ch, audioStream.header
+}
+
+func stopListening(ch chan []byte) {
+	audioStream.Lock()
+	defer audioStream.Unlock()
+	if audioStream.listeners[ch] {
+		delete(audioStream.listeners, ch)
+		close(ch)
+	}
+}
+
+func broadcastStream(data []byte) {
+	audioStream.Lock()
+	defer audioStream.Unlock()
+	for ch := range audioStream.listeners {
+		select {
+		case ch <- data:
+		default:
+			delete(audioStream.listeners, ch)
+			close(ch)
+		}
+	}
+}
+
+func streamTitle() string {
+	audioStream.Lock()
+	defer audioStream.Unlock()
+	return audioStream.title
+}
+
+// setStreamTitle updates the title given to listeners of the stream, if there is one.
+func setStreamTitle(q *queuedTrack) {
+	if config.Stream == nil {
+		return
+	}
+	title := ""
+	if q != nil {
+		title = q.Artist.Artist + " - " + q.Song.Title
+	}
+	audioStream.Lock()
+	changed := title != audioStream.title
+	audioStream.title = title
+	audioStream.Unlock()
+	if changed && config.Stream.Icecast != nil && config.Stream.Format != "ogg" {
+		go updateIcecastTitle(config.Stream.Icecast, title)
+	}
+}
+
+var stopStream context.CancelFunc = func() {}
+
+// startStream starts encoding the music, serving it over HTTP and sending it to Icecast, as configured.
+func startStream(sc *streamConfig) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopStream = cancel
+
+	pcm := make(chan []byte, 50)
+	twedia.Listen(func(data []byte) {
+		select {
+		case pcm <- data:
+		default:
+			// the encoder is behind, so this audio is lost
+		}
+	})
+	go runEncoder(ctx, sc, pcm)
+
+	if sc.Listen != "" {
+		path := sc.Path
+		if path == "" {
+			path = "/stream"
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			serveStream(sc, w, r)
+		})
+		server := &http.Server{Addr: sc.Listen, Handler: mux}
+		go func() {
+			slog.Info("Serving music stream", "address", sc.Listen, "path", path)
+			err := server.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Error serving music stream", "err", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+	}
+
+	if sc.Icecast != nil {
+		go pushIcecast(ctx, sc)
+	}
+}
+
+// runEncoder feeds the music to ffmpeg, and shares what it makes with the stream's listeners,
+// restarting it if it stops.
+func runEncoder(ctx context.Context, sc *streamConfig, pcm <-chan []byte) {
+	bin := config.FFmpeg
+	if bin == "" {
+		bin = "ffmpeg"
+	}
+	codec := "libmp3lame"
+	if sc.Format == "ogg" {
+		codec = "libvorbis"
+	}
+	for ctx.Err() == nil {
+		cmd := exec.CommandContext(ctx, bin, "-hide_banner", "-loglevel", "error",
+			"-f", "s16le", "-ar", "48000", "-ac", "2", "-i", "pipe:0",
+			"-c:a", codec, "-b:a", strconv.Itoa(sc.bitrate())+"k", "-f", sc.formatName(), "pipe:1")
+		err := encode(cmd, sc.Format == "ogg", pcm)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Music stream encoder stopped; restarting it shortly", "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+func (s *streamConfig) formatName() string {
+	if s.Format == "ogg" {
+		return "ogg"
+	}
+	return "mp3"
+}
+
+// encode runs the encoder until it fails.
+func encode(cmd *exec.Cmd, ogg bool, pcm <-chan []byte) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := new(strings.Builder)
+	cmd.Stderr = stderr
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case data := <-pcm:
+				_, err := stdin.Write(data)
+				if err != nil {
+					return
+				}
+			case <-done:
+				stdin.Close()
+				return
+			}
+		}
+	}()
+
+	audioStream.Lock()
+	audioStream.header = nil
+	audioStream.Unlock()
+
+	r := bufio.NewReader(stdout)
+	inHeader := true
+	for {
+		var data []byte
+		if ogg {
+			var granule uint64
+			data, granule, err = readOggPage(r)
+			// a new listener needs the pages carrying the codec's setup, which come before any audio
+			if err == nil && inHeader {
+				if granule == 0 {
+					audioStream.Lock()
+					audioStream.header = append(audioStream.header, data...)
+					audioStream.Unlock()
+				} else {
+					inHeader = false
+				}
+			}
+		} else {
+			data = make([]byte, 4096)
+			var n int
+			n, err = r.Read(data)
+			data = data[:n]
+		}
+		if len(data) > 0 {
+			broadcastStream(data)
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(done)
+	waitErr := cmd.Wait()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return errors.New(msg)
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// readOggPage reads one page of an Ogg stream, returning it along with its granule position.
+func readOggPage(r *bufio.Reader) ([]byte, uint64, error) {
+	header := make([]byte, 27)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(header[:4]) != "OggS" {
+		return nil, 0, errors.New("encoder output is not an Ogg stream")
+	}
+	segments := make([]byte, header[26])
+	_, err = io.ReadFull(r, segments)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+	page := make([]byte, len(header)+len(segments)+size)
+	copy(page, header)
+	copy(page[len(header):], segments)
+	_, err = io.ReadFull(r, page[len(header)+len(segments):])
+	if err != nil {
+		return nil, 0, err
+	}
+	return page, binary.LittleEndian.Uint64(header[6:14]), nil
+}
+
+// serveStream sends the stream to an HTTP listener, with ICY metadata if they ask for it.
+func serveStream(sc *streamConfig, w http.ResponseWriter, r *http.Request) {
+	ch, header := listenStream()
+	defer stopListening(ch)
+
+	h := w.Header()
+	h.Set("Content-Type", sc.contentType())
+	h.Set("Cache-Control", "no-cache, no-store")
+	h.Set("icy-br", strconv.Itoa(sc.bitrate()))
+	if sc.Name != "" {
+		h.Set("icy-name", sc.Name)
+	}
+	var out io.Writer = w
+	if r.Header.Get("Icy-MetaData") == "1" {
+		h.Set("icy-metaint", strconv.Itoa(icyMetaInt))
+		out = &icyWriter{w: w, left: icyMetaInt}
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	slog.Debug("Music stream listener connected", "remote", r.RemoteAddr)
+	defer slog.Debug("Music stream listener disconnected", "remote", r.RemoteAddr)
+
+	flusher, _ := w.(http.Flusher)
+	_, err := out.Write(header)
+	for err == nil {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+			_, err = out.Write(data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// icyWriter adds ICY metadata, giving the title of the song which is playing, to a stream every icyMetaInt bytes.
+type icyWriter struct {
+	w io.Writer
+	// Bytes of audio to go before the next metadata.
+	left int
+	// The title last sent, if any has been.
+	sent *string
+}
+
+func (iw *icyWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n, err := iw.w.Write(data[:min(len(data), iw.left)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+		iw.left -= n
+		if iw.left > 0 {
+			continue
+		}
+
+		// metadata is only repeated when it changes; otherwise the block is empty
+		meta := []byte{0}
+		if title := streamTitle(); iw.sent == nil || *iw.sent != title {
+			meta = icyMetadata(title)
+			iw.sent = &title
+		}
+		_, err = iw.w.Write(meta)
+		if err != nil {
+			return written, err
+		}
+		iw.left = icyMetaInt
+	}
+	return written, nil
+}
+
+// icyMetadata makes a block of ICY metadata: a byte giving its length in units of 16 bytes, then the metadata, padded out with zeros.
+func icyMetadata(title string) []byte {
+	// players take the title to end at the first quote, so use a typographic one in its place
+	title = strings.ReplaceAll(title, "'", "’")
+	const maxTitle = 255*16 - len("StreamTitle='';")
+	if len(title) > maxTitle {
+		title = title[:maxTitle]
+		// don't leave part of a character at the end
+		for !utf8.ValidString(title) {
+			title = title[:len(title)-1]
+		}
+	}
+	meta := "StreamTitle='" + title + "';"
+	blocks := (len(meta) + 15) / 16
+	data := make([]byte, 1+blocks*16)
+	data[0] = byte(blocks)
+	copy(data[1:], meta)
+	return data
+}
+
+// pushIcecast sends the stream to an Icecast mount, reconnecting whenever the connection is lost.
+func pushIcecast(ctx context.Context, sc *streamConfig) {
+	for ctx.Err() == nil {
+		err := sendIcecast(ctx, sc)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Lost connection to Icecast; reconnecting shortly", "url", sc.Icecast.URL, "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// sendIcecast connects to Icecast as a source client, and sends the stream until the connection fails.
+func sendIcecast(ctx context.Context, sc *streamConfig) error {
+	ic := sc.Icecast
+	u, err := url.Parse(ic.URL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// Icecast expects the request to be followed by the stream itself, with no end, so it is
+	// written out by hand rather than through net/http
+	req := fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: %s\r\nAuthorization: %s\r\nUser-Agent: twedia\r\nContent-Type: %s\r\nIce-Public: 0\r\nIce-Bitrate: %d\r\n",
+		u.RequestURI(), u.Host, icecastAuth(ic), sc.contentType(), sc.bitrate())
+	if sc.Name != "" {
+		req += "Ice-Name: " + sc.Name + "\r\n"
+	}
+	req += "Expect: 100-continue\r\n\r\n"
+	_, err = io.WriteString(conn, req)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return errors.New("Icecast refused the stream: " + resp.Status)
+	}
+	conn.SetReadDeadline(time.Time{})
+	slog.Info("Sending music stream to Icecast", "url", ic.URL)
+	go updateIcecastTitle(ic, streamTitle())
+
+	ch, header := listenStream()
+	defer stopListening(ch)
+	_, err = conn.Write(header)
+	for err == nil {
+		data, ok := <-ch
+		if !ok {
+			return errors.New("the connection was too slow to keep up with the stream")
+		}
+		_, err = conn.Write(data)
+	}
+	return err
+}
+
+func icecastAuth(ic *icecastConfig) string {
+	user := ic.User
+	if user == "" {
+		user = "source"
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+creds.IcecastPassword.Reveal()))
+}
+
+// updateIcecastTitle tells Icecast the title of the song which is playing. This only works for MP3 streams.
+func updateIcecastTitle(ic *icecastConfig, title string) {
+	u, err := url.Parse(ic.URL)
+	if err != nil {
+		return
+	}
+	q := url.Values{"mount": {u.Path}, "mode": {"updinfo"}, "song": {title}}
+	admin := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/admin/metadata", RawQuery: q.Encode()}
+	req, err := http.NewRequest(http.MethodGet, admin.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", icecastAuth(ic))
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		slog.Warn("Unable to update the Icecast stream's title", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Unable to update the Icecast stream's title", "status", resp.Status)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestICYMetadata(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{"empty", "", "StreamTitle='';"},
+		{"plain", "Artist - Song", "StreamTitle='Artist - Song';"},
+		{"quotes", "Artist - Don't Stop", "StreamTitle='Artist - Don’t Stop';"},
+		{"quote and semicolon", "A - ';b", "StreamTitle='A - ’;b';"},
+		{"long", strings.Repeat("x", 5000), "StreamTitle='" + strings.Repeat("x", 255*16-15) + "';"},
+		{"long with multibyte characters", strings.Repeat("é", 3000), "StreamTitle='" + strings.Repeat("é", (255*16-15)/2) + "';"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := icyMetadata(tt.title)
+			if (len(data)-1)%16 != 0 || int(data[0]) != (len(data)-1)/16 {
+				t.Fatalf("block of %d bytes has length byte %d", len(data), data[0])
+			}
+			if got := strings.TrimRight(string(data[1:]), "\x00"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/lyrenhex/twedia/twedia"
+	"github.com/lyrenhex/twedia/twitch"
+	"github.com/rivo/tview"
+)
+
+// Whether twedia is connected to Twitch chat.
+var chatConnected atomic.Bool
+
+// The running terminal UI, if there is one.
+var tui *tview.Application
+var tuiLock sync.Mutex
+
+const tuiKeys = "[yellow]space[-] pause  [yellow]s[-] skip  [yellow]+/-[-] volume  [yellow]r[-] random  [yellow]x[-] stop  " +
+	"[yellow]←/→[-] seek  [yellow]b[-] restart  [yellow]m[-] shuffle mode  [yellow]d[-] veto next  [yellow]v[-] VOD-safe  [yellow]/[-] library  [yellow]:[-] command  [yellow]q[-] quit"
+
+// libraryEntry is a song in the library browser.
+type libraryEntry struct {
+	artist twedia.Artist
+	album  twedia.Album
+	song   twedia.Song
+	// Lowercase text which searches are matched against.
+	search string
+}
+
+// runTUI shows a full-screen terminal UI until the user quits.
+func runTUI() error {
+	app := tview.NewApplication()
+
+	nowPlayingView := tview.NewTextView().SetDynamicColors(true)
+	nowPlayingView.SetBorder(true).SetTitle(" Now playing ")
+	statusView := tview.NewTextView().SetDynamicColors(true)
+	statusView.SetBorder(true).SetTitle(" Status ")
+	queueView := tview.NewTextView().SetDynamicColors(true)
+	queueView.SetBorder(true).SetTitle(" Queue ")
+	activityView := tview.NewTextView().SetDynamicColors(true)
+	activityView.SetBorder(true).SetTitle(" Chat commands & redemptions ")
+	logView := tview.NewTextView().SetMaxLines(500).ScrollToEnd()
+	logView.SetBorder(true).SetTitle(" Log ")
+	keysView := tview.NewTextView().SetDynamicColors(true).SetText(tuiKeys)
+
+	commandInput := tview.NewInputField().SetLabel(": ")
+	bottom := tview.NewPages().
+		AddPage("keys", keysView, true, true).
+		AddPage("command", commandInput, true, false)
+
+	home := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(tview.NewFlex().
+			AddItem(nowPlayingView, 0, 2, false).
+			AddItem(statusView, 30, 0, false), 7, 0, false).
+		AddItem(tview.NewFlex().
+			AddItem(queueView, 0, 1, false).
+			AddItem(activityView, 0, 1, false), 0, 1, false).
+		AddItem(logView, 0, 1, false).
+		AddItem(bottom, 1, 0, false)
+
+	// library browser
+	searchInput := tview.NewInputField().SetLabel("Search: ")
+	results := tview.NewList().ShowSecondaryText(false).SetHighlightFullLine(true)
+	results.SetBorder(true).SetTitle(" Library ")
+	libraryKeys := tview.NewTextView().SetDynamicColors(true).
+		SetText("[yellow]enter[-] play now  [yellow]tab[-] add to queue  [yellow]up/down[-] choose  [yellow]esc[-] back")
+	library := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(searchInput, 1, 0, true).
+		AddItem(results, 0, 1, false).
+		AddItem(libraryKeys, 1, 0, false)
+
+	pages := tview.NewPages().
+		AddPage("main", home, true, true).
+		AddPage("library", library, true, false)
+
+	var entries, matches []libraryEntry
+	filter := func(query string) {
+		matches = searchLibrary(entries, query)
+		results.Clear()
+		for _, e := range matches {
+			results.AddItem(fmt.Sprintf("%s  [gray]%s — %s", tview.Escape(e.song.Title), tview.Escape(e.artist.Artist), tview.Escape(e.album.Name)), "", 0, nil)
+		}
+		results.SetTitle(fmt.Sprintf(" Library (%d) ", len(matches)))
+	}
+	openLibrary := func() {
+		entries = libraryEntries(music())
+		searchInput.SetText("")
+		filter("")
+		pages.SwitchToPage("library")
+		app.SetFocus(searchInput)
+	}
+	closeLibrary := func() {
+		pages.SwitchToPage("main")
+		app.SetFocus(home)
+	}
+	searchInput.SetChangedFunc(filter)
+	searchInput.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		i := results.GetCurrentItem()
+		switch ev.Key() {
+		case tcell.KeyUp:
+			results.SetCurrentItem(max(i-1, 0))
+		case tcell.KeyDown:
+			results.SetCurrentItem(i + 1)
+		case tcell.KeyPgUp:
+			results.SetCurrentItem(max(i-10, 0))
+		case tcell.KeyPgDn:
+			results.SetCurrentItem(i + 10)
+		case tcell.KeyEsc:
+			closeLibrary()
+		case tcell.KeyEnter, tcell.KeyTab:
+			if i >= len(matches) {
+				return nil
+			}
+			e := matches[i]
+			if ev.Key() == tcell.KeyEnter {
+				musicPlayer.SetContinuing(false)
+				startPlaying(&e.artist, &e.album, &e.song, trigger{Source: "console"})
+			} else {
+				pos := enqueue(queuedTrack{Artist: e.artist, Album: e.album, Song: e.song})
+				fmt.Fprintf(logView, "Queued %s by %s at position %d\n", e.song.Title, e.artist.Artist, pos)
+				ensurePlaying(trigger{Source: "console"})
+			}
+			closeLibrary()
+		default:
+			return ev
+		}
+		return nil
+	})
+
+	openCommand := func() {
+		commandInput.SetText("")
+		bottom.SwitchToPage("command")
+		app.SetFocus(commandInput)
+	}
+	closeCommand := func() {
+		bottom.SwitchToPage("keys")
+		app.SetFocus(home)
+	}
+	commandInput.SetDoneFunc(func(key tcell.Key) {
+		line := commandInput.GetText()
+		closeCommand()
+		if key != tcell.KeyEnter || strings.TrimSpace(line) == "" {
+			return
+		}
+		fmt.Fprintln(logView, "> "+line)
+		if runCommand(line, logView) {
+			app.Stop()
+		}
+	})
+
+	app.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		if _, typing := app.GetFocus().(*tview.InputField); typing {
+			return ev
+		}
+		switch ev.Key() {
+		case tcell.KeyLeft:
+			runCommand("seek -10s", logView)
+			return nil
+		case tcell.KeyRight:
+			runCommand("seek +10s", logView)
+			return nil
+		}
+		switch ev.Rune() {
+		case ' ':
+			musicPlayer.TogglePause()
+		case 's':
+			runCommand("skip", logView)
+		case 'r':
+			runCommand("start", logView)
+		case 'x':
+			runCommand("stop", logView)
+		case '+', '=':
+			musicPlayer.AdjustVolume(0.5)
+		case '-':
+			musicPlayer.AdjustVolume(-0.5)
+		case 'b':
+			runCommand("restart", logView)
+		case 'd':
+			runCommand("veto", logView)
+		case 'v':
+			runCommand("vodsafe toggle", logView)
+		case 'm':
+			runCommand("shuffle "+nextShuffleMode(), logView)
+		case '/', 'l':
+			openLibrary()
+		case ':':
+			openCommand()
+		case 'q':
+			app.Stop()
+		default:
+			return ev
+		}
+		return nil
+	})
+
+	refresh := func() {
+		nowPlayingView.SetText(nowPlayingText())
+		statusView.SetText(statusText())
+		queueView.SetText(queueText())
+		activityView.SetText(activityText())
+	}
+	refresh()
+
+	done := make(chan bool)
+	defer close(done)
+	events := musicPlayer.Subscribe()
+	defer musicPlayer.Unsubscribe(events)
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				app.QueueUpdateDraw(refresh)
+			case <-events:
+				// show changes to the music straight away
+				app.QueueUpdateDraw(refresh)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	logOutput.Set(logView)
+	defer logOutput.Set(os.Stderr)
+
+	tuiLock.Lock()
+	tui = app
+	tuiLock.Unlock()
+	defer func() {
+		tuiLock.Lock()
+		tui = nil
+		tuiLock.Unlock()
+	}()
+
+	return app.SetRoot(pages, true).SetFocus(home).Run()
+}
+
+// stopTUI closes the terminal UI, if it is running, restoring the terminal.
+func stopTUI() {
+	tuiLock.Lock()
+	defer tuiLock.Unlock()
+	if tui != nil {
+		tui.Stop()
+	}
+}
+
+// libraryEntries lists every song in the catalog for the library browser.
+func libraryEntries(m *twedia.Music) []libraryEntry {
+	var entries []libraryEntry
+	for _, ar := range m.Artists {
+		for _, al := range ar.Albums {
+			for _, s := range al.Songs {
+				entries = append(entries, libraryEntry{
+					artist: ar,
+					album:  al,
+					song:   s,
+					search: strings.ToLower(ar.Artist + " " + al.Name + " " + s.Title),
+				})
+			}
+		}
+	}
+	return entries
+}
+
+// searchLibrary returns the entries whose artist, album or title contain every word of the query.
+func searchLibrary(entries []libraryEntry, query string) []libraryEntry {
+	words := strings.Fields(strings.ToLower(query))
+	var matches []libraryEntry
+	for _, e := range entries {
+		found := true
+		for _, w := range words {
+			if !strings.Contains(e.search, w) {
+				found = false
+				break
+			}
+		}
+		if found {
+			matches = append(matches, e)
+		}
+	}
+	return matches
+}
+
+func nowPlayingText() string {
+	p, ok := nowPlaying()
+	if !ok {
+		return "\n[gray]Not playing"
+	}
+	text := fmt.Sprintf("[::b]%s[::-]\n%s — %s", tview.Escape(p.Song.Title), tview.Escape(p.Artist.Artist), tview.Escape(p.Album.Name))
+	if p.User != "" {
+		text += "\n[gray]requested by " + tview.Escape(p.User) + "[-]"
+	} else {
+		text += "\n"
+	}
+	if site, link := p.Song.Link(); link != "" {
+		if site != "" {
+			site += ": "
+		}
+		text += "\n[gray]" + tview.Escape(site+link) + "[-]"
+	}
+
+	pos, length := musicPlayer.Position(), musicPlayer.Duration()
+	text += "\n" + progressBar(pos, length, 30) + " " + formatDuration(pos) + " / " + formatDuration(length)
+	if musicPlayer.Paused() {
+		text += "  [yellow]paused[-]"
+	}
+	if vol := musicPlayer.Volume(); vol != 0 {
+		text += fmt.Sprintf("  volume %+.1f", vol)
+	}
+	return text
+}
+
+func progressBar(pos, length time.Duration, width int) string {
+	filled := 0
+	if length > 0 {
+		filled = min(int(int64(width)*int64(pos)/int64(length)), width)
+	}
+	return "[green]" + strings.Repeat("█", filled) + "[gray]" + strings.Repeat("░", width-filled) + "[-]"
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+func health(ok bool, text string) string {
+	if ok {
+		return "[green]●[-] " + text
+	}
+	return "[red]●[-] " + text
+}
+
+func statusText() string {
+	text := "Chat       " + health(chatConnected.Load(), "") + "\n"
+	text += "PubSub     " + health(twitch.PubSubConnected(), "") + "\n"
+	if o == nil {
+		text += "OBS        [gray]off[-]\n"
+	} else {
+		text += "OBS        " + health(o.Connected(), "") + "\n"
+	}
+	if v == nil {
+		text += "Veadotube  [gray]off[-]"
+	} else {
+		connected, state := v.Status()
+		text += "Veadotube  " + health(connected, tview.Escape(state))
+	}
+	if vodSafeMode.Load() {
+		text += "\nVOD-safe   [green]on[-]"
+	} else {
+		text += "\nVOD-safe   [gray]off[-]"
+	}
+	text += "\nShuffle    " + shuffleMode()
+	if filter := tagFilterText(); filter != "" {
+		text += " [gray]" + tview.Escape(filter) + "[-]"
+	}
+	return text
+}
+
+func queueText() string {
+	queue := queuedTracks()
+	var prerolled []songRef
+	if musicPlayer.Continuing() {
+		prerolled = prerolledSongs()
+	}
+	if len(queue) == 0 && len(prerolled) == 0 {
+		return "[gray]The queue is empty"
+	}
+	var b strings.Builder
+	for i, q := range queue {
+		fmt.Fprintf(&b, "%d. %s [gray]— %s", i+1, tview.Escape(q.Song.Title), tview.Escape(q.Artist.Artist))
+		if q.User != "" {
+			fmt.Fprintf(&b, " (%s)", tview.Escape(q.User))
+		}
+		b.WriteString("[-]\n")
+	}
+	// the songs chosen in advance, which can be vetoed
+	for _, s := range prerolled {
+		fmt.Fprintf(&b, "[gray]·  %s — %s[-]\n", tview.Escape(s.song.Title), tview.Escape(s.artist.Artist))
+	}
+	return b.String()
+}
+
+func activityText() string {
+	var b strings.Builder
+	for _, a := range activities() {
+		fmt.Fprintf(&b, "[gray]%s[-] %s [yellow]%s[-]", a.Time.Format("15:04"), tview.Escape(a.User), tview.Escape(a.Name))
+		if a.Input != "" {
+			b.WriteString(" " + tview.Escape(a.Input))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
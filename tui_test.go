@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+func TestProgressBar(t *testing.T) {
+	for _, c := range []struct {
+		pos, length time.Duration
+		filled      int
+	}{
+		{0, time.Minute, 0},
+		{30 * time.Second, time.Minute, 5},
+		{time.Minute, time.Minute, 10},
+		// a position past the end, or an unknown length, does not overflow the bar
+		{2 * time.Minute, time.Minute, 10},
+		{time.Minute, 0, 0},
+	} {
+		bar := progressBar(c.pos, c.length, 10)
+		if n := strings.Count(bar, "█"); n != c.filled {
+			t.Errorf("progressBar(%v, %v) filled %d, want %d", c.pos, c.length, n, c.filled)
+		}
+		if n := strings.Count(bar, "█") + strings.Count(bar, "░"); n != 10 {
+			t.Errorf("progressBar(%v, %v) is %d wide", c.pos, c.length, n)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                           "0:00",
+		1500 * time.Millisecond:     "0:02",
+		59 * time.Second:            "0:59",
+		3*time.Minute + time.Second: "3:01",
+		75 * time.Minute:            "75:00",
+	} {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestSearchLibrary(t *testing.T) {
+	entries := libraryEntries(testMusic())
+	if len(entries) != 6 {
+		t.Fatalf("%d entries in the library", len(entries))
+	}
+	for query, want := range map[string][]string{
+		"": {"a1", "a2", "a3", "a4", "b1", "b2"},
+		// the album's name is searched, as well as the title
+		"A1":     {"a1", "a2", "a3"},
+		"a1 A2":  {"a2"},
+		"a4":     {"a4"},
+		"b b1 b": {"b1", "b2"},
+		"nope":   nil,
+	} {
+		var got []string
+		for _, e := range searchLibrary(entries, query) {
+			got = append(got, e.song.Title)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("searching for %q found %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestQueueText(t *testing.T) {
+	useTestPlayer(t)
+	musicPlayer.SetContinuing(false)
+	queueLock.Lock()
+	saved := requestQueue
+	requestQueue = nil
+	queueLock.Unlock()
+	t.Cleanup(func() {
+		queueLock.Lock()
+		requestQueue = saved
+		queueLock.Unlock()
+	})
+
+	if got := queueText(); !strings.Contains(got, "empty") {
+		t.Errorf("empty queue shown as %q", got)
+	}
+	enqueue(queuedTrack{Artist: twedia.Artist{Artist: "A"}, Song: twedia.Song{Title: "[one]"}, User: "viewer"})
+	enqueue(queuedTrack{Artist: twedia.Artist{Artist: "B"}, Song: twedia.Song{Title: "two"}})
+	got := queueText()
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("queue shown as %q", got)
+	}
+	// titles are escaped so that they are not taken as colour tags
+	if !strings.HasPrefix(lines[0], "1. [one[] ") || !strings.Contains(lines[0], "(viewer)") {
+		t.Errorf("first line %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "2. two ") || strings.Contains(lines[1], "(") {
+		t.Errorf("second line %q", lines[1])
+	}
+}
+
+func TestNowPlayingText(t *testing.T) {
+	useTestPlayer(t)
+	if got := nowPlayingText(); !strings.Contains(got, "Not playing") {
+		t.Errorf("nothing playing shown as %q", got)
+	}
+	p := &queuedTrack{
+		Artist: twedia.Artist{Artist: "A"},
+		Album:  twedia.Album{Name: "B"},
+		Song:   twedia.Song{Title: "C"},
+		User:   "viewer",
+	}
+	setNowPlaying(p)
+	defer clearNowPlaying(p)
+	got := nowPlayingText()
+	for _, want := range []string{"C", "A — B", "requested by viewer", "0:00 / 0:00"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("now playing shown as %q, missing %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package twedia
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Most bytes of tags read while looking for embedded art.
+const maxTagSize = 16 << 20
+
+// Names of the image files commonly kept alongside an album's songs, in order of preference.
+var folderArtNames = []string{"cover", "folder", "front", "album", "albumart"}
+
+var errNoArt = errors.New("no embedded art")
+
+// FolderArt looks for the cover art of the album in `dir`, such as cover.jpg or folder.png,
+// returning its path or "" if there is none.
+func FolderArt(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, name := range folderArtNames {
+		for _, e := range entries {
+			ext := strings.ToLower(filepath.Ext(e.Name()))
+			if e.IsDir() || (ext != ".jpg" && ext != ".jpeg" && ext != ".png") {
+				continue
+			}
+			if strings.EqualFold(strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())), name) {
+				return filepath.Join(dir, e.Name())
+			}
+		}
+	}
+	return ""
+}
+
+// EmbeddedArt returns the cover art stored in the tags of the audio file `fn`: ID3v2 (as used by
+// MP3 files), FLAC, or Vorbis comments (as used by Ogg Vorbis and Opus files). The front cover is
+// preferred where a file holds several pictures.
+func EmbeddedArt(fn string) ([]byte, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	head, err := r.Peek(4)
+	if err != nil {
+		return nil, errNoArt
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return id3Art(r)
+	case bytes.Equal(head, []byte("fLaC")):
+		r.Discard(4)
+		return flacArt(r)
+	case bytes.Equal(head, []byte("OggS")):
+		return oggArt(r)
+	}
+	return nil, errNoArt
+}
+
+// pictureChooser keeps the best of the pictures found in a file: the front cover (picture type 3) if there is one.
+type pictureChooser struct {
+	data  []byte
+	front bool
+}
+
+func (p *pictureChooser) add(kind int, data []byte) {
+	if len(data) == 0 || p.front {
+		return
+	}
+	if kind == 3 || p.data == nil {
+		p.data, p.front = data, kind == 3
+	}
+}
+
+func (p *pictureChooser) result() ([]byte, error) {
+	if p.data == nil {
+		return nil, errNoArt
+	}
+	return p.data, nil
+}
+
+// syncsafe reads a 28-bit ID3v2 integer, in which the top bit of each byte is unused.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// unsynchronise undoes ID3v2 unsynchronisation, which inserts a zero byte after each 0xff.
+func unsynchronise(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xff, 0x00}, []byte{0xff})
+}
+
+func id3Art(r io.Reader) ([]byte, error) {
+	header := make([]byte, 10)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	version, flags, size := header[3], header[5], syncsafe(header[6:])
+	if size > maxTagSize || version < 2 || version > 4 {
+		return nil, errNoArt
+	}
+	tag := make([]byte, size)
+	_, err = io.ReadFull(r, tag)
+	if err != nil {
+		return nil, err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		tag = unsynchronise(tag)
+	}
+	if flags&0x40 != 0 && version > 2 && len(tag) >= 4 {
+		// skip the extended header
+		n := int(binary.BigEndian.Uint32(tag)) + 4
+		if version == 4 {
+			n = syncsafe(tag)
+		}
+		if n < 0 || n > len(tag) {
+			return nil, errNoArt
+		}
+		tag = tag[n:]
+	}
+
+	var pics pictureChooser
+	for len(tag) > 0 {
+		var id string
+		var body []byte
+		if version == 2 {
+			if len(tag) < 6 {
+				break
+			}
+			id = string(tag[:3])
+			n := int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+			if n > len(tag)-6 {
+				break
+			}
+			body, tag = tag[6:6+n], tag[6+n:]
+		} else {
+			if len(tag) < 10 {
+				break
+			}
+			id = string(tag[:4])
+			n := int(binary.BigEndian.Uint32(tag[4:]))
+			if version == 4 {
+				n = syncsafe(tag[4:])
+			}
+			if n < 0 || n > len(tag)-10 {
+				break
+			}
+			frameFlags := tag[9]
+			body, tag = tag[10:10+n], tag[10+n:]
+			if version == 4 {
+				if frameFlags&0x0c != 0 {
+					// compressed or encrypted
+					continue
+				}
+				if frameFlags&0x40 != 0 && len(body) >= 1 {
+					// group identifier
+					body = body[1:]
+				}
+				if frameFlags&0x01 != 0 && len(body) >= 4 {
+					body = body[4:]
+				}
+				if frameFlags&0x02 != 0 || flags&0x80 != 0 {
+					body = unsynchronise(body)
+				}
+			} else if frameFlags&0xc0 != 0 {
+				continue
+			} else if frameFlags&0x20 != 0 && len(body) >= 1 {
+				// group identifier
+				body = body[1:]
+			}
+		}
+		if id[0] == 0 {
+			// padding
+			break
+		}
+		if id == "APIC" || id == "PIC" {
+			kind, data := apicFrame(body, version == 2)
+			pics.add(kind, data)
+		}
+	}
+	return pics.result()
+}
+
+// apicFrame reads the picture type and image from an ID3v2 APIC frame, or a PIC frame in ID3v2.2.
+func apicFrame(b []byte, v22 bool) (int, []byte) {
+	if len(b) < 2 {
+		return 0, nil
+	}
+	encoding := b[0]
+	b = b[1:]
+	if v22 {
+		// three character image format
+		if len(b) < 3 {
+			return 0, nil
+		}
+		b = b[3:]
+	} else {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return 0, nil
+		}
+		b = b[i+1:]
+	}
+	if len(b) < 1 {
+		return 0, nil
+	}
+	kind := int(b[0])
+	b = b[1:]
+	// skip the description, which ends with a null character of the frame's text encoding
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return kind, b[i+2:]
+			}
+		}
+		return 0, nil
+	}
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return 0, nil
+	}
+	return kind, b[i+1:]
+}
+
+// flacArt reads the PICTURE blocks of a FLAC file's metadata, which follows the "fLaC" marker.
+func flacArt(r io.Reader) ([]byte, error) {
+	var pics pictureChooser
+	read := 0
+	for {
+		header := make([]byte, 4)
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return nil, err
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7f
+		n := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		read += n
+		if read > maxTagSize {
+			break
+		}
+		if kind == 6 {
+			block := make([]byte, n)
+			_, err = io.ReadFull(r, block)
+			if err != nil {
+				return nil, err
+			}
+			pics.add(pictureBlock(block))
+		} else {
+			_, err = io.CopyN(io.Discard, r, int64(n))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if last {
+			break
+		}
+	}
+	return pics.result()
+}
+
+// pictureBlock reads the picture type and image from a FLAC PICTURE block, which is also how
+// pictures are stored in Vorbis comments.
+func pictureBlock(b []byte) (int, []byte) {
+	field := func() []byte {
+		if len(b) < 4 {
+			b = nil
+			return nil
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			b = nil
+			return nil
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v
+	}
+	if len(b) < 4 {
+		return 0, nil
+	}
+	kind := int(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	field() // MIME type
+	field() // description
+	if len(b) < 16 {
+		return 0, nil
+	}
+	// skip the width, height, colour depth and number of colours
+	b = b[16:]
+	return kind, field()
+}
+
+// oggArt reads the pictures in the comment header of an Ogg Vorbis or Opus file.
+func oggArt(r io.Reader) ([]byte, error) {
+	// the comment header is the second packet of the stream
+	var packet []byte
+	packets, read := 0, 0
+	for packets < 2 {
+		header := make([]byte, 27)
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(header[:4], []byte("OggS")) {
+			return nil, errNoArt
+		}
+		segments := make([]byte, header[26])
+		_, err = io.ReadFull(r, segments)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range segments {
+			seg := make([]byte, n)
+			_, err = io.ReadFull(r, seg)
+			if err != nil {
+				return nil, err
+			}
+			read += int(n)
+			if read > maxTagSize {
+				return nil, errNoArt
+			}
+			if packets == 1 {
+				packet = append(packet, seg...)
+			}
+			if n < 255 {
+				packets++
+				if packets == 2 {
+					break
+				}
+			}
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+		packet = packet[7:]
+	case bytes.HasPrefix(packet, []byte("OpusTags")):
+		packet = packet[8:]
+	default:
+		return nil, errNoArt
+	}
+	next := func() []byte {
+		if len(packet) < 4 {
+			packet = nil
+			return nil
+		}
+		n := binary.LittleEndian.Uint32(packet)
+		if uint64(n) > uint64(len(packet)-4) {
+			packet = nil
+			return nil
+		}
+		v := packet[4 : 4+n]
+		packet = packet[4+n:]
+		return v
+	}
+	next() // vendor
+	if len(packet) < 4 {
+		return nil, errNoArt
+	}
+	count := binary.LittleEndian.Uint32(packet)
+	packet = packet[4:]
+
+	var pics pictureChooser
+	for i := uint32(0); i < count && packet != nil; i++ {
+		key, value, found := strings.Cut(string(next()), "=")
+		if !found {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "METADATA_BLOCK_PICTURE":
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err == nil {
+				pics.add(pictureBlock(data))
+			}
+		case "COVERART":
+			// an older way of embedding art, without a picture type
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err == nil {
+				pics.add(0, data)
+			}
+		}
+	}
+	return pics.result()
+}
@@ -0,0 +1,320 @@
+package twedia
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Image data containing bytes which ID3v2 unsynchronisation changes.
+var testJPEG = []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 0xff, 0x00, 'J', 'F', 'I', 'F'}
+
+// synchronise applies ID3v2 unsynchronisation, inserting a zero byte after each 0xff.
+func synchronise(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xff}, []byte{0xff, 0x00})
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// id3Tag builds an ID3v2 tag holding `body`, which is the tag's frames.
+func id3Tag(version, flags byte, body []byte) []byte {
+	b := append([]byte{'I', 'D', '3', version, 0, flags}, syncsafeBytes(len(body))...)
+	return append(b, body...)
+}
+
+// id3Frame builds a frame of the given ID3v2 version.
+func id3Frame(version byte, id string, flags byte, body []byte) []byte {
+	b := []byte(id)
+	switch version {
+	case 2:
+		b = append(b, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	case 3:
+		b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+		b = append(b, 0, flags)
+	case 4:
+		b = append(b, syncsafeBytes(len(body))...)
+		b = append(b, 0, flags)
+	}
+	return append(b, body...)
+}
+
+// apic builds the body of an APIC frame, with a Latin-1 description.
+func apic(kind byte, data []byte) []byte {
+	b := append([]byte{0}, "image/jpeg\x00"...)
+	b = append(b, kind)
+	b = append(b, "desc\x00"...)
+	return append(b, data...)
+}
+
+func TestID3Art(t *testing.T) {
+	pic := []byte{0, 'J', 'P', 'G', 3, 0}
+	tests := []struct {
+		name string
+		tag  []byte
+		want []byte
+	}{
+		{"ID3v2.2", id3Tag(2, 0, id3Frame(2, "PIC", 0, append(pic, testJPEG...))), testJPEG},
+		{"ID3v2.3", id3Tag(3, 0, id3Frame(3, "APIC", 0, apic(3, testJPEG))), testJPEG},
+		{"ID3v2.4", id3Tag(4, 0, id3Frame(4, "APIC", 0, apic(3, testJPEG))), testJPEG},
+		{"front cover preferred", id3Tag(3, 0, append(id3Frame(3, "APIC", 0, apic(0, []byte("other"))), id3Frame(3, "APIC", 0, apic(3, testJPEG))...)), testJPEG},
+		{"first picture without a front cover", id3Tag(3, 0, append(id3Frame(3, "APIC", 0, apic(4, testJPEG)), id3Frame(3, "APIC", 0, apic(5, []byte("back")))...)), testJPEG},
+		{"other frames and padding", id3Tag(3, 0, append(append(id3Frame(3, "TIT2", 0, []byte("\x00Song")), id3Frame(3, "APIC", 0, apic(3, testJPEG))...), make([]byte, 20)...)), testJPEG},
+		{"unsynchronised ID3v2.3", id3Tag(3, 0x80, synchronise(id3Frame(3, "APIC", 0, apic(3, testJPEG)))), testJPEG},
+		{"unsynchronised ID3v2.4 tag", id3Tag(4, 0x80, id3Frame(4, "APIC", 0, synchronise(apic(3, testJPEG)))), testJPEG},
+		{"unsynchronised ID3v2.4 frame", id3Tag(4, 0, id3Frame(4, "APIC", 0x03, append(syncsafeBytes(len(apic(3, testJPEG))), synchronise(apic(3, testJPEG))...))), testJPEG},
+		{"ID3v2.4 group identifier", id3Tag(4, 0, id3Frame(4, "APIC", 0x40, append([]byte{1}, apic(3, testJPEG)...))), testJPEG},
+		{"ID3v2.3 group identifier", id3Tag(3, 0, id3Frame(3, "APIC", 0x20, append([]byte{1}, apic(3, testJPEG)...))), testJPEG},
+		{"ID3v2.3 extended header", id3Tag(3, 0x40, append([]byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0}, id3Frame(3, "APIC", 0, apic(3, testJPEG))...)), testJPEG},
+		{"ID3v2.4 extended header", id3Tag(4, 0x40, append([]byte{0, 0, 0, 6, 1, 0}, id3Frame(4, "APIC", 0, apic(3, testJPEG))...)), testJPEG},
+		{"compressed frame", id3Tag(3, 0, id3Frame(3, "APIC", 0x80, apic(3, testJPEG))), nil},
+		{"encrypted frame", id3Tag(4, 0, id3Frame(4, "APIC", 0x04, apic(3, testJPEG))), nil},
+		{"no pictures", id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Song"))), nil},
+		{"empty tag", id3Tag(3, 0, nil), nil},
+		{"unknown version", id3Tag(5, 0, id3Frame(4, "APIC", 0, apic(3, testJPEG))), nil},
+		{"oversized frame", id3Tag(3, 0, append([]byte("APIC\x00\x00\x10\x00\x00\x00"), apic(3, testJPEG)...)), nil},
+		{"frame size overflowing", id3Tag(3, 0, append([]byte("APIC\xff\xff\xff\xff\x00\x00"), apic(3, testJPEG)...)), nil},
+		{"oversized ID3v2.2 frame", id3Tag(2, 0, append([]byte("PIC\x7f\xff\xff"), pic...)), nil},
+		{"truncated frame header", id3Tag(3, 0, []byte("APIC\x00\x00")), nil},
+		{"oversized extended header", id3Tag(3, 0x40, []byte{0xff, 0xff, 0xff, 0xff, 0, 0}), nil},
+		{"oversized tag", append([]byte{'I', 'D', '3', 3, 0, 0, 0x7f, 0x7f, 0x7f, 0x7f}, make([]byte, 100)...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := id3Art(bytes.NewReader(tt.tag))
+			if !bytes.Equal(got, tt.want) || (err == nil) != (tt.want != nil) {
+				t.Errorf("got %x, %v; want %x", got, err, tt.want)
+			}
+		})
+	}
+
+	// a tag cut short by the end of the file
+	tag := id3Tag(3, 0, id3Frame(3, "APIC", 0, apic(3, testJPEG)))
+	for _, n := range []int{0, 5, 10, len(tag) - 1} {
+		_, err := id3Art(bytes.NewReader(tag[:n]))
+		if err == nil {
+			t.Errorf("read art from %d bytes of the tag", n)
+		}
+	}
+}
+
+func TestAPICFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		b    string
+		v22  bool
+		kind int
+		want string
+	}{
+		{"Latin-1", "\x00image/png\x00\x03desc\x00DATA", false, 3, "DATA"},
+		{"UTF-8", "\x03image/png\x00\x04d\xc3\xa9sc\x00DATA", false, 4, "DATA"},
+		{"UTF-16", "\x01image/png\x00\x03\xff\xfed\x00\x00\x00DATA", false, 3, "DATA"},
+		{"UTF-16 odd null", "\x02image/png\x00\x03\x00d\x00\x00DATA", false, 3, "DATA"},
+		{"ID3v2.2", "\x00PNG\x03\x00DATA", true, 3, "DATA"},
+		{"no image", "\x00image/png\x00\x03desc\x00", false, 3, ""},
+		{"empty", "", false, 0, ""},
+		{"only an encoding", "\x00", false, 0, ""},
+		{"unterminated MIME type", "\x00image/png", false, 0, ""},
+		{"no picture type", "\x00image/png\x00", false, 0, ""},
+		{"unterminated description", "\x00image/png\x00\x03desc", false, 0, ""},
+		{"unterminated UTF-16 description", "\x01image/png\x00\x03d\x00e\x00\x00", false, 0, ""},
+		{"short ID3v2.2 format", "\x00PN", true, 0, ""},
+		{"ID3v2.2 without a picture type", "\x00PNG", true, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, got := apicFrame([]byte(tt.b), tt.v22)
+			if kind != tt.kind || string(got) != tt.want {
+				t.Errorf("got %d, %q; want %d, %q", kind, got, tt.kind, tt.want)
+			}
+		})
+	}
+}
+
+// picture builds a FLAC PICTURE block.
+func picture(kind uint32, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, kind)
+	b = binary.BigEndian.AppendUint32(b, uint32(len("image/jpeg")))
+	b = append(b, "image/jpeg"...)
+	b = binary.BigEndian.AppendUint32(b, 4)
+	b = append(b, "desc"...)
+	b = append(b, make([]byte, 16)...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// flacBlock builds a FLAC metadata block.
+func flacBlock(last bool, kind byte, body []byte) []byte {
+	if last {
+		kind |= 0x80
+	}
+	b := []byte{kind, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(b, body...)
+}
+
+func TestFLACArt(t *testing.T) {
+	streamInfo := flacBlock(false, 0, make([]byte, 34))
+	tests := []struct {
+		name   string
+		blocks [][]byte
+		want   []byte
+	}{
+		{"picture", [][]byte{streamInfo, flacBlock(true, 6, picture(3, testJPEG))}, testJPEG},
+		{"front cover preferred", [][]byte{streamInfo, flacBlock(false, 6, picture(4, []byte("other"))), flacBlock(false, 6, picture(3, testJPEG)), flacBlock(true, 1, make([]byte, 10))}, testJPEG},
+		{"no pictures", [][]byte{flacBlock(true, 0, make([]byte, 34))}, nil},
+		{"broken picture", [][]byte{streamInfo, flacBlock(true, 6, []byte{0, 0, 0, 3, 0xff, 0xff, 0xff, 0xff})}, nil},
+		{"truncated block", [][]byte{streamInfo, flacBlock(true, 6, picture(3, testJPEG))[:20]}, nil},
+		{"oversized block", [][]byte{streamInfo, {0x06, 0xff, 0xff, 0xff}, picture(3, testJPEG)}, nil},
+		{"no last block", [][]byte{streamInfo}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := flacArt(bytes.NewReader(bytes.Join(tt.blocks, nil)))
+			if !bytes.Equal(got, tt.want) || (err == nil) != (tt.want != nil) {
+				t.Errorf("got %x, %v; want %x", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPictureBlock(t *testing.T) {
+	good := picture(3, testJPEG)
+	tests := []struct {
+		name string
+		b    []byte
+		kind int
+		want []byte
+	}{
+		{"picture", good, 3, testJPEG},
+		{"empty", nil, 0, nil},
+		{"only a type", good[:4], 0, nil},
+		{"truncated MIME type", good[:10], 0, nil},
+		{"truncated dimensions", good[:30], 0, nil},
+		{"truncated image", good[:len(good)-1], 3, nil},
+		{"oversized MIME type", append([]byte{0, 0, 0, 3, 0xff, 0xff, 0xff, 0xff}, good[8:]...), 0, nil},
+		{"oversized image", append(slices.Clone(good[:len(good)-len(testJPEG)-4]), 0xff, 0xff, 0xff, 0xfc), 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, got := pictureBlock(tt.b)
+			if kind != tt.kind || !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d, %x; want %d, %x", kind, got, tt.kind, tt.want)
+			}
+		})
+	}
+}
+
+// oggPages lays out packets in Ogg pages of at most `perPage` segments, so that a packet may
+// span several pages.
+func oggPages(perPage int, packets ...[]byte) []byte {
+	var lacing []byte
+	var data []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		data = append(data, p...)
+	}
+	var out []byte
+	for len(lacing) > 0 {
+		segs := lacing[:min(perPage, len(lacing))]
+		lacing = lacing[len(segs):]
+		header := make([]byte, 27)
+		copy(header, "OggS")
+		header[26] = byte(len(segs))
+		out = append(out, header...)
+		out = append(out, segs...)
+		for _, n := range segs {
+			out = append(out, data[:n]...)
+			data = data[n:]
+		}
+	}
+	return out
+}
+
+// vorbisComments builds a comment header, with `prefix` giving the codec.
+func vorbisComments(prefix string, comments ...string) []byte {
+	b := append([]byte(prefix), 6, 0, 0, 0)
+	b = append(b, "vendor"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(comments)))
+	for _, c := range comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
+
+func TestOggArt(t *testing.T) {
+	idHeader := []byte("\x01vorbis" + string(make([]byte, 23)))
+	big := bytes.Repeat(testJPEG, 10000)
+	block := "METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(picture(3, testJPEG))
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"Vorbis", oggPages(255, idHeader, vorbisComments("\x03vorbis", "TITLE=Song", block)), testJPEG},
+		{"Opus", oggPages(255, []byte("OpusHead"), vorbisComments("OpusTags", block)), testJPEG},
+		{"spanning pages", oggPages(255, idHeader, vorbisComments("\x03vorbis", "METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(picture(3, big)))), big},
+		{"spanning small pages", oggPages(3, idHeader, vorbisComments("\x03vorbis", "TITLE=Song", block)), testJPEG},
+		{"COVERART", oggPages(255, idHeader, vorbisComments("\x03vorbis", "coverart="+base64.StdEncoding.EncodeToString(testJPEG))), testJPEG},
+		{"front cover preferred", oggPages(255, idHeader, vorbisComments("\x03vorbis", "COVERART="+base64.StdEncoding.EncodeToString([]byte("other")), block)), testJPEG},
+		{"no pictures", oggPages(255, idHeader, vorbisComments("\x03vorbis", "TITLE=Song")), nil},
+		{"bad base64", oggPages(255, idHeader, vorbisComments("\x03vorbis", "METADATA_BLOCK_PICTURE=!!!")), nil},
+		{"unknown codec", oggPages(255, idHeader, vorbisComments("\x03theora", block)), nil},
+		{"too many comments", oggPages(255, idHeader, append([]byte("\x03vorbis\x00\x00\x00\x00"), 0xff, 0xff, 0xff, 0xff)), nil},
+		{"oversized comment", oggPages(255, idHeader, append(vorbisComments("\x03vorbis", block)[:21], 0xff, 0xff, 0xff, 0xff)), nil},
+		{"oversized vendor", oggPages(255, idHeader, []byte("\x03vorbis\xff\xff\xff\xff")), nil},
+		{"not Ogg", append(oggPages(255, idHeader), "RIFF"+string(make([]byte, 30))...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := oggArt(bytes.NewReader(tt.data))
+			if !bytes.Equal(got, tt.want) || (err == nil) != (tt.want != nil) {
+				t.Errorf("got %d bytes, %v; want %d bytes", len(got), err, len(tt.want))
+			}
+		})
+	}
+
+	// a stream cut short by the end of the file
+	data := oggPages(4, idHeader, vorbisComments("\x03vorbis", block))
+	for _, n := range []int{0, 10, 27, 40, len(data) - 1} {
+		_, err := oggArt(bytes.NewReader(data[:n]))
+		if err == nil {
+			t.Errorf("read art from %d bytes of the stream", n)
+		}
+	}
+}
+
+func TestEmbeddedArt(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"song.mp3":  id3Tag(3, 0, id3Frame(3, "APIC", 0, apic(3, testJPEG))),
+		"song.flac": append([]byte("fLaC"), flacBlock(true, 6, picture(3, testJPEG))...),
+		"song.ogg":  oggPages(255, []byte("OpusHead"), vorbisComments("OpusTags", "COVERART="+base64.StdEncoding.EncodeToString(testJPEG))),
+		"song.wav":  []byte("RIFF\x00\x00\x00\x00WAVE"),
+		"empty.mp3": nil,
+	}
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		err := os.WriteFile(fn, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := EmbeddedArt(fn)
+		if name == "song.wav" || name == "empty.mp3" {
+			if err != errNoArt {
+				t.Errorf("%s: got %x, %v", name, got, err)
+			}
+		} else if err != nil || !bytes.Equal(got, testJPEG) {
+			t.Errorf("%s: got %x, %v", name, got, err)
+		}
+	}
+}
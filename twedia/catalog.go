@@ -0,0 +1,174 @@
+package twedia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// catalogClient fetches song collections over HTTP(S).
+var catalogClient = &http.Client{Timeout: 10 * time.Second}
+
+// CatalogLoader loads the song collection from a URL or file, and loads it
+// again whenever asked, reporting whether it has changed. The last collection loaded is kept in
+// `CacheFile`, which is used if the collection cannot be fetched when twedia starts; for HTTP
+// sources, it also lets the collection be downloaded again only once it has changed.
+type CatalogLoader struct {
+	Source    string
+	CacheFile string
+
+	mu sync.Mutex
+	// The collection last loaded, if there is one.
+	cache *catalogCache
+}
+
+// catalogCache is a copy of the song collection, along with what is needed to ask a web server whether it has changed.
+type catalogCache struct {
+	Source       string    `json:"source"`
+	Saved        time.Time `json:"saved"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	// The collection as it was fetched, which may be JSON or a playlist.
+	Data []byte `json:"data"`
+	// The collection, in caches saved before playlists could be used, when it was always JSON.
+	Songs json.RawMessage `json:"songs,omitempty"`
+}
+
+// Load returns the song collection, or nil if it has not changed since it was last loaded.
+func (c *CatalogLoader) Load() (*Music, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first := c.cache == nil
+	if first {
+		c.cache = c.readCache()
+	}
+
+	fetched, err := c.fetch()
+	if err == nil && fetched == nil && !first {
+		return nil, nil
+	}
+	if err == nil && fetched != nil && !first && bytes.Equal(fetched.Data, c.cache.Data) {
+		c.cache = fetched
+		c.writeCache()
+		return nil, nil
+	}
+
+	var m Music
+	if err == nil && fetched != nil {
+		err = parseSongs(&m, c.Source, fetched.Data)
+		if err == nil {
+			c.cache = fetched
+			c.writeCache()
+			return &m, nil
+		}
+	} else if err == nil {
+		// the server says that the cached copy is up to date
+		err = parseSongs(&m, c.Source, c.cache.Data)
+		return &m, err
+	}
+
+	// fall back on the copy of the collection loaded last time twedia ran
+	if !first || c.cache == nil {
+		return nil, err
+	}
+	l.Warn("Unable to load the song collection, so using the copy saved "+c.cache.Saved.Format(time.DateTime), "err", err)
+	m = Music{}
+	err = parseSongs(&m, c.Source, c.cache.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// fetch loads the collection from its source, returning nil if the cached copy is still up to date.
+func (c *CatalogLoader) fetch() (*catalogCache, error) {
+	fetched := &catalogCache{Source: c.Source, Saved: time.Now()}
+	if !strings.HasPrefix(c.Source, "http") {
+		data, err := getSongsFile(c.Source)
+		if err != nil {
+			return nil, errors.New("unable to retrieve song collection from file `" + c.Source + "`: " + err.Error())
+		}
+		fetched.Data = data
+		return fetched, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.cache != nil {
+		if c.cache.ETag != "" {
+			req.Header.Set("If-None-Match", c.cache.ETag)
+		}
+		if c.cache.LastModified != "" {
+			req.Header.Set("If-Modified-Since", c.cache.LastModified)
+		}
+	}
+	res, err := catalogClient.Do(req)
+	if err != nil {
+		return nil, errors.New("unable to retrieve song collection over HTTP(S) from " + c.Source + ": " + err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && c.cache != nil {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to retrieve song collection over HTTP(S) from " + c.Source + ": " + res.Status)
+	}
+	fetched.Data, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	fetched.ETag = res.Header.Get("ETag")
+	fetched.LastModified = res.Header.Get("Last-Modified")
+	return fetched, nil
+}
+
+// readCache loads the cached copy of the collection, if there is one for the same source.
+func (c *CatalogLoader) readCache() *catalogCache {
+	if c.CacheFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.CacheFile)
+	if err != nil {
+		return nil
+	}
+	var cache catalogCache
+	err = json.Unmarshal(data, &cache)
+	if err == nil && len(cache.Data) == 0 {
+		cache.Data, cache.Songs = cache.Songs, nil
+	}
+	if err != nil || cache.Source != c.Source || len(cache.Data) == 0 {
+		return nil
+	}
+	return &cache
+}
+
+// writeCache saves the collection, replacing the previous copy only once the new one is complete.
+func (c *CatalogLoader) writeCache() {
+	if c.CacheFile == "" {
+		return
+	}
+	data, err := json.Marshal(c.cache)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.CacheFile), 0755)
+	}
+	if err == nil {
+		tmp := c.CacheFile + ".tmp"
+		err = os.WriteFile(tmp, data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, c.CacheFile)
+		}
+	}
+	if err != nil {
+		l.Warn("Unable to save a copy of the song collection", "err", err)
+	}
+}
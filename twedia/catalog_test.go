@@ -0,0 +1,127 @@
+package twedia
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testCatalog is a song collection of `n` songs by one artist.
+func testCatalog(n int) string {
+	songs := strings.Repeat(`{"title": "Song", "url": ""},`, n)
+	return `{"artists": [{"artist": "Artist", "albums": [{"name": "Album", "songs": [` + strings.TrimSuffix(songs, ",") + `]}]}]}`
+}
+
+// catalogServer serves a song collection with an ETag, which may be changed or made to fail.
+type catalogServer struct {
+	mu          sync.Mutex
+	body, etag  string
+	status      int
+	conditional int
+}
+
+func (s *catalogServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") != "" {
+		s.conditional++
+		if r.Header.Get("If-None-Match") == s.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(s.body))
+}
+
+func (s *catalogServer) set(body, etag string, status int) {
+	s.mu.Lock()
+	s.body, s.etag, s.status = body, etag, status
+	s.mu.Unlock()
+}
+
+func TestCatalogLoader(t *testing.T) {
+	cs := &catalogServer{body: testCatalog(2), etag: `"1"`}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+	cacheFile := filepath.Join(t.TempDir(), "catalog-cache.json")
+	c := &CatalogLoader{Source: srv.URL + "/music.json", CacheFile: cacheFile}
+
+	m, err := c.Load()
+	if err != nil || m == nil || m.TotalSongs != 2 {
+		t.Fatalf("got %+v, %v", m, err)
+	}
+	m, err = c.Load()
+	if err != nil || m != nil {
+		t.Errorf("got %+v, %v when nothing changed", m, err)
+	}
+	if cs.conditional != 1 {
+		t.Errorf("made %d conditional requests", cs.conditional)
+	}
+	cs.set(testCatalog(3), `"2"`, 0)
+	m, err = c.Load()
+	if err != nil || m == nil || m.TotalSongs != 3 {
+		t.Errorf("got %+v, %v after a change", m, err)
+	}
+
+	// with the server down, the saved copy is used when starting, but not once running
+	cs.set("", "", http.StatusInternalServerError)
+	m, err = c.Load()
+	if err == nil || m != nil {
+		t.Errorf("got %+v, %v when refreshing", m, err)
+	}
+	m, err = (&CatalogLoader{Source: c.Source, CacheFile: cacheFile}).Load()
+	if err != nil || m == nil || m.TotalSongs != 3 {
+		t.Errorf("got %+v, %v from the saved copy", m, err)
+	}
+	_, err = (&CatalogLoader{Source: c.Source}).Load()
+	if err == nil || !strings.Contains(err.Error(), "unable to retrieve song collection over HTTP(S)") {
+		t.Errorf("got error %v without a saved copy", err)
+	}
+}
+
+func TestGetSongs(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "music.json")
+	err := os.WriteFile(fn, []byte(testCatalog(2)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Music
+	err = GetSongs(&m, fn)
+	if err != nil || m.TotalSongs != 2 {
+		t.Errorf("got %d songs, %v", m.TotalSongs, err)
+	}
+
+	err = GetSongs(&m, filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil || !strings.Contains(err.Error(), "unable to retrieve song collection from file") {
+		t.Errorf("got error %v", err)
+	}
+	cs := &catalogServer{status: http.StatusNotFound}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+	err = GetSongs(&m, srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "unable to retrieve song collection over HTTP(S)") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestCatalogLoaderOldCache(t *testing.T) {
+	// a copy saved before the cache could hold playlists
+	cacheFile := filepath.Join(t.TempDir(), "catalog-cache.json")
+	err := os.WriteFile(cacheFile, []byte(`{"source": "missing.json", "saved": "2024-01-02T03:04:05Z", "songs": `+testCatalog(2)+`}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := (&CatalogLoader{Source: "missing.json", CacheFile: cacheFile}).Load()
+	if err != nil || m == nil || m.TotalSongs != 2 {
+		t.Errorf("got %+v, %v", m, err)
+	}
+}
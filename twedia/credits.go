@@ -0,0 +1,153 @@
+package twedia
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var linkOrder = struct {
+	sync.Mutex
+	sites []string
+}{sites: []string{"youtube", "bandcamp", "spotify"}}
+
+// Display names of the sites songs are commonly linked to, by their key in Song.Links.
+var siteNames = map[string]string{
+	"youtube":    "YouTube",
+	"bandcamp":   "Bandcamp",
+	"spotify":    "Spotify",
+	"soundcloud": "SoundCloud",
+	"applemusic": "Apple Music",
+	"deezer":     "Deezer",
+	"tidal":      "Tidal",
+}
+
+// Hosts of the sites in siteNames, for working out where a song's `url` goes.
+var siteHosts = map[string]string{
+	"youtube.com":     "youtube",
+	"youtu.be":        "youtube",
+	"bandcamp.com":    "bandcamp",
+	"spotify.com":     "spotify",
+	"soundcloud.com":  "soundcloud",
+	"music.apple.com": "applemusic",
+	"deezer.com":      "deezer",
+	"tidal.com":       "tidal",
+}
+
+// SetLinkOrder sets which of a song's links is preferred, by site, e.g. "bandcamp" then "youtube".
+// Sites not listed are used after those which are, in alphabetical order.
+func SetLinkOrder(sites []string) {
+	linkOrder.Lock()
+	defer linkOrder.Unlock()
+	if len(sites) > 0 {
+		linkOrder.sites = sites
+	}
+}
+
+// SiteName returns the name to show for a site given as a key of Song.Links, e.g. "YouTube".
+func SiteName(site string) string {
+	if name, ok := siteNames[strings.ToLower(site)]; ok {
+		return name
+	}
+	if site == "" {
+		return ""
+	}
+	return strings.ToUpper(site[:1]) + site[1:]
+}
+
+// siteOf works out which site a URL belongs to, returning "" if it is not a known one.
+func siteOf(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	for h, site := range siteHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return site
+		}
+	}
+	return ""
+}
+
+// Link returns the best link to the song, and the name of the site it is on (which is empty if
+// the site is not known), going by the order set with SetLinkOrder. The song's `url` is used if
+// none of its `links` are set.
+func (s *Song) Link() (site, link string) {
+	linkOrder.Lock()
+	order := linkOrder.sites
+	linkOrder.Unlock()
+
+	for _, key := range order {
+		for k, v := range s.Links {
+			if strings.EqualFold(k, key) && v != "" {
+				return SiteName(k), v
+			}
+		}
+	}
+	keys := make([]string, 0, len(s.Links))
+	for k, v := range s.Links {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		return SiteName(keys[0]), s.Links[keys[0]]
+	}
+	if s.URL != "" {
+		return SiteName(siteOf(s.URL)), s.URL
+	}
+	return "", ""
+}
+
+// Creative Commons licence names, such as "CC BY 4.0" or "CC-BY-SA-3.0".
+var ccLicense = regexp.MustCompile(`(?i)^cc[ -]?(by(?:-(?:nc|sa|nd))*)(?:[ -]v?(\d\.\d))?$`)
+
+// ccLicenseDeed returns the usual name of a Creative Commons licence, such as "CC BY-SA 4.0", and
+// the address of its deed, or two empty strings if `license` is not one.
+func ccLicenseDeed(license string) (string, string) {
+	license = strings.TrimSpace(license)
+	if strings.EqualFold(license, "CC0") || strings.EqualFold(license, "CC0 1.0") {
+		return "CC0 1.0", "https://creativecommons.org/publicdomain/zero/1.0/"
+	}
+	m := ccLicense.FindStringSubmatch(license)
+	if m == nil {
+		return "", ""
+	}
+	version := m[2]
+	if version == "" {
+		version = "4.0"
+	}
+	return "CC " + strings.ToUpper(m[1]) + " " + version, "https://creativecommons.org/licenses/" + strings.ToLower(m[1]) + "/" + version + "/"
+}
+
+// SongLicense returns the licence the song is used under, which may be given for its album instead.
+func SongLicense(album *Album, song *Song) string {
+	if song.License != "" {
+		return song.License
+	}
+	return album.License
+}
+
+// Credit returns the attribution line the song's licence asks for, or "" if it has no licence.
+// A Creative Commons licence name is turned into a line giving the title, the artist and the
+// licence, with a link to it; any other licence text is used as it is.
+func Credit(artist *Artist, album *Album, song *Song) string {
+	license := SongLicense(album, song)
+	name, u := ccLicenseDeed(license)
+	if u == "" {
+		return license
+	}
+	by := artist.Artist
+	if len(song.Featuring) > 0 {
+		by += " feat. " + strings.Join(song.Featuring, ", ")
+	}
+	if strings.HasPrefix(name, "CC0") {
+		return fmt.Sprintf("\"%s\" by %s is dedicated to the public domain (%s: %s)", song.Title, by, name, u)
+	}
+	return fmt.Sprintf("\"%s\" by %s is licensed under %s (%s)", song.Title, by, name, u)
+}
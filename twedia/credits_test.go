@@ -0,0 +1,39 @@
+package twedia
+
+import "testing"
+
+func TestCredit(t *testing.T) {
+	tests := []struct {
+		name      string
+		featuring []string
+		song      string
+		album     string
+		want      string
+	}{
+		{"no licence", nil, "", "", ""},
+		{"CC BY", nil, "CC BY 4.0", "", `"Café Song" by Artist is licensed under CC BY 4.0 (https://creativecommons.org/licenses/by/4.0/)`},
+		{"album licence", nil, "", "cc-by-sa-3.0", `"Café Song" by Artist is licensed under CC BY-SA 3.0 (https://creativecommons.org/licenses/by-sa/3.0/)`},
+		{"song over album", nil, "CC BY-NC", "CC BY 4.0", `"Café Song" by Artist is licensed under CC BY-NC 4.0 (https://creativecommons.org/licenses/by-nc/4.0/)`},
+		{"CC0", []string{"Guest", "Other"}, "CC0", "", `"Café Song" by Artist feat. Guest, Other is dedicated to the public domain (CC0 1.0: https://creativecommons.org/publicdomain/zero/1.0/)`},
+		{"other licence", nil, "Used with permission", "", "Used with permission"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			artist := &Artist{Artist: "Artist"}
+			album := &Album{License: tt.album}
+			song := &Song{Title: "Café Song", Featuring: tt.featuring, License: tt.song}
+			if got := Credit(artist, album, song); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreditQuotes(t *testing.T) {
+	// the title is shown as it is, without escaping
+	song := &Song{Title: `The "Best" Song\`, License: "CC BY 4.0"}
+	want := `"The "Best" Song\" by Artist is licensed under CC BY 4.0 (https://creativecommons.org/licenses/by/4.0/)`
+	if got := Credit(&Artist{Artist: "Artist"}, &Album{}, song); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
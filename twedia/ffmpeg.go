@@ -0,0 +1,319 @@
+package twedia
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+const (
+	// How much audio ffmpeg may decode ahead of what is being played.
+	ffmpegBuffer = 5 * time.Second
+	// How long ffmpeg may take to start producing audio.
+	ffmpegStartTimeout = 30 * time.Second
+)
+
+// ffmpegDecoder plays audio which ffmpeg decodes as it goes, streaming raw samples from its
+// output. Seeking starts ffmpeg again from the new position.
+type ffmpegDecoder struct {
+	name string
+
+	mu sync.Mutex
+	// Signalled when samples are taken from `buf`, or the run of ffmpeg changes.
+	more *sync.Cond
+	// Counts the runs of ffmpeg; a run which is no longer current stops.
+	run    int
+	proc   *os.Process
+	length int
+	// Samples which have been decoded, but not yet played, starting at `pos`.
+	buf   [][2]float64
+	pos   int
+	ended bool
+	err   error
+}
+
+// decodeFFmpeg has ffmpeg decode the file (which it fetches itself, if it is remote), and
+// returns once the first of its audio is ready.
+func decodeFFmpeg(f source) (beep.StreamSeekCloser, beep.Format, error) {
+	f.Close()
+	format := beep.Format{SampleRate: sampleRate, NumChannels: 2, Precision: 2}
+	d := &ffmpegDecoder{name: f.Name()}
+	d.more = sync.NewCond(&d.mu)
+
+	d.mu.Lock()
+	run := d.restart(0)
+	d.mu.Unlock()
+	header, data := make(chan struct{}), make(chan struct{})
+	go d.play(run, 0, header, data)
+
+	timeout := time.After(ffmpegStartTimeout)
+	for _, ch := range []chan struct{}{header, data} {
+		select {
+		case <-ch:
+		case <-timeout:
+			d.Close()
+			return nil, format, errors.New("ffmpeg took too long to start decoding " + d.name)
+		}
+	}
+	d.mu.Lock()
+	err := d.err
+	d.mu.Unlock()
+	if err != nil {
+		d.Close()
+		return nil, format, err
+	}
+	return d, format, nil
+}
+
+// restart discards what has been decoded, and stops ffmpeg, so that another run may start from
+// `from`, whose number it returns. The caller must hold the lock.
+func (d *ffmpegDecoder) restart(from int) int {
+	d.run++
+	if d.proc != nil {
+		d.proc.Kill()
+		d.proc = nil
+	}
+	d.buf, d.pos, d.ended, d.err = nil, from, false, nil
+	d.more.Broadcast()
+	return d.run
+}
+
+// play runs ffmpeg from the sample `from`, adding what it decodes to the buffer until it
+// finishes or another run starts. `header` (if not nil) is closed once the file's length is
+// known, and `data` (if not nil) once the first audio is ready; both are closed if ffmpeg fails.
+func (d *ffmpegDecoder) play(run, from int, header, data chan struct{}) {
+	headerDone := sync.OnceFunc(func() {
+		if header != nil {
+			close(header)
+		}
+	})
+	dataReady := sync.OnceFunc(func() {
+		if data != nil {
+			close(data)
+		}
+	})
+	defer headerDone()
+	defer dataReady()
+
+	args := []string{"-hide_banner", "-nostdin", "-nostats"}
+	if from > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(sampleRate.D(from).Seconds(), 'f', 3, 64))
+	}
+	args = append(args, "-i", d.name, "-vn", "-ar", strconv.Itoa(int(sampleRate)), "-ac", "2", "-c:a", "pcm_s16le", "-f", "s16le", "-")
+	cmd := exec.Command(ffmpegPath, args...)
+	stderr := &ffmpegLog{}
+	if header != nil {
+		stderr.header = func(length time.Duration) {
+			d.mu.Lock()
+			d.length = sampleRate.N(length)
+			d.mu.Unlock()
+			headerDone()
+		}
+	}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			err = errors.New("ffmpeg is needed to play " + d.name)
+		}
+		d.finish(run, err)
+		return
+	}
+
+	d.mu.Lock()
+	if run != d.run {
+		d.mu.Unlock()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	d.proc = cmd.Process
+	d.mu.Unlock()
+
+	r := bufio.NewReader(stdout)
+	chunk := make([]byte, 4096)
+	limit := sampleRate.N(ffmpegBuffer)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if samples := pcmSamples(chunk[:n-n%4]); len(samples) > 0 {
+			d.mu.Lock()
+			for run == d.run && len(d.buf) >= limit {
+				d.more.Wait()
+			}
+			if run != d.run {
+				d.mu.Unlock()
+				break
+			}
+			d.buf = append(d.buf, samples...)
+			d.mu.Unlock()
+			dataReady()
+		}
+		if err != nil {
+			break
+		}
+	}
+	err = cmd.Wait()
+	if err != nil {
+		err = errors.New("ffmpeg could not decode " + d.name + ": " + stderr.last())
+	}
+	d.finish(run, err)
+}
+
+// finish records that a run of ffmpeg has ended, with `err` if it failed.
+func (d *ffmpegDecoder) finish(run int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if run != d.run {
+		return
+	}
+	d.proc = nil
+	d.ended, d.err = true, err
+}
+
+// Stream plays what ffmpeg has decoded. If ffmpeg has fallen behind, silence is played until it
+// catches up, rather than holding up the rest of the audio.
+func (d *ffmpegDecoder) Stream(samples [][2]float64) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := copy(samples, d.buf)
+	d.buf = d.buf[n:]
+	d.pos += n
+	if n > 0 {
+		d.more.Broadcast()
+	}
+	if d.ended {
+		return n, n > 0
+	}
+	clear(samples[n:])
+	return len(samples), true
+}
+
+func (d *ffmpegDecoder) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+func (d *ffmpegDecoder) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.length
+}
+
+func (d *ffmpegDecoder) Position() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pos
+}
+
+func (d *ffmpegDecoder) Seek(p int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p < 0 || (d.length > 0 && p > d.length) {
+		return errors.New("ffmpeg: seek position out of range")
+	}
+	run := d.restart(p)
+	go d.play(run, p, nil, nil)
+	return nil
+}
+
+func (d *ffmpegDecoder) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// keep any error from decoding, which the player reads once the song has ended
+	err := d.err
+	d.restart(0)
+	d.ended, d.err = true, err
+	return nil
+}
+
+// pcmSamples converts signed 16-bit little-endian stereo audio to samples.
+func pcmSamples(b []byte) [][2]float64 {
+	samples := make([][2]float64, len(b)/4)
+	for i := range samples {
+		samples[i][0] = float64(int16(binary.LittleEndian.Uint16(b[4*i:]))) / -math.MinInt16
+		samples[i][1] = float64(int16(binary.LittleEndian.Uint16(b[4*i+2:]))) / -math.MinInt16
+	}
+	return samples
+}
+
+// ffmpegLog reads what ffmpeg writes to stderr: the input's length, which it passes to `header`
+// (if not nil), and any error.
+type ffmpegLog struct {
+	mu       sync.Mutex
+	header   func(time.Duration)
+	partial  []byte
+	lastLine string
+}
+
+func (l *ffmpegLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexAny(l.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(l.partial[:i]))
+		l.partial = l.partial[i+1:]
+		if line == "" {
+			continue
+		}
+		l.lastLine = line
+		if l.header == nil {
+			continue
+		}
+		// the first Duration line is the input's; an output starting means there was none
+		if rest, found := strings.CutPrefix(line, "Duration: "); found {
+			length, _ := parseFFmpegTime(strings.SplitN(rest, ",", 2)[0])
+			l.header(length)
+			l.header = nil
+		} else if strings.HasPrefix(line, "Output #") {
+			l.header(0)
+			l.header = nil
+		}
+	}
+	return len(p), nil
+}
+
+// last returns the last line ffmpeg wrote, which describes any error.
+func (l *ffmpegLog) last() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if line := strings.TrimSpace(string(l.partial)); line != "" {
+		return line
+	}
+	return l.lastLine
+}
+
+// parseFFmpegTime parses a time in the form ffmpeg gives them, HH:MM:SS.ss.
+func parseFFmpegTime(s string) (time.Duration, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	var d time.Duration
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		d += time.Duration(n * float64(time.Second) * math.Pow(60, float64(2-i)))
+	}
+	return d, true
+}
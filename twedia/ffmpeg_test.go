@@ -0,0 +1,172 @@
+package twedia
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg uses a shell script in place of ffmpeg for the rest of the test.
+func fakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "ffmpeg")
+	err := os.WriteFile(fn, []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := ffmpegPath
+	ffmpegPath = fn
+	t.Cleanup(func() { ffmpegPath = old })
+}
+
+// testSource is a file which decodeFFmpeg can be given.
+func testSource(t *testing.T) source {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "song.opus")
+	err := os.WriteFile(fn, []byte("OggS"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// streamAll plays the decoder to its end, returning how many samples it gave.
+func streamAll(t *testing.T, d *ffmpegDecoder) int {
+	t.Helper()
+	total := 0
+	buf := make([][2]float64, 1000)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		before := d.Position()
+		n, ok := d.Stream(buf)
+		if !ok {
+			return total
+		}
+		// silence while waiting for ffmpeg does not count
+		total += d.Position() - before
+		if n == len(buf) && d.Position() == before {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	t.Fatal("the decoder did not end")
+	return 0
+}
+
+func TestFFmpegDecoder(t *testing.T) {
+	// a second of audio, or whatever is left of it after seeking
+	fakeFFmpeg(t, `
+echo "Input #0, ogg, from 'x':" >&2
+echo "  Duration: 00:00:01.00, start: 0.000000, bitrate: 1 kb/s" >&2
+echo "Output #0, s16le, to 'pipe:':" >&2
+case "$*" in
+*"-ss 0.500"*) head -c 96000 /dev/zero ;;
+*) head -c 192000 /dev/zero ;;
+esac
+`)
+	s, format, err := decodeFFmpeg(testSource(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	d := s.(*ffmpegDecoder)
+	if format.SampleRate != sampleRate || format.NumChannels != 2 {
+		t.Errorf("format is %+v", format)
+	}
+	if d.Len() != sampleRate.N(time.Second) {
+		t.Errorf("length is %d", d.Len())
+	}
+	if n := streamAll(t, d); n != sampleRate.N(time.Second) {
+		t.Errorf("played %d samples", n)
+	}
+	if d.Err() != nil {
+		t.Error(d.Err())
+	}
+
+	err = d.Seek(sampleRate.N(500 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := d.Position(); pos != sampleRate.N(500*time.Millisecond) {
+		t.Errorf("position is %d after seeking", pos)
+	}
+	if n := streamAll(t, d); n != sampleRate.N(500*time.Millisecond) {
+		t.Errorf("played %d samples after seeking", n)
+	}
+	if d.Seek(-1) == nil {
+		t.Error("seeking before the start succeeded")
+	}
+}
+
+func TestFFmpegDecoderFails(t *testing.T) {
+	fakeFFmpeg(t, `
+echo "x: Invalid data found when processing input" >&2
+exit 1
+`)
+	_, _, err := decodeFFmpeg(testSource(t))
+	if err == nil || !strings.Contains(err.Error(), "Invalid data found when processing input") {
+		t.Errorf("got error %v", err)
+	}
+
+	ffmpegPath = filepath.Join(t.TempDir(), "missing")
+	_, _, err = decodeFFmpeg(testSource(t))
+	if err == nil || !strings.Contains(err.Error(), "ffmpeg is needed") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestFFmpegDecoderClose(t *testing.T) {
+	// ffmpeg keeps decoding until it is stopped
+	fakeFFmpeg(t, `
+echo "  Duration: N/A, start: 0.000000, bitrate: N/A" >&2
+exec cat /dev/zero
+`)
+	s, _, err := decodeFFmpeg(testSource(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := s.(*ffmpegDecoder)
+	if d.Len() != 0 {
+		t.Errorf("length is %d for a stream", d.Len())
+	}
+	buf := make([][2]float64, 1000)
+	if n, ok := d.Stream(buf); n != len(buf) || !ok {
+		t.Errorf("got %d, %v", n, ok)
+	}
+	d.Close()
+	if _, ok := d.Stream(buf); ok {
+		t.Error("streamed after closing")
+	}
+}
+
+func TestParseFFmpegTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"00:03:25.34", 3*time.Minute + 25340*time.Millisecond, true},
+		{"01:00:00.00", time.Hour, true},
+		{"N/A", 0, false},
+		{"00:xx:01", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseFFmpegTime(tt.s)
+		if ok != tt.ok || (got-tt.want).Abs() > time.Millisecond {
+			t.Errorf("parseFFmpegTime(%q) = %v, %v; want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPCMSamples(t *testing.T) {
+	got := pcmSamples([]byte{0x00, 0x80, 0xff, 0x7f, 0x00, 0x00, 0x00, 0x40, 0x01})
+	want := [][2]float64{{-1, 32767.0 / 32768}, {0, 0.5}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
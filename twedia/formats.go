@@ -0,0 +1,113 @@
+package twedia
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/flac"
+	"github.com/faiface/beep/mp3"
+	"github.com/faiface/beep/vorbis"
+	"github.com/faiface/beep/wav"
+)
+
+// audioFormat is a kind of audio file which can be played.
+type audioFormat struct {
+	name string
+	// File extensions, in lower case, used to find files and as a fallback when the content is not recognised.
+	extensions []string
+	// Reports whether the start of a file is that of this format.
+	magic  func(head []byte) bool
+	decode func(f source) (beep.StreamSeekCloser, beep.Format, error)
+}
+
+// formats lists every format which can be played, in the order their magic bytes are checked.
+var formats = []audioFormat{
+	{"WAV", []string{".wav"}, isWAV, func(f source) (beep.StreamSeekCloser, beep.Format, error) { return wav.Decode(f) }},
+	{"FLAC", []string{".flac"}, isFLAC, func(f source) (beep.StreamSeekCloser, beep.Format, error) { return flac.Decode(f) }},
+	{"Ogg Vorbis", []string{".ogg", ".oga"}, isVorbis, func(f source) (beep.StreamSeekCloser, beep.Format, error) { return vorbis.Decode(f) }},
+	{"Opus", []string{".opus"}, isOpus, decodeFFmpeg},
+	{"AAC", []string{".m4a", ".aac", ".mp4"}, isAAC, decodeFFmpeg},
+	{"MP3", []string{".mp3"}, isMP3, func(f source) (beep.StreamSeekCloser, beep.Format, error) { return mp3.Decode(f) }},
+}
+
+// ffmpeg executable used to decode formats which cannot be decoded natively.
+var ffmpegPath = "ffmpeg"
+
+// SetFFmpeg sets the ffmpeg executable used to play Opus and AAC files.
+func SetFFmpeg(path string) {
+	if path != "" {
+		ffmpegPath = path
+	}
+}
+
+// Extensions lists the file extensions of every format which can be played.
+func Extensions() []string {
+	var exts []string
+	for _, f := range formats {
+		exts = append(exts, f.extensions...)
+	}
+	return exts
+}
+
+// IsAudioFile reports whether a file's extension is that of a format which can be played.
+func IsAudioFile(fn string) bool {
+	return formatByExtension(fn) != nil
+}
+
+func formatByExtension(fn string) *audioFormat {
+	ext := strings.ToLower(filepath.Ext(fn))
+	for i, f := range formats {
+		for _, e := range f.extensions {
+			if ext == e {
+				return &formats[i]
+			}
+		}
+	}
+	return nil
+}
+
+// detectFormat works out the format of a file from its first bytes, falling back to its extension.
+func detectFormat(fn string, head []byte) *audioFormat {
+	for i, f := range formats {
+		if f.magic(head) {
+			return &formats[i]
+		}
+	}
+	return formatByExtension(fn)
+}
+
+func isWAV(b []byte) bool {
+	return len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WAVE"
+}
+
+func isFLAC(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("fLaC"))
+}
+
+// The first packet of an Ogg stream, which names its codec, starts straight after the first page's
+// header, which has a single segment in files made by common encoders.
+func isVorbis(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("OggS")) && bytes.Contains(b[:min(len(b), 64)], []byte("\x01vorbis"))
+}
+
+func isOpus(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("OggS")) && bytes.Contains(b[:min(len(b), 64)], []byte("OpusHead"))
+}
+
+// AAC comes either in an MP4 container, or as a raw ADTS stream, whose frames start with a
+// sync word like MP3's, but with the layer bits (which MP3 never leaves zero) unset.
+func isAAC(b []byte) bool {
+	if len(b) >= 8 && string(b[4:8]) == "ftyp" {
+		return true
+	}
+	return len(b) >= 2 && b[0] == 0xFF && b[1]&0xF6 == 0xF0
+}
+
+func isMP3(b []byte) bool {
+	if bytes.HasPrefix(b, []byte("ID3")) {
+		return true
+	}
+	return len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0 && b[1]&0x06 != 0
+}
@@ -3,96 +3,198 @@ package twedia
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
+	"sort"
 	"strings"
-	"time"
 )
 
-// Song is a structure storing the song title and YouTube URL of a song, both as a string.
+// Attributes are optional settings which may be given for an artist, album or song. A song's own
+// settings take priority over its album's, which take priority over its artist's.
+type Attributes struct {
+	// Relative likelihood of being chosen at random; defaults to 1. The weights of a song, its
+	// album and its artist are multiplied together.
+	Weight *float64 `json:"weight,omitempty"`
+	// Tags, such as "chill", which may be used to choose which music is played. A song has the
+	// tags of its album and artist as well as its own.
+	Tags []string `json:"tags,omitempty"`
+	// Whether the music may be played on stream without the VOD being muted.
+	VODSafe *bool `json:"vodSafe,omitempty"`
+	// Whether the music is only played when asked for, and never chosen at random.
+	ExcludeFromRandom *bool `json:"excludeFromRandom,omitempty"`
+}
+
+// Song is a structure storing the details of a song: its title and where to find it, along with
+// anything known about who made it and how it may be used.
 type Song struct {
 	Title string `json:"title"`
-	URL   string `json:"url"`
+	// Link to the song, used when it has no `links`.
+	URL string `json:"url"`
+	// Links to the song, by site, e.g. "youtube", "bandcamp" or "spotify"; see Link.
+	Links map[string]string `json:"links,omitempty"`
+	// Position of the song on its album, starting at 1.
+	Track int `json:"track,omitempty"`
+	// Length of the song, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+	Composer string  `json:"composer,omitempty"`
+	// Other artists who appear on the song.
+	Featuring []string `json:"featuring,omitempty"`
+	// Licence the song is used under, such as "CC BY 4.0", or the attribution text it asks for.
+	License string `json:"license,omitempty"`
+	// Path or URL of the song's cover art, if it differs from its album's.
+	Art string `json:"art,omitempty"`
+	// Path or URL of the song's audio, which is played in place of a file in the music directory.
+	Audio string `json:"audio,omitempty"`
+	Attributes
 }
 
 // Album is a structure storing the album name and a dynamic array of Song objects to represent the songs present on an album.
 type Album struct {
-	Name       string `json:"name"`
-	Songs      []Song `json:"songs"`
-	TotalSongs int
+	Name  string `json:"name"`
+	Songs []Song `json:"songs"`
+	// Licence which the album's songs are used under, unless they give their own.
+	License string `json:"license,omitempty"`
+	// Path or URL of the album's cover art.
+	Art        string `json:"art,omitempty"`
+	TotalSongs int    `json:"-"`
+	Attributes
 }
 
 // Artist is a structure storing the artist name and a dynamic array of Album objects to represent the artist's albums.
 type Artist struct {
 	Artist     string  `json:"artist"`
 	Albums     []Album `json:"albums"`
-	TotalSongs int
+	TotalSongs int     `json:"-"`
+	Attributes
+}
+
+// Traits are a song's attributes, once those of its album and artist are taken into account.
+type Traits struct {
+	Weight            float64
+	Tags              []string
+	VODSafe           bool
+	ExcludeFromRandom bool
+}
+
+// SongTraits combines the attributes of a song with those of its album and artist.
+func SongTraits(artist *Artist, album *Album, song *Song) Traits {
+	t := Traits{Weight: 1}
+	for _, a := range []Attributes{artist.Attributes, album.Attributes, song.Attributes} {
+		if a.Weight != nil {
+			t.Weight *= *a.Weight
+		}
+		t.Tags = append(t.Tags, a.Tags...)
+		if a.VODSafe != nil {
+			t.VODSafe = *a.VODSafe
+		}
+		if a.ExcludeFromRandom != nil {
+			t.ExcludeFromRandom = *a.ExcludeFromRandom
+		}
+	}
+	return t
+}
+
+// HasTag reports whether the song has the given tag, ignoring case.
+func (t Traits) HasTag(tag string) bool {
+	for _, x := range t.Tags {
+		if strings.EqualFold(x, tag) {
+			return true
+		}
+	}
+	return false
 }
 
 // Music is a structure storing a dynamic array within which to store the Artist objects, to be populated by parsing the JSON data file.
 type Music struct {
 	Artists    []Artist `json:"artists"`
-	TotalSongs int
+	TotalSongs int      `json:"-"`
 }
 
 // GetSongs populates the provided Music object with the song database found at the URL `songsCollectionURL`.
 func GetSongs(a *Music, songsCollectionURL string) error {
-	var data []byte
-	var err error
-	if strings.HasPrefix(songsCollectionURL, "http") {
-		// Internet resource over HTTP(S)
-		data, err = getSongsHttp(songsCollectionURL)
+	m, err := (&CatalogLoader{Source: songsCollectionURL}).Load()
+	if err != nil {
+		return err
+	}
+	*a = *m
+	return nil
+}
+
+// parseSongs fills in the Music object from the song database in `data`, which was found at
+// `source`. It is either JSON, or a playlist (see PlaylistMusic).
+func parseSongs(a *Music, source string, data []byte) error {
+	if IsPlaylist(source) {
+		entries, err := ParsePlaylist(source, data)
 		if err != nil {
-			log.Println("Unable to retrieve song collection over HTTP(S) from " + songsCollectionURL + ": " + err.Error())
+			return err
 		}
+		*a = PlaylistMusic(entries)
 	} else {
-		data, err = getSongsFile(songsCollectionURL)
+		err := json.Unmarshal(data, a)
 		if err != nil {
-			log.Println("Unable to retrieve song collection from file `" + songsCollectionURL + "`: " + err.Error())
+			return err
 		}
 	}
 
-	err = json.Unmarshal(data, a)
+	err := a.index()
 	if err != nil {
 		return err
 	}
+	l.Info("Loaded song collection", "artists", len((*a).Artists), "songs", (*a).TotalSongs)
+	return nil
+}
 
+// index checks the songs' attributes, puts each album's songs in track order where their track
+// numbers are given, and counts them.
+func (a *Music) index() error {
+	a.TotalSongs = 0
 	for i, ar := range (*a).Artists {
+		err := ar.Attributes.validate(ar.Artist)
+		if err != nil {
+			return err
+		}
+		(*a).Artists[i].TotalSongs = 0
 		for j, al := range ar.Albums {
-			for range al.Songs {
-				(*a).Artists[i].Albums[j].TotalSongs++
+			err = al.Attributes.validate(ar.Artist + " - " + al.Name)
+			if err != nil {
+				return err
+			}
+			for _, s := range al.Songs {
+				err = s.validate(ar.Artist + " - " + s.Title)
+				if err != nil {
+					return err
+				}
 			}
+			// songs without a track number stay in the order given, after those with one
+			sort.SliceStable(al.Songs, func(x, y int) bool {
+				tx, ty := al.Songs[x].Track, al.Songs[y].Track
+				return tx != 0 && (ty == 0 || tx < ty)
+			})
+			(*a).Artists[i].Albums[j].TotalSongs = len(al.Songs)
 			(*a).Artists[i].TotalSongs += (*a).Artists[i].Albums[j].TotalSongs
 		}
 		(*a).TotalSongs += (*a).Artists[i].TotalSongs
 	}
-
 	return nil
 }
 
-func getSongsHttp(songsCollectionURL string) ([]byte, error) {
-	c := http.Client{
-		Timeout: time.Second * 5,
-	}
-	req, err := http.NewRequest(http.MethodGet, songsCollectionURL, nil)
-	if err != nil {
-		return nil, err
+func (a Attributes) validate(owner string) error {
+	if a.Weight != nil && *a.Weight < 0 {
+		return errors.New(owner + ": weight may not be negative")
 	}
+	return nil
+}
 
-	res, err := c.Do(req)
-	if err != nil {
-		return nil, err
+func (s Song) validate(owner string) error {
+	if s.Track < 0 {
+		return errors.New(owner + ": track may not be negative")
 	}
-
-	data, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	if s.Duration < 0 {
+		return errors.New(owner + ": duration may not be negative")
 	}
-
-	return data, nil
+	return s.Attributes.validate(owner)
 }
 
 func getSongsFile(songsCollectionPath string) ([]byte, error) {
@@ -183,3 +285,37 @@ func SelectSong(artists *Music) (*Artist, *Album, *Song) {
 
 	return artist, album, song
 }
+
+// FindArtistSong looks for a song by its artist and title, ignoring case.
+func FindArtistSong(artists *Music, artist, title string) (*Artist, *Album, *Song) {
+	return findSong(artists, artist, title)
+}
+
+// FindSong searches the artists Music object for a song matching `query`, which may be either the song title alone or of the form "Artist - Title", and returns pointers to the matching Artist, Album, and Song objects within (or nil if there is no match).
+func FindSong(artists *Music, query string) (*Artist, *Album, *Song) {
+	query = strings.TrimSpace(query)
+	if artistName, title, found := strings.Cut(query, " - "); found {
+		artist, album, song := findSong(artists, strings.TrimSpace(artistName), strings.TrimSpace(title))
+		if song != nil {
+			return artist, album, song
+		}
+		// the title itself may contain " - ", so fall through to searching for the whole query
+	}
+	return findSong(artists, "", query)
+}
+
+func findSong(artists *Music, artistName, title string) (*Artist, *Album, *Song) {
+	for i, ar := range artists.Artists {
+		if artistName != "" && !strings.EqualFold(ar.Artist, artistName) {
+			continue
+		}
+		for j, al := range ar.Albums {
+			for k, s := range al.Songs {
+				if strings.EqualFold(s.Title, title) {
+					return &artists.Artists[i], &artists.Artists[i].Albums[j], &artists.Artists[i].Albums[j].Songs[k]
+				}
+			}
+		}
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,33 @@
+package twedia
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSongTraits(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	yes, no := true, false
+	artist := Artist{Attributes: Attributes{Weight: f(2), Tags: []string{"chill"}, VODSafe: &yes}}
+	album := Album{Attributes: Attributes{Weight: f(3), Tags: []string{"Live"}, ExcludeFromRandom: &yes}}
+	song := Song{Attributes: Attributes{Weight: f(0.5), VODSafe: &no, ExcludeFromRandom: &no}}
+
+	got := SongTraits(&artist, &album, &song)
+	// weights multiply, tags add up, and the song's settings take priority over its album's and artist's
+	want := Traits{Weight: 3, Tags: []string{"chill", "Live"}, VODSafe: false, ExcludeFromRandom: false}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !got.HasTag("live") || !got.HasTag("CHILL") || got.HasTag("loud") {
+		t.Errorf("HasTag is wrong for %v", got.Tags)
+	}
+
+	// the album's settings apply when the song has none of its own
+	got = SongTraits(&artist, &album, &Song{})
+	if got.Weight != 6 || !got.VODSafe || !got.ExcludeFromRandom {
+		t.Errorf("got %+v from the album and artist", got)
+	}
+	if got = SongTraits(&Artist{}, &Album{}, &Song{}); got.Weight != 1 || got.VODSafe || got.ExcludeFromRandom {
+		t.Errorf("got %+v with no attributes", got)
+	}
+}
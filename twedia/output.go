@@ -0,0 +1,316 @@
+package twedia
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/speaker"
+)
+
+// The sink which new Players play through.
+var defaultSink sink = speakerSink{}
+
+// InitOutput chooses where the audio of every Player goes:
+//
+//	speaker : the system's audio device (the default)
+//	null    : nowhere, although tracks still play in real time
+//	wav     : recorded to the WAV file at `path`
+//	pcm     : raw signed 16-bit little-endian stereo samples at 48kHz, written to `path`, which
+//	          may be a named pipe (e.g. for ffmpeg), or "-" for standard output
+func InitOutput(kind, path string) error {
+	switch kind {
+	case "", "speaker":
+		defaultSink = speakerSink{}
+		// initialise the speaker to the sampleRate defined in constants
+		err := speaker.Init(sampleRate, sampleRate.N(bufferSize))
+		if err != nil {
+			return err
+		}
+		// mix Players' audio here rather than in the speaker's own mixer, so that it can be listened to
+		speaker.Play(beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+			speakerMixer.Stream(samples)
+			tap(samples)
+			return len(samples), true
+		}))
+	case "null":
+		defaultSink = newStreamSink(nil, nil)
+	case "wav":
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		w := &wavWriter{f: f, limit: maxWAVData}
+		err = w.writeHeader()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		defaultSink = newStreamSink(w.write, w.close)
+	case "pcm":
+		var w io.Writer
+		var closer func() error
+		if path == "-" {
+			w = os.Stdout
+		} else if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+			p := &pipeWriter{path: path}
+			w, closer = p, p.Close
+		} else {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			w, closer = f, f.Close
+		}
+		buf := make([]byte, 0, 4*sampleRate.N(bufferSize))
+		defaultSink = newStreamSink(func(samples [][2]float64) error {
+			buf = appendPCM(buf[:0], samples)
+			_, err := w.Write(buf)
+			return err
+		}, closer)
+	default:
+		return errors.New("unknown audio output '" + kind + "'")
+	}
+	return nil
+}
+
+// CloseOutput stops sending audio to the output, finishing any file being written.
+func CloseOutput() error {
+	if s, ok := defaultSink.(*streamSink); ok {
+		return s.Close()
+	}
+	return nil
+}
+
+var listeners struct {
+	sync.Mutex
+	fs []func(pcm []byte)
+}
+
+// Listen registers `f` to be given every block of audio sent to the output, as signed 16-bit
+// little-endian stereo samples at 48kHz. It is called as the audio is played, so must not block.
+func Listen(f func(pcm []byte)) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	listeners.fs = append(listeners.fs, f)
+}
+
+// tap passes a block of mixed audio to anything listening to the output.
+func tap(samples [][2]float64) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	if len(listeners.fs) == 0 {
+		return
+	}
+	pcm := appendPCM(nil, samples)
+	for _, f := range listeners.fs {
+		f(pcm)
+	}
+}
+
+// streamSink mixes the audio it is given in real time, passing each block of samples to `write`.
+type streamSink struct {
+	mu    sync.Mutex
+	mixer beep.Mixer
+	write func(samples [][2]float64) error
+	close func() error
+	quit  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newStreamSink(write func([][2]float64) error, close func() error) *streamSink {
+	s := &streamSink{
+		write: write,
+		close: close,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *streamSink) Play(st beep.Streamer) {
+	s.mu.Lock()
+	s.mixer.Add(st)
+	s.mu.Unlock()
+}
+
+func (s *streamSink) Lock()   { s.mu.Lock() }
+func (s *streamSink) Unlock() { s.mu.Unlock() }
+
+func (s *streamSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(bufferSize)
+	defer ticker.Stop()
+
+	start := time.Now()
+	written := 0
+	buf := make([][2]float64, sampleRate.N(bufferSize))
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+		// keep time with the clock, rather than the ticker, so that playback does not drift
+		for due := sampleRate.N(time.Since(start)) - written; due > 0; {
+			n := min(due, len(buf))
+			s.mu.Lock()
+			s.mixer.Stream(buf[:n])
+			s.mu.Unlock()
+			if s.write != nil {
+				err := s.write(buf[:n])
+				if err != nil {
+					l.Error("Error writing audio", "err", err)
+				}
+			}
+			tap(buf[:n])
+			due -= n
+			written += n
+		}
+	}
+}
+
+func (s *streamSink) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.quit)
+		<-s.done
+		if s.close != nil {
+			err = s.close()
+		}
+	})
+	return err
+}
+
+// appendPCM appends the samples to `buf` as signed 16-bit little-endian stereo.
+func appendPCM(buf []byte, samples [][2]float64) []byte {
+	for _, sample := range samples {
+		for _, v := range sample {
+			v = math.Max(-1, math.Min(1, v))
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(int16(v*math.MaxInt16)))
+		}
+	}
+	return buf
+}
+
+// The most audio a WAV file can hold, as its sizes are 32 bits, rounded down to whole samples.
+const maxWAVData = (math.MaxUint32 - 36) / 4 * 4
+
+// wavWriter records audio to a WAV file, whose header is completed once it is closed. Audio past
+// `limit` bytes (normally maxWAVData) is not recorded.
+type wavWriter struct {
+	f     *os.File
+	size  int64
+	limit int64
+	full  bool
+	buf   []byte
+}
+
+func (w *wavWriter) writeHeader() error {
+	h := make([]byte, 0, 44)
+	h = append(h, "RIFF"...)
+	h = binary.LittleEndian.AppendUint32(h, uint32(36+w.size))
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 16)
+	h = binary.LittleEndian.AppendUint16(h, 1) // PCM
+	h = binary.LittleEndian.AppendUint16(h, 2) // channels
+	h = binary.LittleEndian.AppendUint32(h, uint32(sampleRate))
+	h = binary.LittleEndian.AppendUint32(h, uint32(sampleRate)*4)
+	h = binary.LittleEndian.AppendUint16(h, 4) // bytes per sample, across both channels
+	h = binary.LittleEndian.AppendUint16(h, 16)
+	h = append(h, "data"...)
+	h = binary.LittleEndian.AppendUint32(h, uint32(w.size))
+	_, err := w.f.WriteAt(h, 0)
+	return err
+}
+
+func (w *wavWriter) write(samples [][2]float64) error {
+	if w.full {
+		return nil
+	}
+	w.buf = appendPCM(w.buf[:0], samples)
+	if room := w.limit - w.size; int64(len(w.buf)) >= room {
+		w.buf = w.buf[:room]
+		w.full = true
+		l.Error("The WAV file has reached the largest size the format allows, so no more audio will be recorded to it", "file", w.f.Name(), "bytes", w.limit)
+	}
+	_, err := w.f.WriteAt(w.buf, 44+w.size)
+	w.size += int64(len(w.buf))
+	if err == nil && w.full {
+		err = w.writeHeader()
+	}
+	return err
+}
+
+func (w *wavWriter) close() error {
+	err := w.writeHeader()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// pipeWriter writes to a named pipe. Opening a pipe waits for a reader, so it is (re)opened in
+// the background whenever no reader is connected, and anything written meanwhile is dropped.
+type pipeWriter struct {
+	path    string
+	mu      sync.Mutex
+	f       *os.File
+	opening bool
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	f := p.f
+	if f == nil && !p.opening {
+		p.opening = true
+		go p.open()
+	}
+	p.mu.Unlock()
+	if f == nil {
+		return len(b), nil
+	}
+
+	_, err := f.Write(b)
+	if err != nil {
+		l.Info("Audio pipe reader disconnected", "pipe", p.path, "err", err)
+		p.mu.Lock()
+		f.Close()
+		p.f = nil
+		p.mu.Unlock()
+	}
+	return len(b), nil
+}
+
+func (p *pipeWriter) open() {
+	f, err := os.OpenFile(p.path, os.O_WRONLY, 0)
+	if err != nil {
+		l.Error("Error opening audio pipe", "pipe", p.path, "err", err)
+		// try again later, rather than straight away
+		time.Sleep(5 * time.Second)
+	} else {
+		l.Info("Audio pipe reader connected", "pipe", p.path)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.f = f
+	p.opening = false
+}
+
+func (p *pipeWriter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		return nil
+	}
+	err := p.f.Close()
+	p.f = nil
+	return err
+}
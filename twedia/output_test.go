@@ -0,0 +1,69 @@
+package twedia
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWAVWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int64
+		writes []int
+		want   int
+	}{
+		{"under the limit", maxWAVData, []int{4, 8}, 48},
+		{"at the limit", 48, []int{4, 8}, 48},
+		{"over the limit", 40, []int{4, 8, 2}, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "out.wav")
+			f, err := os.Create(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := &wavWriter{f: f, limit: tt.limit}
+			err = w.writeHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range tt.writes {
+				samples := make([][2]float64, n)
+				for i := range samples {
+					samples[i] = [2]float64{0.5, -0.5}
+				}
+				err = w.write(samples)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = w.close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != 44+tt.want {
+				t.Fatalf("file holds %d bytes, want %d", len(data), 44+tt.want)
+			}
+			if riff := binary.LittleEndian.Uint32(data[4:]); riff != uint32(36+tt.want) {
+				t.Errorf("RIFF size is %d", riff)
+			}
+			if size := binary.LittleEndian.Uint32(data[40:]); size != uint32(tt.want) {
+				t.Errorf("data size is %d", size)
+			}
+		})
+	}
+}
+
+func TestMaxWAVData(t *testing.T) {
+	if maxWAVData%4 != 0 || maxWAVData+36 > 1<<32-1 || maxWAVData+36+4 <= 1<<32-1 {
+		t.Errorf("maxWAVData is %d", maxWAVData)
+	}
+}
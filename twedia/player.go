@@ -2,18 +2,16 @@ package twedia
 
 import (
 	"errors"
-	"log"
-	"os"
-	"path/filepath"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/faiface/beep"
 	"github.com/faiface/beep/effects"
-	"github.com/faiface/beep/flac"
-	"github.com/faiface/beep/mp3"
 	"github.com/faiface/beep/speaker"
-	"github.com/faiface/beep/vorbis"
-	"github.com/faiface/beep/wav"
 )
 
 const (
@@ -21,111 +19,420 @@ const (
 	bufferSize time.Duration   = time.Second / 10
 )
 
+var l *slog.Logger = slog.Default()
+
+// SetLogger sets the logger to which the package's log messages are written.
+func SetLogger(logger *slog.Logger) {
+	l = logger
+}
+
+// sink is where a Player's audio goes. Streamers which have been played may only be changed while the sink is locked.
+type sink interface {
+	Play(s beep.Streamer)
+	Lock()
+	Unlock()
+}
+
+// speakerSink plays audio through the speaker.
+type speakerSink struct{}
+
+// The mixer through which speakerSinks play, which is guarded by the speaker's lock.
+var speakerMixer beep.Mixer
+
+func (speakerSink) Play(s beep.Streamer) {
+	speaker.Lock()
+	speakerMixer.Add(s)
+	speaker.Unlock()
+}
+
+func (speakerSink) Lock()   { speaker.Lock() }
+func (speakerSink) Unlock() { speaker.Unlock() }
+
+// Event is something which happened to a Player's track: Started, Paused, Finished or Failed.
+type Event interface {
+	event()
+}
+
+// Started is sent when a track starts playing.
+type Started struct {
+	File     string
+	Duration time.Duration
+}
+
+// Paused is sent when a track is paused or unpaused.
+type Paused struct {
+	File   string
+	Paused bool
+}
+
+// Finished is sent when a track stops playing; `Stopped` is set if it was stopped or skipped before its end.
+type Finished struct {
+	File    string
+	Stopped bool
+}
+
+// Failed is sent when a track cannot be played.
+type Failed struct {
+	File string
+	Err  error
+}
+
+func (Started) event()  {}
+func (Paused) event()   {}
+func (Finished) event() {}
+func (Failed) event()   {}
+
+// Player plays one track at a time. Its state belongs to a goroutine of its own, which carries
+// out the commands sent to it by the Player's methods, so they may be called from any goroutine.
 type Player struct {
-	closer beep.StreamSeekCloser
-	ctrl   *beep.Ctrl
-	volume *effects.Volume
-	// Whether the `Player` will continue playing music once the current track has concluded.
-	ContinuingPlayback bool
+	sink     sink
+	commands chan func(*playerState)
+	quit     chan struct{}
+	closing  sync.Once
+
+	// Whether music should carry on playing once the current track has concluded.
+	continuing atomic.Bool
+
+	subsLock sync.Mutex
+	subs     []chan Event
 }
 
-func InitSpeaker() error {
-	// initialise the speaker to the sampleRate defined in constants
-	return speaker.Init(sampleRate, sampleRate.N(bufferSize))
+// playerState is owned by the Player's goroutine.
+type playerState struct {
+	track *track
+	// Volume at which tracks are played, kept from one track to the next.
+	level  float64
+	nextID int
 }
 
-func NewPlayer() Player {
-	return Player{
-		ContinuingPlayback: false,
+// track is a file being played.
+type track struct {
+	id      int
+	file    string
+	decoder beep.StreamSeekCloser
+	format  beep.Format
+	ctrl    *beep.Ctrl
+	volume  *effects.Volume
+	// Receives the outcome of PlayFile once the track stops.
+	result chan error
+}
+
+// NewPlayer creates a Player which plays through the output chosen by InitOutput. It should be closed once it is no longer needed.
+func NewPlayer() *Player {
+	return newPlayer(defaultSink)
+}
+
+func newPlayer(s sink) *Player {
+	p := &Player{
+		sink:     s,
+		commands: make(chan func(*playerState)),
+		quit:     make(chan struct{}),
 	}
+	go p.run()
+	return p
 }
 
-func (p *Player) PlayFile(fn string) error {
-	var format beep.Format
-	var err error
+func (p *Player) run() {
+	s := &playerState{}
+	for {
+		select {
+		case cmd := <-p.commands:
+			cmd(s)
+		case <-p.quit:
+			return
+		}
+	}
+}
 
-	mf, err := os.Open(fn)
+// do runs `cmd` on the Player's goroutine, and waits for it to finish. Nothing is done once the Player is closed.
+func (p *Player) do(cmd func(*playerState)) {
+	done := make(chan struct{})
+	select {
+	case p.commands <- func(s *playerState) {
+		defer close(done)
+		cmd(s)
+	}:
+		<-done
+	case <-p.quit:
+	}
+}
+
+// Close stops the current track, and the Player's goroutine.
+func (p *Player) Close() {
+	p.closing.Do(func() {
+		p.do(func(s *playerState) {
+			p.finish(s, true)
+		})
+		close(p.quit)
+	})
+}
+
+// Subscribe returns a channel on which the Player's events are sent. Events are dropped if the channel is full.
+func (p *Player) Subscribe() <-chan Event {
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	ch := make(chan Event, 16)
+	p.subs = append(p.subs, ch)
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe.
+func (p *Player) Unsubscribe(ch <-chan Event) {
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	for i, sub := range p.subs {
+		if sub == ch {
+			p.subs = append(p.subs[:i], p.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *Player) emit(e Event) {
+	p.subsLock.Lock()
+	defer p.subsLock.Unlock()
+	for _, sub := range p.subs {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+// Continuing reports whether music should carry on playing once the current track has concluded.
+func (p *Player) Continuing() bool {
+	return p.continuing.Load()
+}
+
+func (p *Player) SetContinuing(c bool) {
+	p.continuing.Store(c)
+}
+
+// decode opens the file at `fn`, which may be a local path or a URL, with the decoder for its format.
+func decode(fn string) (beep.StreamSeekCloser, beep.Format, error) {
+	mf, err := openSource(fn)
 	if err != nil {
-		return err
+		return nil, beep.Format{}, err
 	}
-	defer mf.Close()
-
-	ext := filepath.Ext(fn)
-	if ext == ".mp3" {
-		p.closer, format, err = mp3.Decode(mf)
-	} else if ext == ".wav" {
-		p.closer, format, err = wav.Decode(mf)
-	} else if ext == ".ogg" {
-		p.closer, format, err = vorbis.Decode(mf)
-	} else if ext == ".flac" {
-		p.closer, format, err = flac.Decode(mf)
-	} else {
-		log.Println("Unrecognised file type: " + fn)
-		return errors.New("Unrecognised file type: " + fn)
-	}
-	defer p.Stop()
+
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(mf, head)
+	f := detectFormat(fn, head[:n])
+	if f == nil {
+		mf.Close()
+		return nil, beep.Format{}, errors.New("Unrecognised file type: " + fn)
+	}
+	_, err = mf.Seek(0, io.SeekStart)
+	if err != nil {
+		mf.Close()
+		return nil, beep.Format{}, err
+	}
+
+	decoder, format, err := f.decode(mf)
+	if err != nil {
+		mf.Close()
+		return nil, format, fmt.Errorf("decoding %s as %s: %w", fn, f.name, err)
+	}
+	if _, streaming := decoder.(*ffmpegDecoder); IsRemote(fn) && !streaming {
+		// reading may have to wait for the download, which mustn't hold up the sink
+		return prefetch(decoder, format.SampleRate, mf.Close), format, nil
+	}
+	return decoder, format, nil
+}
+
+// PlayFile plays the file at `fn`, in place of any track which is already playing, and returns
+// once it has finished or been stopped.
+func (p *Player) PlayFile(fn string) error {
+	return p.PlayFileStarted(fn, nil)
+}
+
+// PlayFileStarted is PlayFile, but calls `started` (if not nil) once the track has begun to play.
+// `started` is not called if the file cannot be played.
+func (p *Player) PlayFileStarted(fn string, started func()) error {
+	// opening the file may take a while, so do it before handing it to the Player's goroutine
+	decoder, format, err := decode(fn)
 	if err != nil {
+		p.emit(Failed{File: fn, Err: err})
 		return err
 	}
+	var result chan error
+	p.do(func(s *playerState) {
+		result = p.start(s, fn, decoder, format)
+	})
+	if result == nil {
+		decoder.Close()
+		return errors.New("the player has been closed")
+	}
+	if started != nil {
+		started()
+	}
+	return <-result
+}
 
-	resampled := beep.Resample(4, format.SampleRate, sampleRate, p.closer)
+// start plays the decoded file in place of the current track, returning the channel which receives the outcome.
+func (p *Player) start(s *playerState, fn string, decoder beep.StreamSeekCloser, format beep.Format) chan error {
+	p.finish(s, true)
 
-	done := make(chan bool)
-	p.ctrl = &beep.Ctrl{
+	s.nextID++
+	t := &track{
+		id:      s.nextID,
+		file:    fn,
+		decoder: decoder,
+		format:  format,
+		result:  make(chan error, 1),
+	}
+	l.Debug("Playing file", "file", fn, "sampleRate", int(format.SampleRate))
+	resampled := beep.Resample(4, format.SampleRate, sampleRate, decoder)
+	t.ctrl = &beep.Ctrl{
 		Streamer: beep.Seq(resampled, beep.Callback(func() {
-			done <- true
+			// called by the sink with its lock held, so hand over to the Player's goroutine
+			go p.do(func(s *playerState) {
+				if s.track != nil && s.track.id == t.id {
+					p.finish(s, false)
+				}
+			})
 		})),
-		Paused: false,
 	}
-
-	p.volume = &effects.Volume{
-		Streamer: p.ctrl,
+	t.volume = &effects.Volume{
+		Streamer: t.ctrl,
 		Base:     2,
-		Volume:   0,
-		Silent:   false,
+		Volume:   s.level,
 	}
+	s.track = t
+
+	p.sink.Play(t.volume)
+	p.emit(Started{File: fn, Duration: format.SampleRate.D(decoder.Len())})
+	return t.result
+}
 
-	speaker.Play(p.volume)
+// finish ends the current track, if there is one; `stopped` is set if it has not reached its end.
+func (p *Player) finish(s *playerState, stopped bool) {
+	t := s.track
+	if t == nil {
+		return
+	}
+	s.track = nil
 
-	<-done
+	p.sink.Lock()
+	t.ctrl.Streamer = nil
+	p.sink.Unlock()
 
-	return nil
+	// read any error from decoding before the decoder is closed
+	err := t.decoder.Err()
+	if closeErr := t.decoder.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		p.emit(Failed{File: t.file, Err: err})
+	}
+	p.emit(Finished{File: t.file, Stopped: stopped})
+	t.result <- err
+}
+
+// Playing reports whether the `Player` currently has a track loaded, paused or otherwise.
+func (p *Player) Playing() bool {
+	playing := false
+	p.do(func(s *playerState) {
+		playing = s.track != nil
+	})
+	return playing
+}
+
+// Paused reports whether the current track is paused.
+func (p *Player) Paused() bool {
+	paused := false
+	p.do(func(s *playerState) {
+		if s.track != nil {
+			p.sink.Lock()
+			paused = s.track.ctrl.Paused
+			p.sink.Unlock()
+		}
+	})
+	return paused
+}
+
+// Position returns how far through the current track playback is. It is measured in the track's
+// own samples, before they are resampled for the speaker.
+func (p *Player) Position() time.Duration {
+	var pos time.Duration
+	p.do(func(s *playerState) {
+		if s.track != nil {
+			p.sink.Lock()
+			pos = s.track.format.SampleRate.D(s.track.decoder.Position())
+			p.sink.Unlock()
+		}
+	})
+	return pos
+}
+
+// Duration returns the length of the current track.
+func (p *Player) Duration() time.Duration {
+	var d time.Duration
+	p.do(func(s *playerState) {
+		if s.track != nil {
+			d = s.track.format.SampleRate.D(s.track.decoder.Len())
+		}
+	})
+	return d
+}
+
+// Seek moves playback to `d` from the start of the current track.
+func (p *Player) Seek(d time.Duration) error {
+	err := errors.New("nothing is playing")
+	p.do(func(s *playerState) {
+		if s.track == nil {
+			return
+		}
+		t := s.track
+		p.sink.Lock()
+		defer p.sink.Unlock()
+		err = t.decoder.Seek(max(0, min(t.format.SampleRate.N(d), t.decoder.Len()-1)))
+	})
+	return err
+}
+
+// Volume returns the volume at which tracks are played, relative to their original volume (0), as a power of two.
+func (p *Player) Volume() float64 {
+	var level float64
+	p.do(func(s *playerState) {
+		level = s.level
+	})
+	return level
 }
 
 func (p *Player) TogglePause() {
-	if p.closer != nil {
-		speaker.Lock()
-		p.ctrl.Paused = !p.ctrl.Paused
-		speaker.Unlock()
-	}
+	p.do(func(s *playerState) {
+		if s.track == nil {
+			return
+		}
+		p.sink.Lock()
+		s.track.ctrl.Paused = !s.track.ctrl.Paused
+		paused := s.track.ctrl.Paused
+		p.sink.Unlock()
+		p.emit(Paused{File: s.track.file, Paused: paused})
+	})
 }
 
 func (p *Player) AdjustVolume(deltaVolume float64) {
-	if p.closer != nil {
-		speaker.Lock()
-		p.volume.Volume += deltaVolume
-		speaker.Unlock()
-	}
+	p.do(func(s *playerState) {
+		s.level += deltaVolume
+		if s.track != nil {
+			p.sink.Lock()
+			s.track.volume.Volume = s.level
+			p.sink.Unlock()
+		}
+	})
 }
 
+// Skip stops the current track, so that PlayFile returns and the next track may be played.
 func (p *Player) Skip() error {
-	if p.closer != nil {
-		err := p.closer.Close()
-		if err != nil {
-			return err
-		}
-	}
+	p.do(func(s *playerState) {
+		p.finish(s, true)
+	})
 	return nil
 }
 
+// Stop stops the current track.
 func (p *Player) Stop() error {
-	if p.closer != nil {
-		err := p.closer.Close()
-		if err != nil {
-			return err
-		} else {
-			p.closer = nil
-		}
-	}
-	return nil
+	return p.Skip()
 }
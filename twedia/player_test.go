@@ -0,0 +1,300 @@
+package twedia
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+// fakeSink mixes the audio played through it only when asked to.
+type fakeSink struct {
+	mu    sync.Mutex
+	mixer beep.Mixer
+}
+
+func (f *fakeSink) Play(s beep.Streamer) {
+	f.mu.Lock()
+	f.mixer.Add(s)
+	f.mu.Unlock()
+}
+
+func (f *fakeSink) Lock()   { f.mu.Lock() }
+func (f *fakeSink) Unlock() { f.mu.Unlock() }
+
+// pump streams `n` samples of the sink's audio.
+func (f *fakeSink) pump(n int) {
+	buf := make([][2]float64, n)
+	f.mu.Lock()
+	f.mixer.Stream(buf)
+	f.mu.Unlock()
+}
+
+// writeTestWAV writes `n` samples of silence to a mono, 16-bit, 8kHz WAV file in a temporary directory.
+func writeTestWAV(t *testing.T, n int) string {
+	t.Helper()
+	const rate = 8000
+	b := []byte("RIFF")
+	b = binary.LittleEndian.AppendUint32(b, uint32(36+2*n))
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, rate)
+	b = binary.LittleEndian.AppendUint32(b, rate*2)
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = binary.LittleEndian.AppendUint16(b, 16)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(2*n))
+	b = append(b, make([]byte, 2*n)...)
+	fn := filepath.Join(t.TempDir(), "test.wav")
+	err := os.WriteFile(fn, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// nextEvent waits for the next event on `ch`.
+func nextEvent(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was sent")
+		return nil
+	}
+}
+
+func TestPlayerPlaysToEnd(t *testing.T) {
+	s := &fakeSink{}
+	p := newPlayer(s)
+	defer p.Close()
+	events := p.Subscribe()
+	fn := writeTestWAV(t, 800)
+
+	result := make(chan error, 1)
+	started := make(chan struct{})
+	go func() {
+		result <- p.PlayFileStarted(fn, func() { close(started) })
+	}()
+	<-started
+	if e, ok := nextEvent(t, events).(Started); !ok || e.File != fn || e.Duration != 100*time.Millisecond {
+		t.Errorf("got %#v, want Started", e)
+	}
+	if !p.Playing() {
+		t.Error("not playing once started")
+	}
+	if d := p.Duration(); d != 100*time.Millisecond {
+		t.Errorf("duration is %v", d)
+	}
+
+	p.TogglePause()
+	if e, ok := nextEvent(t, events).(Paused); !ok || !e.Paused || !p.Paused() {
+		t.Errorf("got %#v, want Paused", e)
+	}
+	s.pump(sampleRate.N(time.Second))
+	if pos := p.Position(); pos != 0 {
+		t.Errorf("playback moved to %v while paused", pos)
+	}
+	p.TogglePause()
+	nextEvent(t, events)
+
+	err := p.Seek(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := p.Position(); pos != 50*time.Millisecond {
+		t.Errorf("position is %v after seeking", pos)
+	}
+
+	for done := false; !done; {
+		s.pump(sampleRate.N(10 * time.Millisecond))
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Error(err)
+			}
+			done = true
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if e, ok := nextEvent(t, events).(Finished); !ok || e.Stopped {
+		t.Errorf("got %#v, want Finished at the end", e)
+	}
+	if p.Playing() {
+		t.Error("still playing after the end")
+	}
+	if p.Seek(0) == nil {
+		t.Error("seeking with nothing playing succeeded")
+	}
+}
+
+func TestPlayerFailed(t *testing.T) {
+	p := newPlayer(&fakeSink{})
+	defer p.Close()
+	events := p.Subscribe()
+	fn := filepath.Join(t.TempDir(), "bad.wav")
+	err := os.WriteFile(fn, []byte("RIFF....WAVE but not really"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	err = p.PlayFileStarted(fn, func() { called = true })
+	if err == nil {
+		t.Error("playing a broken file succeeded")
+	}
+	if called {
+		t.Error("started was called for a broken file")
+	}
+	if e, ok := nextEvent(t, events).(Failed); !ok || e.File != fn {
+		t.Errorf("got %#v, want Failed", e)
+	}
+}
+
+func TestPlayerSkip(t *testing.T) {
+	p := newPlayer(&fakeSink{})
+	defer p.Close()
+	events := p.Subscribe()
+	fn := writeTestWAV(t, 8000)
+
+	result := make(chan error, 1)
+	started := make(chan struct{})
+	go func() {
+		result <- p.PlayFileStarted(fn, func() { close(started) })
+	}()
+	<-started
+	nextEvent(t, events)
+	p.Skip()
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+	if e, ok := nextEvent(t, events).(Finished); !ok || !e.Stopped {
+		t.Errorf("got %#v, want Finished early", e)
+	}
+}
+
+func TestPlayerConcurrentUse(t *testing.T) {
+	s := &fakeSink{}
+	p := newPlayer(s)
+	fn := writeTestWAV(t, 400)
+
+	stop := make(chan struct{})
+	var pumping sync.WaitGroup
+	pumping.Add(1)
+	go func() {
+		defer pumping.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.pump(sampleRate.N(5 * time.Millisecond))
+			}
+		}
+	}()
+
+	var playing sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		playing.Add(1)
+		go func() {
+			defer playing.Done()
+			for j := 0; j < 20; j++ {
+				p.PlayFile(fn)
+			}
+		}()
+	}
+	for j := 0; j < 200; j++ {
+		switch j % 6 {
+		case 0:
+			p.TogglePause()
+		case 1:
+			p.Seek(time.Duration(j) * time.Millisecond)
+		case 2:
+			p.Skip()
+		case 3:
+			p.AdjustVolume(0.01)
+		case 4:
+			p.Position()
+			p.Duration()
+		case 5:
+			p.Paused()
+			p.Playing()
+		}
+	}
+	// skip any tracks left paused, so that every PlayFile returns
+	done := make(chan struct{})
+	go func() {
+		playing.Wait()
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Millisecond):
+			p.Skip()
+		}
+	}
+	close(stop)
+	pumping.Wait()
+	p.Close()
+	if err := p.PlayFile(fn); err == nil {
+		t.Error("a closed player played a file")
+	}
+}
+
+func TestPlayerFFmpegFailsMidStream(t *testing.T) {
+	// ffmpeg gives a tenth of a second of audio, then fails
+	fakeFFmpeg(t, `
+echo "  Duration: 00:00:01.00, start: 0.000000, bitrate: 1 kb/s" >&2
+head -c 19200 /dev/zero
+echo "x: Error while decoding stream #0:0: Invalid data found when processing input" >&2
+exit 1
+`)
+	fn := filepath.Join(t.TempDir(), "song.opus")
+	err := os.WriteFile(fn, []byte("OggS\x00\x02OpusHead"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSink{}
+	p := newPlayer(s)
+	defer p.Close()
+	events := p.Subscribe()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- p.PlayFile(fn)
+	}()
+	if e, ok := nextEvent(t, events).(Started); !ok {
+		t.Fatalf("got %#v, want Started", e)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for done := false; !done; {
+		if time.Now().After(deadline) {
+			t.Fatal("playback did not end")
+		}
+		s.pump(sampleRate.N(10 * time.Millisecond))
+		select {
+		case err = <-result:
+			done = true
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "Invalid data found") {
+		t.Errorf("got error %v", err)
+	}
+	if e, ok := nextEvent(t, events).(Failed); !ok || e.File != fn {
+		t.Errorf("got %#v, want Failed", e)
+	}
+	if e, ok := nextEvent(t, events).(Finished); !ok || e.Stopped {
+		t.Errorf("got %#v, want Finished", e)
+	}
+}
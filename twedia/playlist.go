@@ -0,0 +1,282 @@
+package twedia
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PlaylistEntry is a track listed in a playlist. Only its location is always known.
+type PlaylistEntry struct {
+	// Path or URL of the track's audio.
+	Location string
+	Artist   string
+	Album    string
+	Title    string
+	// Zero if it is not known.
+	Duration time.Duration
+}
+
+// Track numbers at the start of file names, such as "01 - " or "3. "
+var trackNumber = regexp.MustCompile(`^\d+\s*[-._)]\s*`)
+
+// TitleFromFile guesses a song's title from its file name.
+func TitleFromFile(fn string) string {
+	title := strings.TrimSuffix(fn, filepath.Ext(fn))
+	return strings.TrimSpace(trackNumber.ReplaceAllString(title, ""))
+}
+
+// TrackFromFile returns the track number at the start of a song's file name, or 0 if there is none.
+func TrackFromFile(fn string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimRight(trackNumber.FindString(fn), "-._) \t")))
+	return n
+}
+
+// IsPlaylist reports whether `name` has the extension of a playlist: .m3u, .m3u8, .pls or .xspf.
+func IsPlaylist(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u", ".m3u8", ".pls", ".xspf":
+		return true
+	}
+	return false
+}
+
+// ParsePlaylist reads an M3U, PLS or XSPF playlist, found at `name` (a path or URL, against which
+// relative locations are resolved). The format is chosen by the playlist's contents, or its extension.
+func ParsePlaylist(name string, data []byte) ([]PlaylistEntry, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(data)
+	var entries []PlaylistEntry
+	var err error
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")) || strings.EqualFold(path.Ext(name), ".xspf"):
+		entries, err = parseXSPF(data)
+	case bytes.HasPrefix(bytes.ToLower(trimmed), []byte("[playlist]")) || strings.EqualFold(path.Ext(name), ".pls"):
+		entries, err = parsePLS(data)
+	default:
+		entries, err = parseM3U(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read playlist %s: %w", name, err)
+	}
+	for i := range entries {
+		entries[i].Location = resolveLocation(name, entries[i].Location)
+	}
+	return entries, nil
+}
+
+// resolveLocation turns a location in the playlist at `name` into a path or URL which can be opened.
+func resolveLocation(name, loc string) string {
+	if u, err := url.Parse(loc); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path)
+	}
+	if IsRemote(loc) || filepath.IsAbs(loc) {
+		return loc
+	}
+	if IsRemote(name) {
+		base, err := url.Parse(name)
+		ref, err2 := url.Parse(loc)
+		if err == nil && err2 == nil {
+			return base.ResolveReference(ref).String()
+		}
+		return loc
+	}
+	return filepath.Join(filepath.Dir(name), filepath.FromSlash(loc))
+}
+
+// splitTitle splits a display title of the form "Artist - Title".
+func splitTitle(display string) (string, string) {
+	if artist, title, found := strings.Cut(display, " - "); found {
+		return strings.TrimSpace(artist), strings.TrimSpace(title)
+	}
+	return "", strings.TrimSpace(display)
+}
+
+func parseM3U(data []byte) ([]PlaylistEntry, error) {
+	var entries []PlaylistEntry
+	var next PlaylistEntry
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if info, found := strings.CutPrefix(line, "#EXTINF:"); found {
+			// #EXTINF:<seconds>[ attributes],<artist> - <title>
+			length, display, _ := strings.Cut(info, ",")
+			length, _, _ = strings.Cut(length, " ")
+			next = PlaylistEntry{}
+			if secs, err := strconv.Atoi(length); err == nil && secs > 0 {
+				next.Duration = time.Duration(secs) * time.Second
+			}
+			next.Artist, next.Title = splitTitle(display)
+		} else if album, found := strings.CutPrefix(line, "#EXTALB:"); found {
+			next.Album = strings.TrimSpace(album)
+		} else if line != "" && !strings.HasPrefix(line, "#") {
+			next.Location = line
+			entries = append(entries, next)
+			next = PlaylistEntry{}
+		}
+	}
+	return entries, s.Err()
+}
+
+func parsePLS(data []byte) ([]PlaylistEntry, error) {
+	byIndex := make(map[int]*PlaylistEntry)
+	var order []int
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(s.Text()), "=")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(key)
+		var field string
+		for _, f := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, f) {
+				field = f
+				break
+			}
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(key, field))
+		if field == "" || err != nil {
+			continue
+		}
+		e := byIndex[n]
+		if e == nil {
+			e = &PlaylistEntry{}
+			byIndex[n] = e
+			order = append(order, n)
+		}
+		switch field {
+		case "file":
+			e.Location = value
+		case "title":
+			e.Artist, e.Title = splitTitle(value)
+		case "length":
+			if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+				e.Duration = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	var entries []PlaylistEntry
+	for _, n := range order {
+		if byIndex[n].Location != "" {
+			entries = append(entries, *byIndex[n])
+		}
+	}
+	return entries, s.Err()
+}
+
+func parseXSPF(data []byte) ([]PlaylistEntry, error) {
+	var doc struct {
+		Tracks []struct {
+			Location []string `xml:"location"`
+			Creator  string   `xml:"creator"`
+			Album    string   `xml:"album"`
+			Title    string   `xml:"title"`
+			// In milliseconds.
+			Duration int64 `xml:"duration"`
+		} `xml:"trackList>track"`
+	}
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	var entries []PlaylistEntry
+	for _, t := range doc.Tracks {
+		if len(t.Location) == 0 {
+			continue
+		}
+		entries = append(entries, PlaylistEntry{
+			Location: strings.TrimSpace(t.Location[0]),
+			Artist:   strings.TrimSpace(t.Creator),
+			Album:    strings.TrimSpace(t.Album),
+			Title:    strings.TrimSpace(t.Title),
+			Duration: time.Duration(t.Duration) * time.Millisecond,
+		})
+	}
+	if len(entries) == 0 && len(doc.Tracks) == 0 && !bytes.Contains(data, []byte("<playlist")) {
+		return nil, errors.New("not an XSPF playlist")
+	}
+	return entries, nil
+}
+
+// PlaylistMusic builds a music catalog from a playlist, in which each song plays the audio at its
+// location. Where the playlist does not give a track's artist, album or title, they are taken
+// from its location, which is assumed to be laid out as .../Artist/Album/Song.
+func PlaylistMusic(entries []PlaylistEntry) Music {
+	var m Music
+	for _, e := range entries {
+		loc := e.Location
+		if u, err := url.Parse(loc); err == nil && IsRemote(loc) {
+			loc, _ = url.PathUnescape(u.Path)
+		}
+		parts := strings.Split(filepath.ToSlash(loc), "/")
+		fromPath := func(i int) string {
+			if len(parts) > i {
+				return parts[len(parts)-1-i]
+			}
+			return ""
+		}
+		artist, album, title := e.Artist, e.Album, e.Title
+		if artist == "" {
+			artist = fromPath(2)
+		}
+		if artist == "" {
+			artist = "Unknown artist"
+		}
+		if album == "" {
+			album = fromPath(1)
+		}
+		if title == "" {
+			title = TitleFromFile(fromPath(0))
+		}
+
+		ar := findOrAdd(&m.Artists, func(a Artist) bool { return strings.EqualFold(a.Artist, artist) }, Artist{Artist: artist})
+		al := findOrAdd(&ar.Albums, func(a Album) bool { return strings.EqualFold(a.Name, album) }, Album{Name: album})
+		al.Songs = append(al.Songs, Song{Title: title, Audio: e.Location, Duration: e.Duration.Seconds()})
+	}
+	m.index()
+	return m
+}
+
+// findOrAdd returns the item in `items` for which `match` holds, adding `item` if there is none.
+func findOrAdd[T any](items *[]T, match func(T) bool, item T) *T {
+	for i := range *items {
+		if match((*items)[i]) {
+			return &(*items)[i]
+		}
+	}
+	*items = append(*items, item)
+	return &(*items)[len(*items)-1]
+}
+
+// WriteM3U writes an extended M3U playlist.
+func WriteM3U(w io.Writer, entries []PlaylistEntry) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("#EXTM3U\n")
+	for _, e := range entries {
+		secs := -1
+		if e.Duration > 0 {
+			secs = int(e.Duration.Round(time.Second).Seconds())
+		}
+		display := e.Title
+		if e.Artist != "" {
+			display = e.Artist + " - " + e.Title
+		}
+		fmt.Fprintf(b, "#EXTINF:%d,%s\n", secs, display)
+		if e.Album != "" {
+			fmt.Fprintf(b, "#EXTALB:%s\n", e.Album)
+		}
+		fmt.Fprintln(b, e.Location)
+	}
+	return b.Flush()
+}
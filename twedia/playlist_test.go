@@ -0,0 +1,95 @@
+package twedia
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	dir := filepath.FromSlash("/music/lists")
+	tests := []struct {
+		name string
+		file string
+		data string
+		want []PlaylistEntry
+	}{
+		{"extended M3U", filepath.Join(dir, "a.m3u8"), "\xef\xbb\xbf#EXTM3U\n#EXTINF:185,Artist - Song\n#EXTALB:Album\nArtist/Album/01 Song.mp3\n\n#EXTINF:-1 tvg-id=\"x\",Untitled\nhttp://nas/b.flac\n", []PlaylistEntry{
+			{Location: filepath.Join(dir, "Artist", "Album", "01 Song.mp3"), Artist: "Artist", Album: "Album", Title: "Song", Duration: 185 * time.Second},
+			{Location: "http://nas/b.flac", Title: "Untitled"},
+		}},
+		{"plain M3U", filepath.Join(dir, "a.m3u"), "# a comment\n/abs/song.mp3\r\nfile:///abs/other%20song.mp3\n", []PlaylistEntry{
+			{Location: "/abs/song.mp3"},
+			{Location: filepath.FromSlash("/abs/other song.mp3")},
+		}},
+		{"M3U at a URL", "http://nas/lists/a.m3u", "../music/song.mp3\n", []PlaylistEntry{
+			{Location: "http://nas/music/song.mp3"},
+		}},
+		{"PLS", filepath.Join(dir, "a.pls"), "[playlist]\nFile2=b.mp3\nFile1=a.mp3\nTitle1=Artist - Song\nLength1=60\nLength2=-1\nTitle3=no file\nNumberOfEntries=2\n", []PlaylistEntry{
+			{Location: filepath.Join(dir, "b.mp3")},
+			{Location: filepath.Join(dir, "a.mp3"), Artist: "Artist", Title: "Song", Duration: time.Minute},
+		}},
+		{"PLS by its contents", filepath.Join(dir, "a.txt"), "[Playlist]\nfile1=a.mp3\n", []PlaylistEntry{
+			{Location: filepath.Join(dir, "a.mp3")},
+		}},
+		{"XSPF", filepath.Join(dir, "a.xspf"), `<?xml version="1.0"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/"><trackList>
+<track><location>a.ogg</location><location>ignored.ogg</location><creator> Artist </creator><album>Album</album><title>Song</title><duration>1500</duration></track>
+<track><title>no location</title></track>
+</trackList></playlist>`, []PlaylistEntry{
+			{Location: filepath.Join(dir, "a.ogg"), Artist: "Artist", Album: "Album", Title: "Song", Duration: 1500 * time.Millisecond},
+		}},
+		{"empty XSPF", filepath.Join(dir, "a.xspf"), `<playlist><trackList/></playlist>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePlaylist(tt.file, []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePlaylistErrors(t *testing.T) {
+	for _, tt := range []struct{ file, data string }{
+		{"a.xspf", "<playlist><trackList>"},
+		{"a.xspf", "<html></html>"},
+	} {
+		_, err := ParsePlaylist(tt.file, []byte(tt.data))
+		if err == nil {
+			t.Errorf("reading %q as %s succeeded", tt.data, tt.file)
+		}
+	}
+}
+
+func TestWriteM3U(t *testing.T) {
+	entries := []PlaylistEntry{
+		{Location: "/music/a.mp3", Artist: "Artist", Album: "Album", Title: "Song", Duration: 1500 * time.Millisecond},
+		{Location: "http://nas/b.flac", Title: "Untitled"},
+	}
+	buf := new(bytes.Buffer)
+	err := WriteM3U(buf, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXTINF:2,Artist - Song\n#EXTALB:Album\n/music/a.mp3\n#EXTINF:-1,Untitled\nhttp://nas/b.flac\n"
+	if buf.String() != want {
+		t.Errorf("wrote %q, want %q", buf.String(), want)
+	}
+
+	// what is written reads back the same, apart from the rounding of its durations
+	got, err := ParsePlaylist("/lists/a.m3u", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[0].Duration = 2 * time.Second
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("read back %+v", got)
+	}
+}
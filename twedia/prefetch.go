@@ -0,0 +1,167 @@
+package twedia
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+const (
+	// How much audio is decoded ahead of what is being played, for files which may be slow to read.
+	prefetchAhead = 10 * time.Second
+	// How much is decoded before such a file starts to play, so that it does not start with a gap.
+	prefetchStart = 2 * time.Second
+	// How long to wait for the start of such a file before playing it anyway.
+	prefetchTimeout = 30 * time.Second
+)
+
+// prefetcher decodes audio ahead of where it is being played, on a goroutine of its own, so that a
+// slow read (such as of a remote file still being downloaded) never holds up the sink. If the
+// decoder falls behind, silence is played until it catches up.
+type prefetcher struct {
+	src    beep.StreamSeekCloser
+	length int
+	// Closes what `src` reads from, to stop a read which is waiting for data.
+	unblock func() error
+	done    chan struct{}
+
+	mu sync.Mutex
+	// Signalled when samples are taken from `buf`, or it is to seek or close.
+	more *sync.Cond
+	// Samples which have been decoded, but not yet played, starting at `pos`.
+	buf [][2]float64
+	pos int
+	// Where to seek to next, or -1.
+	seekTo int
+	// How many samples to decode ahead.
+	limit  int
+	ended  bool
+	err    error
+	closed bool
+}
+
+// prefetch starts decoding `src` ahead, at the sample rate `rate`, and returns once the first
+// of it is ready. `unblock` closes whatever `src` reads from.
+func prefetch(src beep.StreamSeekCloser, rate beep.SampleRate, unblock func() error) *prefetcher {
+	p := &prefetcher{
+		src:     src,
+		length:  src.Len(),
+		unblock: unblock,
+		done:    make(chan struct{}),
+		seekTo:  -1,
+		limit:   rate.N(prefetchAhead),
+	}
+	p.more = sync.NewCond(&p.mu)
+	go p.fill()
+
+	timedOut := false
+	timeout := time.AfterFunc(prefetchTimeout, func() {
+		p.mu.Lock()
+		timedOut = true
+		p.more.Broadcast()
+		p.mu.Unlock()
+	})
+	defer timeout.Stop()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.buf) < rate.N(prefetchStart) && !p.ended && !timedOut {
+		p.more.Wait()
+	}
+	return p
+}
+
+func (p *prefetcher) fill() {
+	defer close(p.done)
+	chunk := make([][2]float64, 4096)
+	for {
+		p.mu.Lock()
+		for !p.closed && p.seekTo < 0 && (p.ended || len(p.buf) >= p.limit) {
+			p.more.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		seek := p.seekTo
+		p.seekTo = -1
+		p.mu.Unlock()
+
+		if seek >= 0 {
+			err := p.src.Seek(seek)
+			p.mu.Lock()
+			if p.seekTo < 0 && err != nil {
+				p.ended, p.err = true, err
+			}
+			p.more.Broadcast()
+			p.mu.Unlock()
+			continue
+		}
+
+		n, ok := p.src.Stream(chunk)
+		p.mu.Lock()
+		// anything decoded from before a seek is no longer wanted
+		if p.seekTo < 0 && !p.closed {
+			p.buf = append(p.buf, chunk[:n]...)
+			if !ok {
+				p.ended, p.err = true, p.src.Err()
+			}
+		}
+		p.more.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+func (p *prefetcher) Stream(samples [][2]float64) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := copy(samples, p.buf)
+	p.buf = p.buf[n:]
+	p.pos += n
+	if n > 0 {
+		p.more.Broadcast()
+	}
+	if p.ended && len(p.buf) == 0 {
+		return n, n > 0
+	}
+	clear(samples[n:])
+	return len(samples), true
+}
+
+func (p *prefetcher) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *prefetcher) Len() int {
+	return p.length
+}
+
+func (p *prefetcher) Position() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pos
+}
+
+func (p *prefetcher) Seek(pos int) error {
+	if pos < 0 || pos > p.length {
+		return errors.New("prefetch: seek position out of range")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seekTo, p.pos, p.buf, p.ended, p.err = pos, pos, nil, false, nil
+	p.more.Broadcast()
+	return nil
+}
+
+func (p *prefetcher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.more.Broadcast()
+	p.mu.Unlock()
+	p.unblock()
+	<-p.done
+	return p.src.Close()
+}
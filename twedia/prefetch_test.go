@@ -0,0 +1,131 @@
+package twedia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+// gatedStreamer plays `length` samples of a constant, taking a token from `gate` for each call
+// to Stream, until `closed` is closed.
+type gatedStreamer struct {
+	length, pos int
+	gate        chan struct{}
+	closed      chan struct{}
+}
+
+func (g *gatedStreamer) Stream(samples [][2]float64) (int, bool) {
+	select {
+	case <-g.gate:
+	case <-g.closed:
+		return 0, false
+	}
+	n := min(len(samples), g.length-g.pos)
+	for i := range samples[:n] {
+		samples[i] = [2]float64{1, 1}
+	}
+	g.pos += n
+	return n, n > 0
+}
+
+func (g *gatedStreamer) Err() error       { return nil }
+func (g *gatedStreamer) Len() int         { return g.length }
+func (g *gatedStreamer) Position() int    { return g.pos }
+func (g *gatedStreamer) Seek(p int) error { g.pos = p; return nil }
+func (g *gatedStreamer) Close() error     { return nil }
+
+func (g *gatedStreamer) unblock() error {
+	close(g.closed)
+	return nil
+}
+
+// countSamples streams `p` to its end, returning how many samples were not silent.
+func countSamples(t *testing.T, p *prefetcher) int {
+	t.Helper()
+	total := 0
+	buf := make([][2]float64, 1000)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		n, ok := p.Stream(buf)
+		if !ok {
+			return total
+		}
+		for _, s := range buf[:n] {
+			if s[0] == 1 {
+				total++
+			}
+		}
+	}
+	t.Fatal("the prefetcher did not end")
+	return 0
+}
+
+func TestPrefetcher(t *testing.T) {
+	const rate = beep.SampleRate(8000)
+	g := &gatedStreamer{length: rate.N(5 * time.Second), gate: make(chan struct{}), closed: make(chan struct{})}
+	close(g.gate)
+	p := prefetch(g, rate, g.unblock)
+	defer p.Close()
+
+	if p.Len() != g.length {
+		t.Errorf("length is %d", p.Len())
+	}
+	if n := countSamples(t, p); n != g.length {
+		t.Errorf("played %d samples", n)
+	}
+	err := p.Seek(rate.N(2 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos := p.Position(); pos != rate.N(2*time.Second) {
+		t.Errorf("position is %d after seeking", pos)
+	}
+	if n := countSamples(t, p); n != rate.N(3*time.Second) {
+		t.Errorf("played %d samples after seeking", n)
+	}
+	if p.Seek(-1) == nil {
+		t.Error("seeking before the start succeeded")
+	}
+}
+
+func TestPrefetcherSlowSource(t *testing.T) {
+	const rate = beep.SampleRate(8000)
+	g := &gatedStreamer{length: rate.N(time.Minute), gate: make(chan struct{}, 10), closed: make(chan struct{})}
+	// enough for the start of it, and no more
+	for i := 0; i < 4; i++ {
+		g.gate <- struct{}{}
+	}
+	p := prefetch(g, rate, g.unblock)
+
+	buf := make([][2]float64, rate.N(prefetchStart))
+	n, ok := p.Stream(buf)
+	if n != len(buf) || !ok || buf[0][0] != 1 {
+		t.Fatalf("got %d, %v to start with", n, ok)
+	}
+	// the source is stuck, so silence is played instead of waiting for it
+	streamed := make(chan struct{})
+	go func() {
+		n, ok = p.Stream(buf)
+		close(streamed)
+	}()
+	select {
+	case <-streamed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream waited for a slow source")
+	}
+	if n != len(buf) || !ok || buf[len(buf)-1] != [2]float64{} {
+		t.Errorf("got %d, %v while the source is stuck", n, ok)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a slow source")
+	}
+}
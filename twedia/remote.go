@@ -0,0 +1,529 @@
+package twedia
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Size of the pieces in which remote audio is downloaded.
+const chunkSize = 512 * 1024
+
+// Downloads are abandoned if no data arrives for this long.
+var remoteIdleTimeout = 30 * time.Second
+
+// source is an audio file being played, which may be local or remote.
+type source interface {
+	io.ReadSeekCloser
+	Name() string
+}
+
+var remoteCache = struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+}{maxSize: 1 << 30}
+
+// remoteClient gives up on servers which are slow to respond, but not on long downloads.
+var remoteClient = func() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 30 * time.Second
+	return &http.Client{Transport: t}
+}()
+
+// SetRemoteCache sets the directory in which remote audio files are kept once downloaded, and
+// the most bytes of them to keep. With no directory, remote audio is not kept.
+func SetRemoteCache(dir string, maxSize int64) {
+	remoteCache.Lock()
+	defer remoteCache.Unlock()
+	remoteCache.dir = dir
+	if maxSize > 0 {
+		remoteCache.maxSize = maxSize
+	}
+}
+
+// IsRemote reports whether `fn` is the URL of a remote audio file, rather than a local path.
+func IsRemote(fn string) bool {
+	lower := strings.ToLower(fn)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// openSource opens a local or remote audio file.
+func openSource(fn string) (source, error) {
+	if IsRemote(fn) {
+		return openRemote(fn)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// cachePath returns where the remote file at `u` is cached, if it is.
+func cachePath(u string) string {
+	remoteCache.Lock()
+	defer remoteCache.Unlock()
+	if remoteCache.dir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(u))
+	ext := ""
+	if parsed, err := url.Parse(u); err == nil {
+		ext = strings.ToLower(path.Ext(parsed.Path))
+	}
+	return filepath.Join(remoteCache.dir, hex.EncodeToString(sum[:12])+ext)
+}
+
+// openRemote opens a remote audio file, from the cache if it has already been downloaded.
+func openRemote(u string) (source, error) {
+	cached := cachePath(u)
+	if cached != "" {
+		f, err := os.Open(cached)
+		if err == nil {
+			// mark it as recently used, so it is not the first to be evicted
+			now := time.Now()
+			os.Chtimes(cached, now, now)
+			l.Debug("Playing remote audio from the cache", "url", u, "file", cached)
+			return remoteName{f, u}, nil
+		}
+	}
+
+	dir := os.TempDir()
+	if cached != "" {
+		dir = filepath.Dir(cached)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	part, err := os.CreateTemp(dir, "download-*.part")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &remoteFile{
+		url:       u,
+		cachePath: cached,
+		part:      part,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	err = r.start(ctx)
+	if err != nil {
+		cancel()
+		part.Close()
+		os.Remove(part.Name())
+		return nil, err
+	}
+	return r, nil
+}
+
+// remoteName is a cached copy of a remote file, named by its URL.
+type remoteName struct {
+	*os.File
+	url string
+}
+
+func (r remoteName) Name() string { return r.url }
+
+// remoteFile reads an audio file over HTTP. It is downloaded in chunks, starting from wherever
+// it is being read, into a temporary file, which joins the cache once all of it has arrived.
+// Chunks are fetched with range requests where the server supports them, so that seeking does
+// not wait for everything before it to be downloaded.
+type remoteFile struct {
+	url       string
+	cachePath string
+	part      *os.File
+	size      int64
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	have    []bool
+	missing int
+	pos     int64
+	// How much of a file of unknown size (-1) has arrived.
+	received int64
+	err      error
+	closed   bool
+}
+
+func (r *remoteFile) Name() string { return r.url }
+
+// start makes the first request, which finds out how large the file is and whether it can be
+// fetched in ranges, then leaves the rest of the download to a goroutine.
+func (r *remoteFile) start(ctx context.Context) error {
+	resp, err := r.get(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		_, total, found := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		r.size, err = strconv.ParseInt(total, 10, 64)
+		if !found || err != nil {
+			resp.Body.Close()
+			return errors.New("unexpected Content-Range from " + r.url)
+		}
+		r.init()
+		// an empty file has no chunks to store
+		if r.size > 0 {
+			err = r.store(0, resp.Body)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		go r.fetchRanges(ctx)
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			// the size is found once all of it has arrived; until then, it may be read as it comes
+			r.size = -1
+			go r.fetchStream(resp.Body)
+			return nil
+		}
+		r.size = resp.ContentLength
+		r.init()
+		go r.fetchWhole(resp.Body)
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("unable to fetch %s: %s", r.url, resp.Status)
+	}
+	return nil
+}
+
+func (r *remoteFile) init() {
+	n := int((r.size + chunkSize - 1) / chunkSize)
+	r.have = make([]bool, n)
+	r.missing = n
+}
+
+// get requests the chunk at `offset`, asking for the server's range support to be used.
+func (r *remoteFile) get(ctx context.Context, offset int64) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+chunkSize-1))
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newIdleBody(resp.Body, cancel)
+	return resp, nil
+}
+
+// idleBody is the body of a response, which is abandoned if no data arrives for remoteIdleTimeout.
+type idleBody struct {
+	io.ReadCloser
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleBody(body io.ReadCloser, cancel context.CancelFunc) *idleBody {
+	b := &idleBody{ReadCloser: body, cancel: cancel}
+	b.timer = time.AfterFunc(remoteIdleTimeout, func() {
+		b.timedOut.Store(true)
+		cancel()
+	})
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.timedOut.Load() {
+		return n, fmt.Errorf("no data arrived for %v", remoteIdleTimeout)
+	}
+	b.timer.Reset(remoteIdleTimeout)
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// store writes a chunk which has been fetched to the temporary file.
+func (r *remoteFile) store(c int, body io.Reader) error {
+	offset := int64(c) * chunkSize
+	n := min(chunkSize, r.size-offset)
+	buf := make([]byte, n)
+	_, err := io.ReadFull(body, buf)
+	if err != nil {
+		return err
+	}
+	_, err = r.part.WriteAt(buf, offset)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.have[c] {
+		r.have[c] = true
+		r.missing--
+	}
+	r.cond.Broadcast()
+	return nil
+}
+
+// fail records that the download cannot continue, waking any reader waiting for it.
+func (r *remoteFile) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil && !r.closed {
+		r.err = err
+		l.Error("Error downloading remote audio", "url", r.url, "err", err)
+	}
+	r.cond.Broadcast()
+}
+
+// nextChunk picks the next chunk to fetch: the first missing one from where the file is being
+// read, then any left before it. It returns -1 once everything has been fetched.
+func (r *remoteFile) nextChunk() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.missing == 0 {
+		return -1
+	}
+	from := int(r.pos / chunkSize)
+	for i := range r.have {
+		c := (from + i) % len(r.have)
+		if !r.have[c] {
+			return c
+		}
+	}
+	return -1
+}
+
+func (r *remoteFile) fetchRanges(ctx context.Context) {
+	defer close(r.done)
+	for c := r.nextChunk(); c >= 0; c = r.nextChunk() {
+		var err error
+		for attempt := 0; attempt < 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Second)
+			}
+			var resp *http.Response
+			resp, err = r.get(ctx, int64(c)*chunkSize)
+			if err != nil {
+				continue
+			}
+			if resp.StatusCode != http.StatusPartialContent {
+				err = errors.New(resp.Status)
+			} else {
+				err = r.store(c, resp.Body)
+			}
+			resp.Body.Close()
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			r.fail(err)
+			return
+		}
+	}
+}
+
+// fetchWhole downloads the file from start to end, for servers which do not support range requests.
+func (r *remoteFile) fetchWhole(body io.ReadCloser) {
+	defer close(r.done)
+	defer body.Close()
+	for c := range r.have {
+		err := r.store(c, body)
+		if err != nil {
+			r.fail(err)
+			return
+		}
+	}
+}
+
+// fetchStream downloads a file whose size is not known, which may be read as it arrives.
+func (r *remoteFile) fetchStream(body io.ReadCloser) {
+	defer close(r.done)
+	defer body.Close()
+	buf := make([]byte, 64*1024)
+	var size int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			_, werr := r.part.WriteAt(buf[:n], size)
+			if werr != nil {
+				r.fail(werr)
+				return
+			}
+			size += int64(n)
+			r.mu.Lock()
+			r.received = size
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			r.fail(err)
+			return
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.size = size
+	r.init()
+	for i := range r.have {
+		r.have[i] = true
+	}
+	r.missing = 0
+	r.cond.Broadcast()
+}
+
+func (r *remoteFile) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	var end int64
+	for {
+		if r.closed {
+			r.mu.Unlock()
+			return 0, os.ErrClosed
+		}
+		if r.size >= 0 {
+			if r.pos >= r.size {
+				r.mu.Unlock()
+				return 0, io.EOF
+			}
+			if r.have[r.pos/chunkSize] {
+				end = min((r.pos/chunkSize+1)*chunkSize, r.size)
+				break
+			}
+		} else if r.pos < r.received {
+			end = r.received
+			break
+		}
+		if r.err != nil {
+			err := r.err
+			r.mu.Unlock()
+			return 0, err
+		}
+		r.cond.Wait()
+	}
+	pos := r.pos
+	r.mu.Unlock()
+
+	n, err := r.part.ReadAt(p[:min(int64(len(p)), end-pos)], pos)
+	r.mu.Lock()
+	r.pos += int64(n)
+	r.mu.Unlock()
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		// the end of a file of unknown size is only found once it has all arrived
+		for r.size < 0 && r.err == nil && !r.closed {
+			r.cond.Wait()
+		}
+		if r.size < 0 {
+			return 0, errors.New("the size of " + r.url + " is not known")
+		}
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	// the downloader picks up from the new position
+	r.cond.Broadcast()
+	return offset, nil
+}
+
+// Close stops the download. If all of the file has arrived, it is added to the cache; otherwise, it is discarded.
+func (r *remoteFile) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	r.cancel()
+	<-r.done
+
+	err := r.part.Close()
+	if r.size >= 0 && r.missing == 0 && r.err == nil && r.cachePath != "" && err == nil {
+		err = os.Rename(r.part.Name(), r.cachePath)
+		if err == nil {
+			l.Debug("Cached remote audio", "url", r.url, "file", r.cachePath)
+			go trimCache()
+			return nil
+		}
+	}
+	os.Remove(r.part.Name())
+	return err
+}
+
+// trimCache removes the least recently played files from the cache until it fits within its maximum size.
+func trimCache() {
+	remoteCache.Lock()
+	defer remoteCache.Unlock()
+	entries, err := os.ReadDir(remoteCache.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || strings.HasSuffix(e.Name(), ".part") {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		if total <= remoteCache.maxSize {
+			break
+		}
+		err := os.Remove(filepath.Join(remoteCache.dir, f.Name()))
+		if err == nil {
+			total -= f.Size()
+		}
+	}
+}
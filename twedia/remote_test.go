@@ -0,0 +1,177 @@
+package twedia
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAudio is the content of a remote file, a little over two chunks long.
+func testAudio() []byte {
+	b := make([]byte, 2*chunkSize+1000)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+// useRemoteCache keeps remote files in a temporary directory for the rest of the test.
+func useRemoteCache(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	SetRemoteCache(dir, 0)
+	t.Cleanup(func() { SetRemoteCache("", 0) })
+	return dir
+}
+
+// readRemote opens the remote file at `u`, and reads all of it from `from`.
+func readRemote(t *testing.T, u string, from int64) []byte {
+	t.Helper()
+	f, err := openSource(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if from > 0 {
+		_, err = f.Seek(from, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRemoteFile(t *testing.T) {
+	data := testAudio()
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"ranges", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "song.mp3", time.Time{}, bytes.NewReader(data))
+		}},
+		{"no ranges", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+		}},
+		{"unknown length", func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+			w.Write(data)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useRemoteCache(t)
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			u := srv.URL + "/song.mp3"
+
+			if got := readRemote(t, u, 0); !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, which do not match", len(got))
+			}
+			if got := readRemote(t, u, chunkSize+10); !bytes.Equal(got, data[chunkSize+10:]) {
+				t.Errorf("read %d bytes after seeking, which do not match", len(got))
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ".mp3") {
+				t.Errorf("cache holds %v", entries)
+			}
+		})
+	}
+}
+
+func TestRemoteFileEmpty(t *testing.T) {
+	useRemoteCache(t)
+	for _, status := range []int{http.StatusPartialContent, http.StatusOK} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status == http.StatusPartialContent {
+				w.Header().Set("Content-Range", "bytes */0")
+			}
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(status)
+		}))
+		if got := readRemote(t, srv.URL+"/empty"+strconv.Itoa(status)+".mp3", 0); len(got) != 0 {
+			t.Errorf("%d: read %d bytes from an empty file", status, len(got))
+		}
+		srv.Close()
+	}
+}
+
+func TestRemoteFileReadsAsItArrives(t *testing.T) {
+	useRemoteCache(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(" second"))
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	opened := make(chan source, 1)
+	go func() {
+		f, err := openSource(srv.URL + "/song.mp3")
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- f
+	}()
+	var f source
+	select {
+	case f = <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("opening waited for the whole file")
+	}
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(f, buf)
+	if err != nil || string(buf) != "first" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	release <- struct{}{}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil || end != int64(len("first second")) {
+		t.Errorf("the end is at %d, %v", end, err)
+	}
+}
+
+func TestRemoteFileIdleTimeout(t *testing.T) {
+	old := remoteIdleTimeout
+	remoteIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { remoteIdleTimeout = old })
+	dir := useRemoteCache(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("start"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	f, err := openSource(srv.URL + "/song.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(f)
+	if err == nil || !strings.Contains(err.Error(), "no data arrived") {
+		t.Errorf("got error %v", err)
+	}
+	f.Close()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("cache holds %v after a failed download", entries)
+	}
+}
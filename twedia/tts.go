@@ -2,23 +2,23 @@ package twedia
 
 import (
 	"context"
-	"log"
 	"os"
 
 	texttospeech "cloud.google.com/go/texttospeech/apiv1"
 	"cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
 )
 
-// SynthesiseText uses the Google Cloud Text-to-Speech API to generate an MP3 audio file speaking the provided string t, and returns the file name of the created MP3 file.
+// SynthesiseText uses the Google Cloud Text-to-Speech API to generate an MP3 audio file speaking the provided string t, saving it as fn.
 // NB. this function requires that a valid Google API credential file is present and referred to by the 'GOOGLE_APPLICATION_CREDENTIALS' environment variable.
-func SynthesiseText(t string, fn string) {
+func SynthesiseText(t string, fn string) error {
 	// Instantiates a client.
 	ctx := context.Background()
 
 	client, err := texttospeech.NewClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer client.Close()
 
 	// Perform the text-to-speech request on the text input with the selected
 	// voice parameters and audio file type.
@@ -42,12 +42,9 @@ func SynthesiseText(t string, fn string) {
 
 	resp, err := client.SynthesizeSpeech(ctx, &req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// The resp's AudioContent is binary.
-	err = os.WriteFile(fn, resp.AudioContent, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return os.WriteFile(fn, resp.AudioContent, 0644)
 }
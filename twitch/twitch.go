@@ -1,18 +1,19 @@
 package twitch
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,11 +22,34 @@ import (
 
 const pubSubAPI string = "wss://pubsub-edge.twitch.tv"
 
+var l *slog.Logger = slog.Default()
+
+// SetLogger sets the logger to which the package's log messages are written.
+func SetLogger(logger *slog.Logger) {
+	l = logger
+}
+
+var pubSubConnected atomic.Bool
+
+// PubSubConnected reports whether ListenChannelPoints is currently subscribed to channel point redemptions.
+func PubSubConnected() bool {
+	return pubSubConnected.Load()
+}
+
 type apiResp struct {
 	Users   []user `json:"data"`
 	Status  int    `json:"status"`
 	Message string `json:"message"`
 }
+type streamsResp struct {
+	Streams []stream `json:"data"`
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+}
+type stream struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+}
 type user struct {
 	ID          string `json:"id"`
 	Login       string `json:"login"`
@@ -89,37 +113,69 @@ type pubSub struct {
 	Error string `json:"error"`
 }
 
+// authPage is served at the OAuth redirect URI. Twitch returns the token in the URL fragment,
+// which never reaches the server, so the page sends it on to `/token` itself.
+const authPage = `<!DOCTYPE html>
+<html><head><title>Twedia</title></head><body><p>Authorising Twedia...</p><script>
+const p = new URLSearchParams(location.hash.slice(1));
+const q = new URLSearchParams(location.search);
+if (p.has("access_token")) {
+	fetch("/token?" + new URLSearchParams({access_token: p.get("access_token"), state: p.get("state")}))
+		.then(r => document.body.textContent = r.ok ? "Twedia has been authorised; you may close this page." : "Authorisation failed.");
+} else {
+	document.body.textContent = "Authorisation failed: " + (q.get("error_description") || "no token was received.");
+}
+</script></body></html>`
+
 // GetOAuthToken gets a User OAuth Token from the Twitch API and returns it as a string.
-// This function needs further work: it is not fully automated, requiring user involvement (which also has an ugly UX)
-func GetOAuthToken(clientID string) string {
-	browser.OpenURL("https://id.twitch.tv/oauth2/authorize?client_id=" + clientID + "&redirect_uri=http://localhost&response_type=token&scope=channel_read%20channel:read:redemptions")
-
-	ctx, cancel := context.WithCancel(context.Background())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "Please see token in the address bar and copy to Twedia.")
-		cancel()
+// The user must authorise Twedia in their browser; the authorisation page is opened automatically where possible, and its URL is logged otherwise.
+func GetOAuthToken(clientID string) (string, error) {
+	state := strconv.FormatInt(rand.Int63(), 36)
+	authURL := "https://id.twitch.tv/oauth2/authorize?client_id=" + clientID + "&redirect_uri=http://localhost&response_type=token&scope=channel_read%20channel:read:redemptions&state=" + state
+
+	tokens := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, authPage)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != state || r.URL.Query().Get("access_token") == "" {
+			http.Error(w, "invalid token", http.StatusBadRequest)
+			return
+		}
+		select {
+		case tokens <- r.URL.Query().Get("access_token"):
+		default:
+		}
 	})
-	srv := &http.Server{Addr: ":80"}
-	go srv.ListenAndServe()
-	<-ctx.Done()
-	if err := srv.Shutdown(ctx); err != nil && err != context.Canceled {
-		log.Println(err)
+	// Twitch redirects to http://localhost, so the token can only be received on port 80
+	ln, err := net.Listen("tcp", "localhost:80")
+	if err != nil {
+		return "", fmt.Errorf("unable to listen on port 80 for the token from Twitch: %w", err)
 	}
+	srv := &http.Server{Handler: mux}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
 
-	fmt.Print("Please enter OAuth token: ")
+	l.Warn("Please authorise Twedia with Twitch by visiting: " + authURL)
+	browser.OpenURL(authURL)
 
 	var token string
-	var err error
-	for {
-		reader := bufio.NewReader(os.Stdin)
-		token, err = reader.ReadString('\n')
-		if err == nil {
-			break
-		}
+	select {
+	case token = <-tokens:
+	case err := <-errs:
+		return "", err
 	}
-	token = strings.Replace(strings.Replace(token, "\n", "", -1), "\r", "", -1)
 
-	return token
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		l.Warn("Error stopping the authorisation server", "err", err)
+	}
+
+	return token, nil
 }
 
 // GetChannelID retrieves the channel ID for the OAuth token provided, and returns it as a string
@@ -132,12 +188,12 @@ func GetChannelID(token, clientID string) (string, error) {
 	req.Header.Add("Client-Id", clientID)
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	json.Unmarshal(body, chanInfo)
 
@@ -155,80 +211,130 @@ func GetChannelID(token, clientID string) (string, error) {
 	return chanInfo.Users[0].ID, nil
 }
 
-// ListenChannelPoints starts a WebSocket listening to the Twitch PubSub API for Channel Point redemptions, which calls callback with the provided file handle and the reward title as a string
-func ListenChannelPoints(chanID, clientID, oauthToken string, callback func(Redemption)) {
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+// GetStreamStart returns when the channel's current stream started, or the zero time if the channel is not live.
+func GetStreamStart(token, clientID, chanID string) (time.Time, error) {
+	streams := &streamsResp{}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequest("GET", "https://api.twitch.tv/helix/streams?user_id="+url.QueryEscape(chanID), nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Client-Id", clientID)
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(streams)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if streams.Status != 0 {
+		return time.Time{}, errors.New(strings.ToLower(streams.Message))
+	}
+	if len(streams.Streams) == 0 {
+		return time.Time{}, nil
+	}
+	return streams.Streams[0].StartedAt, nil
+}
 
+// ListenChannelPoints listens to the Twitch PubSub API for Channel Point redemptions, calling callback with each one. It reconnects whenever the connection is lost, and never returns.
+// If Twitch rejects the OAuth token, `reauthorise` is called for a new one, which it is responsible for saving.
+func ListenChannelPoints(chanID, oauthToken string, reauthorise func() (string, error), callback func(Redemption)) {
 	attempts := 0
 	for {
-		attempts++
 		c, _, err := websocket.DefaultDialer.Dial(pubSubAPI, nil)
 		if err != nil {
-			time.Sleep(time.Second + (time.Duration(rand.Intn(1000))*time.Millisecond)*time.Duration(attempts))
-			continue
+			l.Warn("Unable to connect to PubSub", "err", err)
+		} else {
+			var badAuth bool
+			badAuth, err = listenPubSub(c, chanID, oauthToken, callback)
+			c.Close()
+			if pubSubConnected.Swap(false) {
+				// the connection worked for a while, so try again straight away
+				attempts = 0
+			}
+			if badAuth {
+				l.Warn("Bad PubSub auth, requesting new token")
+				token, err := reauthorise()
+				if err != nil {
+					l.Error("Error getting new PubSub token", "err", err)
+				} else {
+					oauthToken = token
+					continue
+				}
+			} else {
+				l.Warn("PubSub connection lost; reconnecting", "err", err)
+			}
 		}
 
-		listenReq := pubSub{
-			Type: "LISTEN",
-			Data: data{
-				Topics: []string{
-					"channel-points-channel-v1." + chanID,
-				},
-				AuthToken: oauthToken,
+		attempts++
+		delay := time.Second + (time.Duration(rand.Intn(1000))*time.Millisecond)*time.Duration(attempts)
+		time.Sleep(min(delay, 2*time.Minute))
+	}
+}
+
+// listenPubSub subscribes to redemptions over the connection `c` and passes them to `callback`, until the connection fails.
+// It reports whether the failure was because Twitch rejected the OAuth token.
+func listenPubSub(c *websocket.Conn, chanID, oauthToken string, callback func(Redemption)) (bool, error) {
+	listenReq := pubSub{
+		Type: "LISTEN",
+		Data: data{
+			Topics: []string{
+				"channel-points-channel-v1." + chanID,
 			},
-		}
-		listenReqJSON, _ := json.Marshal(listenReq)
-		c.WriteMessage(websocket.TextMessage, listenReqJSON)
-
-		go func() {
-			ticker := time.NewTicker(time.Minute)
-			defer ticker.Stop()
-
-			for {
-				select {
-				case <-ticker.C:
-					err := c.WriteMessage(websocket.TextMessage, []byte("{\"type\": \"PING\"}"))
-					if err != nil {
-						log.Println("PubSub write: ", err)
-					}
-				case <-interrupt:
-					err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-					if err != nil {
-						log.Println("PubSub write close: ", err)
-						return
-					}
-					time.Sleep(time.Second)
-					return
+			AuthToken: oauthToken,
+		},
+	}
+	listenReqJSON, _ := json.Marshal(listenReq)
+	err := c.WriteMessage(websocket.TextMessage, listenReqJSON)
+	if err != nil {
+		return false, err
+	}
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := c.WriteMessage(websocket.TextMessage, []byte("{\"type\": \"PING\"}"))
+				if err != nil {
+					l.Warn("PubSub write", "err", err)
 				}
+			case <-done:
+				return
 			}
-		}()
+		}
+	}()
 
-		for {
-			_, msg, err := c.ReadMessage()
-			resp := &pubSub{}
-			json.Unmarshal(msg, resp)
-			if err != nil {
-				log.Println("PubSub read: ", err)
-				continue
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			return false, err
+		}
+		resp := &pubSub{}
+		json.Unmarshal(msg, resp)
+		switch resp.Type {
+		case "RESPONSE":
+			if resp.Error == "ERR_BADAUTH" {
+				return true, nil
+			} else if resp.Error != "" {
+				return false, errors.New("PubSub API error: " + resp.Error)
 			}
-			switch resp.Type {
-			case "RESPONSE":
-				if resp.Error == "ERR_BADAUTH" {
-					log.Println("Bad PubSub auth, requesting new token.")
-					GetOAuthToken(clientID)
-					// this attempt was a failure; interrupt the keepalive and try again
-					interrupt <- os.Interrupt
-					go ListenChannelPoints(chanID, clientID, oauthToken, callback)
-				} else if resp.Error != "" {
-					log.Println("PubSub API error: ", resp.Error)
-				}
-			case "MESSAGE":
-				message := &message{}
-				json.Unmarshal([]byte(resp.Data.Message), message)
-				if message.Type == "reward-redeemed" {
-					callback(message.Data.Redemption)
-				}
+			pubSubConnected.Store(true)
+			l.Info("Listening for channel point redemptions")
+		case "RECONNECT":
+			return false, errors.New("Twitch asked for a reconnection")
+		case "MESSAGE":
+			message := &message{}
+			json.Unmarshal([]byte(resp.Data.Message), message)
+			if message.Type == "reward-redeemed" {
+				l.Debug("Reward redeemed", "reward", message.Data.Redemption.Reward.Title, "user", message.Data.Redemption.User.Login)
+				callback(message.Data.Redemption)
 			}
 		}
 	}
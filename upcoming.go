@@ -0,0 +1,62 @@
+package main
+
+// upcomingEntry is a song which is coming up: a request, or one chosen in advance by the shuffle mode.
+type upcomingEntry struct {
+	Song   string `json:"song"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+	URL    string `json:"url,omitempty"`
+	// Who asked for the song, if anyone.
+	User string `json:"user,omitempty"`
+	// Whether the song is a request, rather than chosen by the shuffle mode.
+	Requested bool `json:"requested"`
+}
+
+// upcomingTracks returns up to `n` of the songs which will play next: the request queue, then,
+// if music carries on after it, the songs chosen in advance.
+func upcomingTracks(n int) []upcomingEntry {
+	var upcoming []upcomingEntry
+	for _, q := range queuedTracks() {
+		if len(upcoming) == n {
+			return upcoming
+		}
+		if vodSafeBlocks(&q.Artist, &q.Album, &q.Song) {
+			// it will be skipped
+			continue
+		}
+		d := trackData(q.Artist, q.Album, q.Song)
+		upcoming = append(upcoming, upcomingEntry{
+			Song:      d.Song,
+			Artist:    d.Artist,
+			Album:     d.Album,
+			URL:       d.URL,
+			User:      q.User,
+			Requested: true,
+		})
+	}
+	if musicPlayer == nil || !musicPlayer.Continuing() {
+		return upcoming
+	}
+	for _, s := range prerolledSongs() {
+		if len(upcoming) == n {
+			break
+		}
+		d := trackData(*s.artist, *s.album, *s.song)
+		upcoming = append(upcoming, upcomingEntry{
+			Song:   d.Song,
+			Artist: d.Artist,
+			Album:  d.Album,
+			URL:    d.URL,
+		})
+	}
+	return upcoming
+}
+
+func runNextAction(_ action, tr trigger) error {
+	sendMessage("upNext", messageData{
+		User:     tr.User,
+		Input:    tr.Input,
+		Upcoming: upcomingTracks(lookahead()),
+	}, tr.MessageID)
+	return nil
+}
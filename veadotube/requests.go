@@ -33,7 +33,7 @@ func newStateEventRequestBasic(payload payloadBasicEvent) string {
 		Payload: payload,
 	})
 	if err != nil {
-		l.Println("Marshaling state event request: ", err)
+		l.Error("Marshaling state event request", "err", err)
 	}
 	return "nodes:" + string(r)
 }
@@ -46,7 +46,7 @@ func newStateEventRequestWithState(payload payloadEventWithState) string {
 		Payload: payload,
 	})
 	if err != nil {
-		l.Println("Marshaling state event request: ", err)
+		l.Error("Marshaling state event request", "err", err)
 	}
 	return "nodes:" + string(r)
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"strings"
+
+	"github.com/gorilla/websocket"
 )
 
 type stateEventResponseList struct {
@@ -48,14 +50,20 @@ type instanceEventResponseInfo struct {
 
 // Listen for messages from the Veadotube WebSocket connection and
 // handle internal state changes appropriately.
-func (v *Veadotube) listen() {
+func (v *Veadotube) listen(conn *websocket.Conn) {
 	respList := &stateEventResponseList{}
 	respPeek := &stateEventResponsePeek{}
 	respInfo := &instanceEventResponseInfo{}
 	for {
-		_, msg, err := v.Connection.ReadMessage()
+		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			l.Println("WebSocket read:", err)
+			l.Error("Lost connection to veadotube", "err", err)
+			v.mu.Lock()
+			if v.Connection == conn {
+				v.Connection = nil
+			}
+			v.mu.Unlock()
+			return
 		}
 		channel, s, _ := strings.Cut(string(msg), ":")
 		msg = bytes.Trim([]byte(s), "\x00")
@@ -82,16 +90,19 @@ func (v *Veadotube) listen() {
 		default:
 		}
 		// we've fallen through - unhandled event!
-		l.Printf("Unhandled message from channel '%s': %s\n", channel, s)
+		l.Debug("Unhandled message", "channel", channel, "message", s)
 	}
 }
 
 func (v *Veadotube) handleResponseStateList(resp *stateEventResponseList) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	for _, state := range resp.Payload.States {
 		v.StateMap[state.Name] = state.Id
 	}
 }
 
 func (v *Veadotube) handleResponseStatePeek(_ *stateEventResponsePeek) {
-	l.Fatal("TODO: handle state peek response")
+	// we don't currently request the state, so only log it
+	l.Debug("Ignoring state peek response")
 }
@@ -3,12 +3,14 @@ package veadotube
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,28 +24,34 @@ type InstanceData struct {
 
 type Veadotube struct {
 	CurrentInstance InstanceData
-	Connection      *websocket.Conn
-	StateMap        map[string]string
+
+	// mu guards the connection, which is also used to send messages one at a time, and the states.
+	mu         sync.Mutex
+	Connection *websocket.Conn
+	StateMap   map[string]string
+	// Name of the state which twedia last switched to.
+	State string
 }
 
-var l *log.Logger = log.New(os.Stdout, "[veadotube] ", log.LstdFlags|log.Lshortfile|log.Lmsgprefix)
+var l *slog.Logger = slog.Default()
 
-// Select a running Veadotube instance from the user's home directory.
-//
-// This function involves direct user input, and may return `nil` on an error
-// or if multiple instances are available to be selected but the user selects
-// none of them.
-func New() (*Veadotube, error) {
+// SetLogger sets the logger to which the package's log messages are written.
+func SetLogger(logger *slog.Logger) {
+	l = logger
+}
+
+// Instances returns the running Veadotube mini instances found in the user's home directory.
+func Instances() ([]InstanceData, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
-		l.Println("Error retrieving home directory:", err)
+		l.Error("Error retrieving home directory", "err", err)
 		return nil, err
 	}
 	s := string(os.PathSeparator)
 	instanceDir := home + s + ".veadotube" + s + "instances"
 	instanceFiles, err := os.ReadDir(instanceDir)
 	if err != nil {
-		l.Println("Error retrieving veadotube instance list:", err)
+		l.Warn("Error retrieving veadotube instance list", "err", err)
 		return nil, err
 	}
 	var instances []InstanceData
@@ -52,28 +60,41 @@ func New() (*Veadotube, error) {
 			i := &InstanceData{}
 			data, err := os.ReadFile(instanceDir + s + f.Name())
 			if err != nil {
-				l.Printf("Error reading instance data for %s: %s\n", f.Name(), err)
+				l.Warn("Error reading instance data", "instance", f.Name(), "err", err)
 				continue
 			}
 			json.Unmarshal(data, i)
 			if (time.Now().Unix() - i.Time) > 10 {
-				l.Println("Skipping stale instance", f.Name())
+				l.Debug("Skipping stale instance", "instance", f.Name())
 				continue
 			}
 			if i.Server == "" || i.Server == ":0" {
-				l.Println("Skipping instance with no websocket server", f.Name())
+				l.Debug("Skipping instance with no websocket server", "instance", f.Name())
 				continue
 			}
 			instances = append(instances, *i)
 		}
 	}
+	return instances, nil
+}
+
+// Select a running Veadotube instance from the user's home directory.
+//
+// This function involves direct user input, and may return `nil` on an error
+// or if multiple instances are available to be selected but the user selects
+// none of them.
+func New() (*Veadotube, error) {
+	instances, err := Instances()
+	if err != nil {
+		return nil, err
+	}
 
 	v := Veadotube{}
 
 	if len(instances) == 1 {
 		v.CurrentInstance = instances[0]
 	} else if len(instances) == 0 {
-		l.Println("No valid instances found.")
+		l.Info("No valid instances found")
 		return nil, nil
 	} else {
 		fmt.Println("Found the following running veadotube mini instances:")
@@ -110,16 +131,50 @@ func New() (*Veadotube, error) {
 	return &v, nil
 }
 
+// Select the running Veadotube instance with the given name, without user input.
+//
+// If `name` is empty, the only running instance is selected. `nil` is returned
+// if there is no matching instance, or if there are several to choose between.
+func NewNamed(name string) (*Veadotube, error) {
+	instances, err := Instances()
+	if err != nil {
+		return nil, err
+	}
+
+	v := Veadotube{
+		StateMap: make(map[string]string),
+	}
+	for _, instance := range instances {
+		if strings.EqualFold(instance.Name, name) {
+			v.CurrentInstance = instance
+			return &v, nil
+		}
+	}
+	if name == "" && len(instances) == 1 {
+		v.CurrentInstance = instances[0]
+		return &v, nil
+	}
+
+	if name == "" && len(instances) > 1 {
+		l.Warn("Multiple instances found, but no instance name was given")
+	} else {
+		l.Warn("No instance with the given name found", "name", name)
+	}
+	return nil, nil
+}
+
 // Connect to the Veadotube instance.
 func (v *Veadotube) Connect() {
-	l.Printf("Connecting to instance %s (%s)...\n", v.CurrentInstance.Name, v.CurrentInstance.Server)
-	var err error
-	v.Connection, _, err = websocket.DefaultDialer.Dial("ws://"+v.CurrentInstance.Server+"?n=twedia", nil)
+	l.Info("Connecting to instance", "instance", v.CurrentInstance.Name, "server", v.CurrentInstance.Server)
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+v.CurrentInstance.Server+"?n=twedia", nil)
 	if err != nil {
-		l.Println("Error connecting to veadotube instance:", err)
+		l.Error("Error connecting to veadotube instance", "err", err)
 		return
 	}
-	l.Println("Connected.")
+	v.mu.Lock()
+	v.Connection = conn
+	v.mu.Unlock()
+	l.Info("Connected")
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 	go func() {
@@ -130,9 +185,9 @@ func (v *Veadotube) Connect() {
 			select {
 			case <-ticker.C:
 			case <-interrupt:
-				err := v.Connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				err := v.send(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 				if err != nil {
-					l.Println("PubSub write close:", err)
+					l.Warn("WebSocket write close", "err", err)
 					return
 				}
 				time.Sleep(time.Second)
@@ -141,29 +196,54 @@ func (v *Veadotube) Connect() {
 		}
 	}()
 
-	go v.listen()
+	go v.listen(conn)
 
-	err = v.Connection.WriteMessage(websocket.TextMessage, []byte(newStateEventRequestBasic(payloadBasicEvent{
+	err = v.send(websocket.TextMessage, []byte(newStateEventRequestBasic(payloadBasicEvent{
 		Event: "list",
 	})))
 	if err != nil {
-		l.Println("Error requesting states list:", err)
+		l.Error("Error requesting states list", "err", err)
 		return
 	}
 }
 
+// send writes a message to the Veadotube instance.
+func (v *Veadotube) send(messageType int, data []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.Connection == nil {
+		return errors.New("no connection")
+	}
+	return v.Connection.WriteMessage(messageType, data)
+}
+
+// Status reports whether twedia is connected to the Veadotube instance, and the name of the
+// state which it last switched to.
+func (v *Veadotube) Status() (bool, string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.Connection != nil, v.State
+}
+
 // Set the active Veadotube state to that with the provided state name.
 func (v *Veadotube) SetState(state string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 	if v.Connection == nil {
-		l.Printf("Failed to set veadotube state to '%s': no connection\n", state)
+		l.Warn("Failed to set veadotube state: no connection", "state", state)
 		return
 	}
 	if v.StateMap[state] == "" {
-		l.Printf("Unknown state '%s'.\n", state)
+		l.Warn("Unknown state", "state", state)
 		return
 	}
-	v.Connection.WriteMessage(websocket.TextMessage, []byte(newStateEventRequestWithState(payloadEventWithState{
+	err := v.Connection.WriteMessage(websocket.TextMessage, []byte(newStateEventRequestWithState(payloadEventWithState{
 		Event: "set",
 		State: v.StateMap[state],
 	})))
+	if err != nil {
+		l.Error("Failed to set veadotube state", "state", state, "err", err)
+		return
+	}
+	v.State = state
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+	"github.com/lyrenhex/twedia/twitch"
+)
+
+type vodSafeConfig struct {
+	// Whether VOD-safe mode is on when twedia starts.
+	Enabled bool `json:"enabled,omitempty"`
+	// Directory in which reports of unsafe music are written; defaults to "vod-reports" in the data directory.
+	ReportDir string `json:"reportDir,omitempty"`
+}
+
+// Whether only music marked as VOD-safe may be played at random or requested.
+var vodSafeMode atomic.Bool
+
+// When twedia started, which is when the stream is assumed to have started if it is not live.
+var startTime = time.Now()
+
+var reportLock sync.Mutex
+
+func isVODSafe(artist *twedia.Artist, album *twedia.Album, song *twedia.Song) bool {
+	return twedia.SongTraits(artist, album, song).VODSafe
+}
+
+// vodSafeBlocks reports whether VOD-safe mode stops the song from being played.
+func vodSafeBlocks(artist *twedia.Artist, album *twedia.Album, song *twedia.Song) bool {
+	return vodSafeMode.Load() && !isVODSafe(artist, album, song)
+}
+
+// shouldReportUnsafe reports whether playing the song should be added to the VOD report: that
+// is, if it is not VOD-safe and either VOD-safe mode is on or the music is marked with `vodSafe`
+// as unsafe, rather than simply not being marked either way.
+func shouldReportUnsafe(artist *twedia.Artist, album *twedia.Album, song *twedia.Song) bool {
+	if isVODSafe(artist, album, song) {
+		return false
+	}
+	return vodSafeMode.Load() || artist.VODSafe != nil || album.VODSafe != nil || song.VODSafe != nil
+}
+
+// setVODSafeMode turns VOD-safe mode "on" or "off", or "toggle"s it.
+func setVODSafeMode(state string) error {
+	switch state {
+	case "on":
+		vodSafeMode.Store(true)
+	case "off":
+		vodSafeMode.Store(false)
+	case "toggle":
+		vodSafeMode.Store(!vodSafeMode.Load())
+	default:
+		return errors.New("unknown VOD-safe state '" + state + "' (expected on, off or toggle)")
+	}
+	// the songs lined up by the shuffle mode may no longer be allowed, or may be missing some
+	rotation.Lock()
+	resetRotation()
+	rotation.Unlock()
+	slog.Info("VOD-safe mode changed", "on", vodSafeMode.Load())
+	return nil
+}
+
+// reportUnsafe adds the time during which a song which is not VOD-safe played to the report for
+// the current stream, so that it can be muted or cut from the VOD. Times are given both from the
+// start of the stream (or of twedia, if the channel is not live) and on the clock.
+func reportUnsafe(artist twedia.Artist, album twedia.Album, song twedia.Song, from, to time.Time) {
+	start, err := twitch.GetStreamStart(pubsubToken(), config.ClientID, channelID)
+	if err != nil {
+		slog.Warn("Unable to find when the stream started", "err", err)
+	}
+	if start.IsZero() {
+		start = startTime
+	}
+
+	dir := filepath.Join(dataDir, "vod-reports")
+	if config.VODSafe != nil && config.VODSafe.ReportDir != "" {
+		dir = config.VODSafe.ReportDir
+	}
+	fn := filepath.Join(dir, "vod-"+start.Local().Format("2006-01-02_150405")+".csv")
+
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		slog.Error("Error writing VOD report", "err", err)
+		return
+	}
+	newFile := !exists(fn)
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Error writing VOD report", "err", err)
+		return
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if newFile {
+		w.Write([]string{"start", "end", "startTime", "endTime", "artist", "album", "title"})
+	}
+	w.Write([]string{
+		streamOffset(from.Sub(start)),
+		streamOffset(to.Sub(start)),
+		from.Format(time.RFC3339),
+		to.Format(time.RFC3339),
+		artist.Artist,
+		album.Name,
+		song.Title,
+	})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		slog.Error("Error writing VOD report", "err", err)
+	}
+}
+
+// streamOffset formats a time within the stream as H:MM:SS.
+func streamOffset(d time.Duration) string {
+	d = max(d, 0).Round(time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lyrenhex/twedia/twedia"
+)
+
+func TestShouldReportUnsafe(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name          string
+		artist, album *bool
+		song          *bool
+		mode          bool
+		want          bool
+	}{
+		{"unmarked", nil, nil, nil, false, false},
+		{"unmarked in VOD-safe mode", nil, nil, nil, true, true},
+		{"marked unsafe", nil, nil, &no, false, true},
+		{"album marked unsafe", nil, &no, nil, false, true},
+		{"artist marked unsafe", &no, nil, nil, false, true},
+		{"marked safe", nil, nil, &yes, true, false},
+		{"safe song on an unsafe album", nil, &no, &yes, false, false},
+		{"unsafe song by a safe artist", &yes, nil, &no, false, true},
+	}
+	defer vodSafeMode.Store(false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vodSafeMode.Store(tt.mode)
+			artist := twedia.Artist{Attributes: twedia.Attributes{VODSafe: tt.artist}}
+			album := twedia.Album{Attributes: twedia.Attributes{VODSafe: tt.album}}
+			song := twedia.Song{Attributes: twedia.Attributes{VODSafe: tt.song}}
+			if got := shouldReportUnsafe(&artist, &album, &song); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamOffset(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0:00:00"},
+		{-time.Minute, "0:00:00"},
+		{1499 * time.Millisecond, "0:00:01"},
+		{1500 * time.Millisecond, "0:00:02"},
+		{59*time.Minute + 59*time.Second, "0:59:59"},
+		{time.Hour, "1:00:00"},
+		{25*time.Hour + 2*time.Minute + 3*time.Second, "25:02:03"},
+	}
+	for _, tt := range tests {
+		if got := streamOffset(tt.d); got != tt.want {
+			t.Errorf("streamOffset(%v) = %s, want %s", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestVODSafeShuffle(t *testing.T) {
+	m := testMusic()
+	yes := true
+	m.Artists[0].Albums[1].VODSafe = &yes // a4
+	m.Artists[1].VODSafe = &yes           // b1, b2
+	useTestCatalog(t, m)
+	defer setVODSafeMode("off")
+	setVODSafeMode("on")
+
+	for _, mode := range []string{"bag", "album"} {
+		setShuffleMode(mode)
+		for i := 0; i < 20; i++ {
+			s, ok := nextSong(nil, nil)
+			if !ok {
+				t.Fatalf("%s: no song was chosen", mode)
+			}
+			if s.artist.Artist == "A" && s.song.Title != "a4" {
+				t.Fatalf("%s: chose %s, which is not VOD-safe", mode, s.song.Title)
+			}
+		}
+	}
+
+	// the songs lined up before VOD-safe mode was turned off are chosen afresh
+	setVODSafeMode("off")
+	setShuffleMode("sequential")
+	if got := titles(prerolledSongs()); len(got) == 0 || got[0] != "a1" {
+		t.Errorf("got %v with VOD-safe mode off", got)
+	}
+}